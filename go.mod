@@ -1,3 +1,3 @@
 module go_loadbalancer
 
-go 1.23.2
+go 1.24
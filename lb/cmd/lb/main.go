@@ -2,13 +2,19 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"go_loadbalancer/lb/internal/backend"
+	"go_loadbalancer/lb/internal/clientcert"
 	"go_loadbalancer/lb/internal/handler"
 	"go_loadbalancer/lb/internal/health"
+	"go_loadbalancer/lb/internal/lb"
 	"go_loadbalancer/lb/internal/queue"
 	"go_loadbalancer/lb/internal/ratelimit"
 	"go_loadbalancer/lb/internal/registry"
@@ -23,6 +29,7 @@ func main() {
 
 	reg.Add(b1)
 	reg.Add(b2)
+	reg.RetryBudget = ratelimit.NewRetryBudget(10*time.Second, 10, 20)
 
 	strat := weightedroundrobin.NewWeightedRoundRobin(map[*backend.Backend]int{
 		b1: 3,
@@ -35,12 +42,40 @@ func main() {
 	h := handler.NewHandler(reg, strat, 3, q)
 	h.GlobalLimiter = limiter
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	q.StartWorkers(10, func(r *queue.Request) {
+		h.ServeBackend(r.W, r.R)
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	hc := health.NewHealthChecker(reg, 5*time.Second, 3, 2)
 	hc.Start(ctx)
 
+	cfg := lb.ListenerConfig{Addr: ":8080", H2C: true}
+	srv := lb.NewServer(cfg, clientcert.Middleware(h))
+
+	ln, err := lb.Listen(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		srv.Shutdown(shutdownCtx)
+		h.Shutdown(shutdownCtx)
+	}()
+
 	log.Println("Load Balancer running on :8080")
-	log.Fatal(http.ListenAndServe(":8080", h))
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	<-drained
 }
@@ -0,0 +1,420 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCA is a minimal RFC 8555 server for one HTTP-01 order at a time. It
+// checks every JWS signature and nonce, and validates challenges by asking
+// solver for the key authorization. Pebble is not available here; this
+// covers the same protocol flow.
+type fakeCA struct {
+	t      *testing.T
+	srv    *httptest.Server
+	solver http.Handler
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu        sync.Mutex
+	nonces    map[string]bool
+	nextNonce int
+	accounts  map[string]*ecdsa.PublicKey
+	registers int
+	domain    string
+	authzOK   bool
+	orderOK   bool
+	cert      []byte
+}
+
+func newFakeCA(t *testing.T) *fakeCA {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(der)
+
+	ca := &fakeCA{
+		t:        t,
+		caKey:    caKey,
+		caCert:   caCert,
+		nonces:   make(map[string]bool),
+		accounts: make(map[string]*ecdsa.PublicKey),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /dir", ca.directory)
+	mux.HandleFunc("HEAD /nonce", func(w http.ResponseWriter, r *http.Request) { ca.setNonce(w) })
+	mux.HandleFunc("POST /", ca.post)
+
+	ca.srv = httptest.NewServer(mux)
+	t.Cleanup(ca.srv.Close)
+
+	return ca
+}
+
+func (ca *fakeCA) url(path string) string {
+	return ca.srv.URL + path
+}
+
+func (ca *fakeCA) directory(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"newNonce":   ca.url("/nonce"),
+		"newAccount": ca.url("/new-account"),
+		"newOrder":   ca.url("/new-order"),
+	})
+}
+
+func (ca *fakeCA) setNonce(w http.ResponseWriter) {
+	ca.mu.Lock()
+	ca.nextNonce++
+	nonce := "n" + strconv.Itoa(ca.nextNonce)
+	ca.nonces[nonce] = true
+	ca.mu.Unlock()
+
+	w.Header().Set("Replay-Nonce", nonce)
+}
+
+func problem(w http.ResponseWriter, status int, typ string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:" + typ, "detail": typ})
+}
+
+// verify checks r's JWS and returns the signer's account URL, the key and
+// the payload.
+func (ca *fakeCA) verify(r *http.Request) (kid string, key *ecdsa.PublicKey, payload []byte, prob string) {
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return "", nil, nil, "malformed"
+	}
+
+	var protected struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  map[string]string
+	}
+	header, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err := json.Unmarshal(header, &protected); err != nil || protected.Alg != "ES256" {
+		return "", nil, nil, "malformed"
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if !ca.nonces[protected.Nonce] {
+		return "", nil, nil, "badNonce"
+	}
+	delete(ca.nonces, protected.Nonce)
+
+	if protected.URL != ca.url(r.URL.Path) {
+		return "", nil, nil, "unauthorized"
+	}
+
+	if protected.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(protected.JWK["x"])
+		y, _ := base64.RawURLEncoding.DecodeString(protected.JWK["y"])
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	} else if key = ca.accounts[protected.Kid]; key == nil {
+		return "", nil, nil, "accountDoesNotExist"
+	}
+
+	sig, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(sig) != 64 || !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return "", nil, nil, "malformed"
+	}
+
+	payload, _ = base64.RawURLEncoding.DecodeString(jws.Payload)
+	return protected.Kid, key, payload, ""
+}
+
+func (ca *fakeCA) post(w http.ResponseWriter, r *http.Request) {
+	ca.setNonce(w)
+
+	_, key, payload, prob := ca.verify(r)
+	if prob != "" {
+		problem(w, http.StatusBadRequest, prob)
+		return
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/new-account":
+		ca.registers++
+		kid := ca.url("/acct/" + strconv.Itoa(ca.registers))
+		ca.accounts[kid] = key
+		w.Header().Set("Location", kid)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status":"valid"}`))
+
+	case "/new-order":
+		var req struct{ Identifiers []Identifier }
+		json.Unmarshal(payload, &req)
+		ca.domain, ca.authzOK, ca.orderOK = req.Identifiers[0].Value, false, false
+
+		w.Header().Set("Location", ca.url("/order"))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(ca.order())
+
+	case "/order":
+		json.NewEncoder(w).Encode(ca.order())
+
+	case "/authz":
+		status := StatusPending
+		if ca.authzOK {
+			status = StatusValid
+		}
+		json.NewEncoder(w).Encode(Authorization{
+			Status:     status,
+			Identifier: Identifier{Type: "dns", Value: ca.domain},
+			Challenges: []Challenge{{Type: ChallengeHTTP01, URL: ca.url("/chall"), Token: "tok"}},
+		})
+
+	case "/chall":
+		// Validate synchronously, as if the CA had fetched the token.
+		rec := httptest.NewRecorder()
+		ca.solver.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, httpChallengePath+"tok", nil))
+		ca.authzOK = rec.Body.String() == "tok."+jwkThumbprint(key)
+		w.Write([]byte(`{}`))
+
+	case "/finalize":
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+
+		if err := ca.issue(der); err != nil {
+			problem(w, http.StatusBadRequest, "badCSR")
+			return
+		}
+		json.NewEncoder(w).Encode(ca.order())
+
+	case "/cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(ca.cert)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (ca *fakeCA) order() Order {
+	o := Order{
+		Status:         StatusPending,
+		Identifiers:    []Identifier{{Type: "dns", Value: ca.domain}},
+		Authorizations: []string{ca.url("/authz")},
+		Finalize:       ca.url("/finalize"),
+	}
+
+	switch {
+	case ca.orderOK:
+		o.Status, o.Certificate = StatusValid, ca.url("/cert")
+	case ca.authzOK:
+		o.Status = StatusReady
+	}
+
+	return o
+}
+
+func (ca *fakeCA) issue(csrDER []byte) error {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil || !ca.authzOK || len(csr.DNSNames) != 1 || csr.DNSNames[0] != ca.domain {
+		return fmt.Errorf("bad CSR")
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: ca.domain},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.caCert, csr.PublicKey, ca.caKey)
+	if err != nil {
+		return err
+	}
+
+	ca.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.caCert.Raw})...)
+	ca.orderOK = true
+
+	return nil
+}
+
+// jwkThumbprint computes the RFC 7638 thumbprint independently of the client.
+func jwkThumbprint(key *ecdsa.PublicKey) string {
+	b, _ := json.Marshal(struct {
+		Crv string `json:"crv"`
+		Kty string `json:"kty"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}{
+		Crv: "P-256",
+		Kty: "EC",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	})
+	sum := sha256.Sum256(b)
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func newTestManager(t *testing.T, ca *fakeCA, dir string) *Manager {
+	t.Helper()
+
+	m, err := NewManager(Config{
+		Domains:      []string{"example.test"},
+		DirectoryURL: ca.url("/dir"),
+		CacheDir:     dir,
+		Challenges:   []string{ChallengeHTTP01},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.solver = m.HTTPHandler(nil)
+
+	return m
+}
+
+func TestObtain(t *testing.T) {
+	ca := newFakeCA(t)
+	dir := t.TempDir()
+	m := newTestManager(t, ca, dir)
+
+	if err := m.Obtain(context.Background(), "example.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "Example.Test."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cert.Leaf.DNSNames; len(got) != 1 || got[0] != "example.test" {
+		t.Fatalf("certificate for %v", got)
+	}
+
+	for _, name := range []string{"account.key", "account.url", "example.test.crt", "example.test.key"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("cache: %v", err)
+		}
+	}
+
+	// A restarted manager loads the certificate from the cache.
+	m = newTestManager(t, ca, dir)
+	if m.needsRenewal("example.test") {
+		t.Fatal("cached certificate not loaded")
+	}
+}
+
+func TestAccountReusedAcrossRestarts(t *testing.T) {
+	ca := newFakeCA(t)
+	dir := t.TempDir()
+
+	for range 2 {
+		m := newTestManager(t, ca, dir)
+		if err := m.Obtain(context.Background(), "example.test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ca.registers != 1 {
+		t.Fatalf("registered %d times, want 1", ca.registers)
+	}
+}
+
+func TestAccountReregisteredWhenUnknown(t *testing.T) {
+	ca := newFakeCA(t)
+	dir := t.TempDir()
+
+	if err := newTestManager(t, ca, dir).Obtain(context.Background(), "example.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The CA forgets the account, as a staging reset does.
+	ca.mu.Lock()
+	clear(ca.accounts)
+	ca.mu.Unlock()
+
+	if err := newTestManager(t, ca, dir).Obtain(context.Background(), "example.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ca.registers != 2 {
+		t.Fatalf("registered %d times, want 2", ca.registers)
+	}
+}
+
+func TestNewKeyDropsCachedAccount(t *testing.T) {
+	ca := newFakeCA(t)
+	dir := t.TempDir()
+
+	if err := newTestManager(t, ca, dir).Obtain(context.Background(), "example.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Remove(filepath.Join(dir, "account.key"))
+
+	m := newTestManager(t, ca, dir)
+	if m.client.kid != "" {
+		t.Fatalf("kept account %q for a new key", m.client.kid)
+	}
+}
+
+func TestSignES256(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough signatures that some r or s values have leading zero bytes.
+	for i := range 200 {
+		digest := sha256.Sum256([]byte(strconv.Itoa(i)))
+
+		sig, err := signES256(key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if len(sig) != 64 || !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+			t.Fatalf("signature %d does not verify", i)
+		}
+	}
+}
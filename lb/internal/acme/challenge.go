@@ -0,0 +1,115 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+
+	// ALPNProto is the protocol a TLS-ALPN-01 validator negotiates.
+	ALPNProto = "acme-tls/1"
+
+	httpChallengePath = "/.well-known/acme-challenge/"
+)
+
+// id-pe-acmeIdentifier, RFC 8737 section 6.1.
+var oidACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// HTTPHandler answers HTTP-01 challenges and passes every other request to
+// next, typically lb.RedirectHandler on the plain-HTTP listener. A nil next
+// responds 404.
+func (m *Manager) HTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.URL.Path, httpChallengePath)
+		if !ok {
+			if next == nil {
+				http.NotFound(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		m.mu.RLock()
+		keyAuth, found := m.httpTokens[token]
+		m.mu.RUnlock()
+
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(keyAuth))
+	})
+}
+
+func isALPNChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == ALPNProto
+}
+
+// alpnCertificate builds the self-signed certificate a TLS-ALPN-01 validator
+// expects: the domain as its only SAN and the key authorization digest in a
+// critical acmeIdentifier extension.
+func alpnCertificate(domain, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(keyAuth))
+	value, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		DNSNames:     []string{domain},
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidACMEIdentifier, Critical: true, Value: value},
+		},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// pickChallenge returns the first challenge offered by the server whose type
+// appears in preferred, honouring the order of preferred.
+func pickChallenge(authz *Authorization, preferred []string) (Challenge, bool) {
+	for _, typ := range preferred {
+		i := slices.IndexFunc(authz.Challenges, func(ch Challenge) bool { return ch.Type == typ })
+		if i >= 0 {
+			return authz.Challenges[i], true
+		}
+	}
+
+	return Challenge{}, false
+}
@@ -0,0 +1,561 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+const (
+	StatusPending    = "pending"
+	StatusProcessing = "processing"
+	StatusReady      = "ready"
+	StatusValid      = "valid"
+	StatusInvalid    = "invalid"
+)
+
+var ErrNotRegistered = errors.New("acme: account not registered")
+
+// Problem is an RFC 7807 error document returned by the ACME server.
+type Problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("acme: %s: %s", p.Type, p.Detail)
+}
+
+type Identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type Order struct {
+	URL            string       `json:"-"`
+	Status         string       `json:"status"`
+	Identifiers    []Identifier `json:"identifiers"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *Problem     `json:"error"`
+}
+
+type Authorization struct {
+	Status     string      `json:"status"`
+	Identifier Identifier  `json:"identifier"`
+	Challenges []Challenge `json:"challenges"`
+}
+
+type Challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Token  string   `json:"token"`
+	Status string   `json:"status"`
+	Error  *Problem `json:"error"`
+}
+
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// Client speaks the subset of RFC 8555 needed to obtain certificates.
+// Requests are signed with ES256 using Key.
+type Client struct {
+	DirectoryURL string
+	HTTPClient   *http.Client
+	Key          *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	dir    *directory
+	kid    string
+	nonces []string
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+
+	return http.DefaultClient
+}
+
+func (c *Client) discover(ctx context.Context) (*directory, error) {
+	c.mu.Lock()
+	dir := c.dir
+	c.mu.Unlock()
+
+	if dir != nil {
+		return dir, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.DirectoryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("acme: fetch directory: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("acme: fetch directory: status %d", resp.StatusCode)
+	}
+
+	dir = &directory{}
+	if err := json.NewDecoder(resp.Body).Decode(dir); err != nil {
+		return nil, fmt.Errorf("acme: decode directory: %w", err)
+	}
+
+	c.mu.Lock()
+	c.dir = dir
+	c.mu.Unlock()
+
+	return dir, nil
+}
+
+func (c *Client) nonce(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	if n := len(c.nonces); n > 0 {
+		nonce := c.nonces[n-1]
+		c.nonces = c.nonces[:n-1]
+		c.mu.Unlock()
+		return nonce, nil
+	}
+	c.mu.Unlock()
+
+	dir, err := c.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, dir.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("acme: fetch nonce: %w", err)
+	}
+	resp.Body.Close()
+
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("acme: server returned no nonce")
+	}
+
+	return nonce, nil
+}
+
+func (c *Client) saveNonce(resp *http.Response) {
+	if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+		c.mu.Lock()
+		c.nonces = append(c.nonces, nonce)
+		c.mu.Unlock()
+	}
+}
+
+// post sends a JWS-signed request. A nil payload sends POST-as-GET. Unless
+// useJWK is set the account's key ID identifies the signer.
+func (c *Client) post(ctx context.Context, url string, payload any, useJWK bool) (*http.Response, error) {
+	for retried := false; ; retried = true {
+		resp, err := c.postOnce(ctx, url, payload, useJWK)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode < 400 {
+			return resp, nil
+		}
+
+		prob := readProblem(resp)
+		if prob.Type == "urn:ietf:params:acme:error:badNonce" && !retried {
+			continue
+		}
+
+		return nil, prob
+	}
+}
+
+func (c *Client) postOnce(ctx context.Context, url string, payload any, useJWK bool) (*http.Response, error) {
+	nonce, err := c.nonce(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	protected := map[string]any{
+		"alg":   "ES256",
+		"nonce": nonce,
+		"url":   url,
+	}
+
+	if useJWK {
+		protected["jwk"] = jwk(c.Key)
+	} else {
+		c.mu.Lock()
+		kid := c.kid
+		c.mu.Unlock()
+
+		if kid == "" {
+			return nil, ErrNotRegistered
+		}
+		protected["kid"] = kid
+	}
+
+	body, err := signJWS(c.Key, protected, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("acme: POST %s: %w", url, err)
+	}
+
+	c.saveNonce(resp)
+
+	return resp, nil
+}
+
+func readProblem(resp *http.Response) *Problem {
+	defer resp.Body.Close()
+
+	prob := &Problem{Status: resp.StatusCode}
+	if err := json.NewDecoder(resp.Body).Decode(prob); err != nil || prob.Type == "" {
+		prob.Type = "about:blank"
+		prob.Detail = http.StatusText(resp.StatusCode)
+	}
+
+	return prob
+}
+
+func decode(resp *http.Response, v any) error {
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Register creates the account for Key, or looks it up if it already exists.
+func (c *Client) Register(ctx context.Context, contact []string) error {
+	dir, err := c.discover(ctx)
+	if err != nil {
+		return err
+	}
+
+	payload := map[string]any{"termsOfServiceAgreed": true}
+	if len(contact) > 0 {
+		payload["contact"] = contact
+	}
+
+	resp, err := c.post(ctx, dir.NewAccount, payload, true)
+	if err != nil {
+		return fmt.Errorf("acme: register account: %w", err)
+	}
+	resp.Body.Close()
+
+	kid := resp.Header.Get("Location")
+	if kid == "" {
+		return errors.New("acme: account response without Location")
+	}
+
+	c.mu.Lock()
+	c.kid = kid
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *Client) NewOrder(ctx context.Context, domains []string) (*Order, error) {
+	dir, err := c.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]Identifier, len(domains))
+	for i, d := range domains {
+		ids[i] = Identifier{Type: "dns", Value: d}
+	}
+
+	resp, err := c.post(ctx, dir.NewOrder, map[string]any{"identifiers": ids}, false)
+	if err != nil {
+		return nil, fmt.Errorf("acme: new order: %w", err)
+	}
+
+	order := &Order{URL: resp.Header.Get("Location")}
+	if err := decode(resp, order); err != nil {
+		return nil, fmt.Errorf("acme: decode order: %w", err)
+	}
+
+	return order, nil
+}
+
+func (c *Client) GetOrder(ctx context.Context, url string) (*Order, error) {
+	resp, err := c.post(ctx, url, nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	order := &Order{URL: url}
+	if err := decode(resp, order); err != nil {
+		return nil, fmt.Errorf("acme: decode order: %w", err)
+	}
+
+	return order, nil
+}
+
+func (c *Client) GetAuthorization(ctx context.Context, url string) (*Authorization, error) {
+	resp, err := c.post(ctx, url, nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	authz := &Authorization{}
+	if err := decode(resp, authz); err != nil {
+		return nil, fmt.Errorf("acme: decode authorization: %w", err)
+	}
+
+	return authz, nil
+}
+
+// Accept tells the server the challenge response is in place.
+func (c *Client) Accept(ctx context.Context, ch Challenge) error {
+	resp, err := c.post(ctx, ch.URL, struct{}{}, false)
+	if err != nil {
+		return fmt.Errorf("acme: accept %s challenge: %w", ch.Type, err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (c *Client) WaitAuthorization(ctx context.Context, url string) error {
+	for {
+		authz, err := c.GetAuthorization(ctx, url)
+		if err != nil {
+			return err
+		}
+
+		switch authz.Status {
+		case StatusValid:
+			return nil
+		case StatusPending, StatusProcessing:
+		default:
+			for _, ch := range authz.Challenges {
+				if ch.Error != nil {
+					return fmt.Errorf("acme: authorization for %s %s: %w", authz.Identifier.Value, authz.Status, ch.Error)
+				}
+			}
+			return fmt.Errorf("acme: authorization for %s %s", authz.Identifier.Value, authz.Status)
+		}
+
+		if err := sleep(ctx, time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+// Finalize submits the DER-encoded CSR and waits for the certificate to be issued.
+func (c *Client) Finalize(ctx context.Context, order *Order, csr []byte) (*Order, error) {
+	payload := map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}
+
+	resp, err := c.post(ctx, order.Finalize, payload, false)
+	if err != nil {
+		return nil, fmt.Errorf("acme: finalize order: %w", err)
+	}
+	resp.Body.Close()
+
+	for {
+		o, err := c.GetOrder(ctx, order.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		switch o.Status {
+		case StatusValid:
+			return o, nil
+		case StatusPending, StatusProcessing, StatusReady:
+		default:
+			if o.Error != nil {
+				return nil, fmt.Errorf("acme: order %s: %w", o.Status, o.Error)
+			}
+			return nil, fmt.Errorf("acme: order %s", o.Status)
+		}
+
+		if err := sleep(ctx, time.Second); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// FetchCertificate downloads the issued chain, leaf first, as DER blocks.
+func (c *Client) FetchCertificate(ctx context.Context, url string) ([][]byte, error) {
+	resp, err := c.post(ctx, url, nil, false)
+	if err != nil {
+		return nil, fmt.Errorf("acme: fetch certificate: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain [][]byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type == "CERTIFICATE" {
+			chain = append(chain, block.Bytes)
+		}
+	}
+
+	if len(chain) == 0 {
+		return nil, errors.New("acme: no certificate in response")
+	}
+
+	return chain, nil
+}
+
+// KeyAuthorization returns the challenge response for token.
+func (c *Client) KeyAuthorization(token string) string {
+	return token + "." + thumbprint(c.Key)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func jwk(key *ecdsa.PrivateKey) map[string]string {
+	pub, _ := key.PublicKey.ECDH()
+	point := pub.Bytes()
+	size := (len(point) - 1) / 2
+
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   base64.RawURLEncoding.EncodeToString(point[1 : 1+size]),
+		"y":   base64.RawURLEncoding.EncodeToString(point[1+size:]),
+	}
+}
+
+// thumbprint is the RFC 7638 JWK thumbprint: members in lexicographic order.
+func thumbprint(key *ecdsa.PrivateKey) string {
+	k := jwk(key)
+	canonical := `{"crv":"` + k["crv"] + `","kty":"` + k["kty"] + `","x":"` + k["x"] + `","y":"` + k["y"] + `"}`
+	sum := sha256.Sum256([]byte(canonical))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func signJWS(key *ecdsa.PrivateKey, protected map[string]any, payload any) ([]byte, error) {
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+
+	var encodedPayload string
+	if payload != nil {
+		p, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		encodedPayload = base64.RawURLEncoding.EncodeToString(p)
+	}
+
+	encodedHeader := base64.RawURLEncoding.EncodeToString(header)
+	digest := sha256.Sum256([]byte(encodedHeader + "." + encodedPayload))
+
+	sig, err := signES256(key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]string{
+		"protected": encodedHeader,
+		"payload":   encodedPayload,
+		"signature": base64.RawURLEncoding.EncodeToString(sig),
+	})
+}
+
+// signES256 returns the fixed-width r||s signature JWS expects rather than
+// the ASN.1 form crypto/ecdsa produces.
+func signES256(key *ecdsa.PrivateKey, digest []byte) ([]byte, error) {
+	der, err := key.Sign(rand.Reader, digest, crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	return derToRaw(der, 32)
+}
+
+func derToRaw(der []byte, size int) ([]byte, error) {
+	// SEQUENCE { INTEGER r, INTEGER s }
+	if len(der) < 8 || der[0] != 0x30 {
+		return nil, errors.New("acme: malformed ECDSA signature")
+	}
+
+	rest := der[2:]
+	if der[1]&0x80 != 0 {
+		rest = der[2+int(der[1]&0x7f):]
+	}
+
+	out := make([]byte, 2*size)
+	for i := 0; i < 2; i++ {
+		if len(rest) < 2 || rest[0] != 0x02 {
+			return nil, errors.New("acme: malformed ECDSA signature")
+		}
+
+		n := int(rest[1])
+		if len(rest) < 2+n {
+			return nil, errors.New("acme: malformed ECDSA signature")
+		}
+
+		v := bytes.TrimLeft(rest[2:2+n], "\x00")
+		if len(v) > size {
+			return nil, errors.New("acme: malformed ECDSA signature")
+		}
+
+		copy(out[(i+1)*size-len(v):(i+1)*size], v)
+		rest = rest[2+n:]
+	}
+
+	return out, nil
+}
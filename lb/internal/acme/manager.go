@@ -0,0 +1,484 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoCertificate = errors.New("acme: no certificate for server name")
+
+const (
+	DefaultRenewBefore   = 30 * 24 * time.Hour
+	DefaultCheckInterval = 12 * time.Hour
+	renewRetryInterval   = time.Hour
+)
+
+type Config struct {
+	Domains []string
+	// DirectoryURL defaults to Let's Encrypt production. Point it at a
+	// Pebble instance for testing.
+	DirectoryURL string
+	Email        string
+	// CacheDir holds the account key, the account URL it is registered
+	// under and one <domain>.crt/<domain>.key pair per domain.
+	CacheDir string
+	// Challenges lists the challenge types to use, most preferred first.
+	// Defaults to HTTP-01 then TLS-ALPN-01.
+	Challenges    []string
+	RenewBefore   time.Duration
+	CheckInterval time.Duration
+	// HTTPClient talks to the ACME server; give it a transport trusting the
+	// test CA when running against Pebble.
+	HTTPClient *http.Client
+	// Fallback serves names the manager holds no certificate for, such as
+	// a certs.Store with manually managed certificates.
+	Fallback func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// Manager obtains certificates for its domains, keeps them on disk and
+// renews them before they expire.
+type Manager struct {
+	cfg    Config
+	client *Client
+
+	mu         sync.RWMutex
+	certs      map[string]*tls.Certificate
+	httpTokens map[string]string
+	alpnCerts  map[string]*tls.Certificate
+}
+
+func NewManager(cfg Config) (*Manager, error) {
+	if cfg.CacheDir == "" {
+		return nil, errors.New("acme: CacheDir is required")
+	}
+	if cfg.DirectoryURL == "" {
+		cfg.DirectoryURL = LetsEncryptURL
+	}
+	if len(cfg.Challenges) == 0 {
+		cfg.Challenges = []string{ChallengeHTTP01, ChallengeTLSALPN01}
+	}
+	if cfg.RenewBefore == 0 {
+		cfg.RenewBefore = DefaultRenewBefore
+	}
+	if cfg.CheckInterval == 0 {
+		cfg.CheckInterval = DefaultCheckInterval
+	}
+
+	if err := os.MkdirAll(cfg.CacheDir, 0o700); err != nil {
+		return nil, fmt.Errorf("acme: create cache dir: %w", err)
+	}
+
+	key, created, err := loadOrCreateKey(filepath.Join(cfg.CacheDir, "account.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		cfg: cfg,
+		client: &Client{
+			DirectoryURL: cfg.DirectoryURL,
+			HTTPClient:   cfg.HTTPClient,
+			Key:          key,
+		},
+		certs:      make(map[string]*tls.Certificate),
+		httpTokens: make(map[string]string),
+		alpnCerts:  make(map[string]*tls.Certificate),
+	}
+
+	// An account URL only belongs to the key it was registered with.
+	if created {
+		os.Remove(m.accountPath())
+	} else if data, err := os.ReadFile(m.accountPath()); err == nil {
+		m.client.kid = strings.TrimSpace(string(data))
+	}
+
+	for _, domain := range cfg.Domains {
+		cert, err := m.loadCert(domain)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.Printf("acme: ignoring cached certificate for %s: %v", domain, err)
+			}
+			continue
+		}
+		m.certs[strings.ToLower(domain)] = cert
+	}
+
+	return m, nil
+}
+
+// Start obtains missing or expiring certificates and then renews them in the
+// background until ctx is done. The challenge listeners must already be
+// serving HTTPHandler or TLSConfig, otherwise validation fails.
+func (m *Manager) Start(ctx context.Context) {
+	go func() {
+		for {
+			next := m.cfg.CheckInterval
+			if err := m.renewAll(ctx); err != nil {
+				log.Printf("acme: %v", err)
+				next = renewRetryInterval
+			}
+
+			if err := sleep(ctx, next); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (m *Manager) renewAll(ctx context.Context) error {
+	var errs []error
+
+	for _, domain := range m.cfg.Domains {
+		if !m.needsRenewal(domain) {
+			continue
+		}
+
+		if err := m.Obtain(ctx, domain); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		log.Printf("acme: obtained certificate for %s", domain)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (m *Manager) needsRenewal(domain string) bool {
+	m.mu.RLock()
+	cert := m.certs[strings.ToLower(domain)]
+	m.mu.RUnlock()
+
+	return cert == nil || time.Until(cert.Leaf.NotAfter) < m.cfg.RenewBefore
+}
+
+// Obtain runs a complete order for domain and installs the new certificate.
+func (m *Manager) Obtain(ctx context.Context, domain string) error {
+	if err := m.register(ctx); err != nil {
+		return err
+	}
+
+	order, err := m.client.NewOrder(ctx, []string{domain})
+	if isAccountGone(err) {
+		// The server no longer knows the cached account; register afresh.
+		m.client.mu.Lock()
+		m.client.kid = ""
+		m.client.mu.Unlock()
+
+		if err := m.register(ctx); err != nil {
+			return err
+		}
+		order, err = m.client.NewOrder(ctx, []string{domain})
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, url := range order.Authorizations {
+		if err := m.authorize(ctx, url); err != nil {
+			return err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return fmt.Errorf("acme: create CSR: %w", err)
+	}
+
+	order, err = m.client.Finalize(ctx, order, csr)
+	if err != nil {
+		return err
+	}
+
+	chain, err := m.client.FetchCertificate(ctx, order.Certificate)
+	if err != nil {
+		return err
+	}
+
+	cert, err := m.storeCert(domain, chain, key)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.certs[strings.ToLower(domain)] = cert
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *Manager) register(ctx context.Context) error {
+	m.client.mu.Lock()
+	registered := m.client.kid != ""
+	m.client.mu.Unlock()
+
+	if registered {
+		return nil
+	}
+
+	var contact []string
+	if m.cfg.Email != "" {
+		contact = []string{"mailto:" + m.cfg.Email}
+	}
+
+	if err := m.client.Register(ctx, contact); err != nil {
+		return err
+	}
+
+	m.client.mu.Lock()
+	kid := m.client.kid
+	m.client.mu.Unlock()
+
+	// Without the account URL every restart would register again.
+	if err := writeFile(m.accountPath(), []byte(kid+"\n"), 0o600); err != nil {
+		log.Printf("acme: cache account URL: %v", err)
+	}
+
+	return nil
+}
+
+func (m *Manager) accountPath() string {
+	return filepath.Join(m.cfg.CacheDir, "account.url")
+}
+
+func isAccountGone(err error) bool {
+	var prob *Problem
+	return errors.As(err, &prob) && prob.Type == "urn:ietf:params:acme:error:accountDoesNotExist"
+}
+
+func (m *Manager) authorize(ctx context.Context, url string) error {
+	authz, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	if authz.Status == StatusValid {
+		return nil
+	}
+
+	ch, ok := pickChallenge(authz, m.cfg.Challenges)
+	if !ok {
+		return fmt.Errorf("acme: no supported challenge for %s", authz.Identifier.Value)
+	}
+
+	cleanup, err := m.provision(authz.Identifier.Value, ch)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if err := m.client.Accept(ctx, ch); err != nil {
+		return err
+	}
+
+	return m.client.WaitAuthorization(ctx, url)
+}
+
+// provision publishes the challenge response and returns a func removing it.
+func (m *Manager) provision(domain string, ch Challenge) (func(), error) {
+	keyAuth := m.client.KeyAuthorization(ch.Token)
+
+	switch ch.Type {
+	case ChallengeHTTP01:
+		m.mu.Lock()
+		m.httpTokens[ch.Token] = keyAuth
+		m.mu.Unlock()
+
+		return func() {
+			m.mu.Lock()
+			delete(m.httpTokens, ch.Token)
+			m.mu.Unlock()
+		}, nil
+	case ChallengeTLSALPN01:
+		cert, err := alpnCertificate(domain, keyAuth)
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.ToLower(domain)
+		m.mu.Lock()
+		m.alpnCerts[name] = cert
+		m.mu.Unlock()
+
+		return func() {
+			m.mu.Lock()
+			delete(m.alpnCerts, name)
+			m.mu.Unlock()
+		}, nil
+	}
+
+	return nil, fmt.Errorf("acme: unsupported challenge %s", ch.Type)
+}
+
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	m.mu.RLock()
+	var cert *tls.Certificate
+	if isALPNChallenge(hello) {
+		cert = m.alpnCerts[name]
+	} else {
+		cert = m.certs[name]
+	}
+	m.mu.RUnlock()
+
+	if cert != nil {
+		return cert, nil
+	}
+
+	if m.cfg.Fallback != nil && !isALPNChallenge(hello) {
+		return m.cfg.Fallback(hello)
+	}
+
+	return nil, ErrNoCertificate
+}
+
+// TLSConfig returns a server configuration that serves managed certificates
+// and answers TLS-ALPN-01 challenges. It lists only the challenge protocol
+// in NextProtos: http.Server.ServeTLS appends h2, when the server's
+// Protocols enable it, and http/1.1. Servers that wrap the listener with
+// tls.NewListener themselves must add those protocols.
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{ALPNProto},
+	}
+}
+
+func (m *Manager) certPaths(domain string) (certFile, keyFile string) {
+	base := filepath.Join(m.cfg.CacheDir, strings.ToLower(domain))
+	return base + ".crt", base + ".key"
+}
+
+func (m *Manager) loadCert(domain string) (*tls.Certificate, error) {
+	certFile, keyFile := m.certPaths(domain)
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	return &cert, nil
+}
+
+func (m *Manager) storeCert(domain string, chain [][]byte, key *ecdsa.PrivateKey) (*tls.Certificate, error) {
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, fmt.Errorf("acme: parse issued certificate: %w", err)
+	}
+
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	certFile, keyFile := m.certPaths(domain)
+	if err := writeFile(keyFile, keyPEM, 0o600); err != nil {
+		return nil, err
+	}
+	if err := writeFile(certFile, certPEM, 0o644); err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// loadOrCreateKey reads the account key at path, generating and storing a
+// new one if there is none; created reports which happened.
+func loadOrCreateKey(path string) (key *ecdsa.PrivateKey, created bool, err error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, false, fmt.Errorf("acme: no PEM data in %s", path)
+		}
+
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, false, fmt.Errorf("acme: parse account key: %w", err)
+		}
+
+		return key, false, nil
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, false, err
+	}
+
+	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, false, err
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := writeFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, false, err
+	}
+
+	return key, true, nil
+}
+
+// writeFile replaces path atomically so a crash never leaves a torn file.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
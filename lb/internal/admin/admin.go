@@ -1 +1,131 @@
 package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go_loadbalancer/lb/internal/gateway"
+)
+
+// Handler serves the admin API. It performs no authentication and the lb
+// binary does not mount it: it is a library for programs that embed a
+// Gateway, which must serve it on a separate listener behind their own
+// authentication, never on the proxy's public listener.
+//
+//	GET  /routes/{name}/split         current weights
+//	PUT  /routes/{name}/split         {"weights": {"stable": 90, "canary": 10}}
+//	POST /routes/{name}/split/shift   {"weights": {...}, "step": 5, "interval": "1m"}
+type Handler struct {
+	Gateway *gateway.Gateway
+
+	mux *http.ServeMux
+}
+
+func NewHandler(g *gateway.Gateway) *Handler {
+	h := &Handler{Gateway: g, mux: http.NewServeMux()}
+
+	h.mux.HandleFunc("GET /routes/{name}/split", h.getSplit)
+	h.mux.HandleFunc("PUT /routes/{name}/split", h.setSplit)
+	h.mux.HandleFunc("POST /routes/{name}/split/shift", h.shiftSplit)
+
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+type splitRequest struct {
+	Weights  map[string]int `json:"weights"`
+	Step     int            `json:"step,omitempty"`
+	Interval string         `json:"interval,omitempty"`
+}
+
+type splitResponse struct {
+	Route   string         `json:"route"`
+	Weights map[string]int `json:"weights"`
+}
+
+func (h *Handler) split(w http.ResponseWriter, r *http.Request) *gateway.TrafficSplit {
+	route := h.Gateway.Route(r.PathValue("name"))
+	if route == nil {
+		writeError(w, http.StatusNotFound, "route not found")
+		return nil
+	}
+
+	if route.Split == nil {
+		writeError(w, http.StatusConflict, "route has no traffic split")
+		return nil
+	}
+
+	return route.Split
+}
+
+func (h *Handler) getSplit(w http.ResponseWriter, r *http.Request) {
+	ts := h.split(w, r)
+	if ts == nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, splitResponse{Route: r.PathValue("name"), Weights: ts.Weights()})
+}
+
+func (h *Handler) setSplit(w http.ResponseWriter, r *http.Request) {
+	ts := h.split(w, r)
+	if ts == nil {
+		return
+	}
+
+	var req splitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := ts.SetWeights(req.Weights); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, splitResponse{Route: r.PathValue("name"), Weights: ts.Weights()})
+}
+
+func (h *Handler) shiftSplit(w http.ResponseWriter, r *http.Request) {
+	ts := h.split(w, r)
+	if ts == nil {
+		return
+	}
+
+	var req splitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	interval, err := time.ParseDuration(req.Interval)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid interval: "+err.Error())
+		return
+	}
+
+	// The shift outlives this request; it ends when the weights reach the
+	// target or are set again, or when SetRoutes drops the split.
+	if err := ts.ShiftTo(context.Background(), req.Weights, req.Step, interval); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, splitResponse{Route: r.PathValue("name"), Weights: ts.Weights()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -1,6 +1,10 @@
 package backend
 
 import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -15,34 +19,60 @@ type Backend struct {
 	Proxy     *httputil.ReverseProxy
 	Alive     atomic.Bool
 	Transport *http.Transport
+	Protocol  Protocol
+	TLSConfig *tls.Config
 	Failures  atomic.Int32
 	Successes atomic.Int32
 
 	CB *circuitbreaker.CircuitBreaker
+
+	// ProxyProtocol is the PROXY protocol version sent on new connections,
+	// or 0 for none.
+	ProxyProtocol int
 }
 
 func CreateNewBackend(rawURL string, timeout time.Duration) (*Backend, error) {
+	return CreateNewBackendWithOptions(rawURL, DefaultOptions(timeout))
+}
+
+func CreateNewBackendWithOptions(rawURL string, opts Options) (*Backend, error) {
 	parsed, err := url.Parse(rawURL)
 
 	if err != nil {
 		return nil, err
 	}
 
-	transport := &http.Transport{
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ResponseHeaderTimeout: timeout,
+	var tlsConfig *tls.Config
+	if parsed.Scheme == "https" {
+		tlsOpts := opts.TLS
+		if tlsOpts == nil {
+			tlsOpts = &TLSOptions{}
+		}
+
+		if tlsConfig, err = tlsOpts.Config(parsed.Hostname()); err != nil {
+			return nil, err
+		}
 	}
 
+	transport := newTransport(opts, tlsConfig)
+
 	proxy := httputil.NewSingleHostReverseProxy(parsed)
+	proxy.Director = director(proxy.Director, parsed, opts)
 	proxy.Transport = transport
+	if opts.ProxyProtocol > 0 {
+		proxy.Transport = proxyProtocolTransport{transport}
+	}
+	proxy.ErrorHandler = proxyErrorHandler
 
 	b := &Backend{
 		URL:       parsed,
 		Proxy:     proxy,
 		Transport: transport,
+		Protocol:  opts.Protocol,
+		TLSConfig: tlsConfig,
 		CB:        circuitbreaker.NewCircuitBreaker(3, 5*time.Second),
+
+		ProxyProtocol: opts.ProxyProtocol,
 	}
 
 	b.Alive.Store(true)
@@ -70,16 +100,93 @@ func (b *Backend) IncrementSuccessCount() { b.Successes.Add(1) }
 func (b *Backend) ResetSuccessCount()     { b.Successes.Store(0) }
 func (b *Backend) SuccessCount() int32    { return b.Successes.Load() }
 
-func (b *Backend) RecordSuccess() {
+// Allow asks the backend's breaker to admit a request. Backends without a
+// breaker admit everything with a zero permit.
+func (b *Backend) Allow() (circuitbreaker.Permit, bool) {
+	if b.CB == nil {
+		return circuitbreaker.Permit{}, true
+	}
+
+	return b.CB.Allow()
+}
+
+func (b *Backend) RecordSuccess(p circuitbreaker.Permit, latency time.Duration) {
 	b.IncrementSuccessCount()
-	b.CB.AfterRequestSuccess()
+	p.Record(true, latency)
 }
 
-func (b *Backend) RecordFailure() {
+func (b *Backend) RecordFailure(p circuitbreaker.Permit, latency time.Duration) {
 	b.IncrementFailCount()
-	b.CB.AfterRequestFailure()
+	p.Record(false, latency)
 
-	if b.FailCount() >= b.CB.FailureThreshold {
+	if b.CB != nil && b.CB.FailureThreshold > 0 && b.FailCount() >= b.CB.FailureThreshold {
 		b.MarkDead()
 	}
 }
+
+func director(next func(*http.Request), target *url.URL, opts Options) func(*http.Request) {
+	return func(req *http.Request) {
+		next(req)
+		opts.Forwarding.Apply(req)
+
+		switch {
+		case opts.Host != "":
+			req.Host = opts.Host
+		case opts.RewriteHost:
+			req.Host = target.Host
+		}
+	}
+}
+
+type proxyErrorSetter interface {
+	SetProxyError(err error)
+}
+
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if es, ok := w.(proxyErrorSetter); ok {
+		es.SetProxyError(err)
+	}
+
+	log.Printf("http: proxy error: %v", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// Dial opens a raw connection to the backend, speaking TLS for https URLs
+// and UDP for udp URLs. It is used for traffic that bypasses the reverse
+// proxy, such as upgrades and layer-4 modes. The PROXY protocol header is
+// built from the client addresses in ctx, see proxyproto.WithAddrs.
+func (b *Backend) Dial(ctx context.Context) (net.Conn, error) {
+	host := b.URL.Host
+	if b.URL.Port() == "" {
+		port := "80"
+		if b.URL.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(b.URL.Hostname(), port)
+	}
+
+	network := "tcp"
+	if b.URL.Scheme == "udp" {
+		network = "udp"
+	}
+
+	conn, err := dialRaw(ctx, network, host, b.ProxyProtocol)
+	if err != nil || b.URL.Scheme != "https" {
+		return conn, err
+	}
+
+	cfg := &tls.Config{ServerName: b.URL.Hostname()}
+	if b.TLSConfig != nil {
+		cfg = b.TLSConfig.Clone()
+	}
+	// Raw connections carry HTTP/1.1 upgrades, never h2.
+	cfg.NextProtos = []string{"http/1.1"}
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
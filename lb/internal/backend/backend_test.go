@@ -0,0 +1,51 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordWithoutBreaker(t *testing.T) {
+	b, err := CreateNewBackend("http://127.0.0.1:1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.CB = nil
+
+	for range 10 {
+		permit, ok := b.Allow()
+		if !ok {
+			t.Fatal("backend without a breaker refused a request")
+		}
+		b.RecordFailure(permit, time.Millisecond)
+	}
+
+	permit, _ := b.Allow()
+	b.RecordSuccess(permit, time.Millisecond)
+
+	if !b.IsAlive() {
+		t.Fatal("failures marked a backend without a breaker dead")
+	}
+	if b.FailCount() != 10 || b.SuccessCount() != 1 {
+		t.Fatalf("counted %d failures and %d successes", b.FailCount(), b.SuccessCount())
+	}
+}
+
+func TestRecordFailureMarksDead(t *testing.T) {
+	b, err := CreateNewBackend("http://127.0.0.1:1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int32(0); i < b.CB.FailureThreshold; i++ {
+		if !b.IsAlive() {
+			t.Fatalf("dead after %d failures", i)
+		}
+		permit, _ := b.Allow()
+		b.RecordFailure(permit, time.Millisecond)
+	}
+
+	if b.IsAlive() {
+		t.Fatal("alive past the failure threshold")
+	}
+}
@@ -0,0 +1,129 @@
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"go_loadbalancer/lb/internal/forwarded"
+)
+
+type Protocol int
+
+const (
+	HTTP1 Protocol = iota
+	// HTTP2 speaks HTTP/2 over TLS, negotiated with ALPN.
+	HTTP2
+	// H2C speaks cleartext HTTP/2 with prior knowledge.
+	H2C
+)
+
+func ParseProtocol(s string) (Protocol, error) {
+	switch s {
+	case "", "http1", "http/1.1":
+		return HTTP1, nil
+	case "h2", "http2":
+		return HTTP2, nil
+	case "h2c":
+		return H2C, nil
+	}
+
+	return HTTP1, fmt.Errorf("unknown upstream protocol %q", s)
+}
+
+func (p Protocol) String() string {
+	switch p {
+	case HTTP2:
+		return "h2"
+	case H2C:
+		return "h2c"
+	}
+
+	return "http/1.1"
+}
+
+type Options struct {
+	Timeout  time.Duration
+	Protocol Protocol
+	// TLS configures https backends; nil uses the system roots and the URL
+	// host as server name.
+	TLS *TLSOptions
+	// ProxyProtocol sends a PROXY protocol header of this version (1 or 2)
+	// on each backend connection. HTTP keep-alive is disabled because a
+	// header identifies one client.
+	ProxyProtocol int
+
+	// Forwarding controls X-Forwarded-*, X-Real-IP and Forwarded headers;
+	// nil trusts no proxies and drops the client's forwarding headers, see
+	// forwarded.Config.
+	Forwarding *forwarded.Config
+	// Host is sent as the Host header instead of the client's. RewriteHost
+	// sends the backend URL's host; by default the client's Host passes
+	// through.
+	Host        string
+	RewriteHost bool
+
+	// Connection pooling; MaxIdleConnsPerHost only applies to HTTP/1.1.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+
+	// HTTP/2 connection tuning, used for HTTP2 and H2C.
+	MaxReceiveBufferPerConnection int
+	MaxReadFrameSize              int
+	SendPingTimeout               time.Duration
+	PingTimeout                   time.Duration
+}
+
+func DefaultOptions(timeout time.Duration) Options {
+	return Options{
+		Timeout:         timeout,
+		Protocol:        HTTP1,
+		MaxIdleConns:    100,
+		IdleConnTimeout: 90 * time.Second,
+	}
+}
+
+func newTransport(opts Options, tlsConfig *tls.Config) *http.Transport {
+	transport := &http.Transport{
+		MaxIdleConns:          opts.MaxIdleConns,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       opts.MaxConnsPerHost,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: opts.Timeout,
+		Protocols:             new(http.Protocols),
+	}
+
+	switch opts.Protocol {
+	case HTTP2:
+		transport.Protocols.SetHTTP2(true)
+	case H2C:
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	default:
+		transport.Protocols.SetHTTP1(true)
+	}
+
+	if opts.ProxyProtocol > 0 {
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialRaw(ctx, network, addr, opts.ProxyProtocol)
+		}
+		transport.DisableKeepAlives = true
+	}
+
+	if opts.Protocol != HTTP1 {
+		transport.HTTP2 = &http.HTTP2Config{
+			MaxReceiveBufferPerConnection: opts.MaxReceiveBufferPerConnection,
+			MaxReadFrameSize:              opts.MaxReadFrameSize,
+			SendPingTimeout:               opts.SendPingTimeout,
+			PingTimeout:                   opts.PingTimeout,
+		}
+	}
+
+	return transport
+}
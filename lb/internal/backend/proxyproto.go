@@ -0,0 +1,40 @@
+package backend
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"go_loadbalancer/lb/internal/proxyproto"
+)
+
+// dialRaw opens a plain connection and, for PROXY protocol backends, sends
+// the header for the client carried in ctx before anything else.
+func dialRaw(ctx context.Context, network, addr string, proxyProtocol int) (net.Conn, error) {
+	d := &net.Dialer{Timeout: 10 * time.Second}
+
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil || proxyProtocol == 0 || network != "tcp" {
+		return conn, err
+	}
+
+	if _, err := conn.Write(proxyproto.HeaderFor(ctx, proxyProtocol).Format()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// proxyProtocolTransport hands the client's addresses to the dialer. The
+// header describes a single client, so the transport must not reuse
+// connections across requests.
+type proxyProtocolTransport struct {
+	http.RoundTripper
+}
+
+func (t proxyProtocolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := proxyproto.WithRequestAddrs(req.Context(), req)
+	return t.RoundTripper.RoundTrip(req.WithContext(ctx))
+}
@@ -0,0 +1,147 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+var ErrPinMismatch = errors.New("backend certificate does not match any pin")
+
+// TLSOptions configures TLS to an https backend. Share one value between the
+// backends of a pool to apply the same settings pool-wide.
+type TLSOptions struct {
+	// CAFile is a PEM bundle of roots trusted for backend certificates;
+	// empty uses the system roots.
+	CAFile string
+	// CertFile and KeyFile hold the client certificate presented for mTLS.
+	CertFile string
+	KeyFile  string
+
+	// ServerName overrides the SNI sent, which defaults to the URL host.
+	ServerName string
+	// VerifyName, when set, is the name the certificate must be valid for
+	// instead of the SNI name.
+	VerifyName         string
+	InsecureSkipVerify bool
+
+	// Pins are base64 SHA-256 digests of SubjectPublicKeyInfo, as used by
+	// HPKP. When set, some certificate in a verified chain must match; with
+	// InsecureSkipVerify only the leaf can.
+	Pins []string
+
+	MinVersion uint16
+}
+
+// Config builds the client TLS configuration for a backend at host.
+func (o *TLSOptions) Config(host string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         host,
+		MinVersion:         o.MinVersion,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+
+	if o.ServerName != "" {
+		cfg.ServerName = o.ServerName
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read backend CA bundle: %w", err)
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in backend CA bundle %s", o.CAFile)
+		}
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load backend client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	verifyName := o.VerifyName != "" && !o.InsecureSkipVerify
+	if verifyName {
+		// crypto/tls always verifies against ServerName, so skip its check
+		// and verify against VerifyName ourselves.
+		cfg.InsecureSkipVerify = true
+	}
+
+	if verifyName || len(o.Pins) > 0 {
+		roots := cfg.RootCAs
+		pins := o.Pins
+		insecure := o.InsecureSkipVerify
+
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			// Pins only count on verified chains: the peer may send any
+			// certificate it likes alongside its own.
+			chains := cs.VerifiedChains
+			switch {
+			case verifyName:
+				var err error
+				if chains, err = verifyChain(cs.PeerCertificates, roots, o.VerifyName); err != nil {
+					return err
+				}
+			case insecure:
+				// Nothing is verified, so only the leaf, which the peer
+				// proved it holds the key for, can be pinned.
+				chains = nil
+				if len(cs.PeerCertificates) > 0 {
+					chains = [][]*x509.Certificate{cs.PeerCertificates[:1]}
+				}
+			}
+
+			if len(pins) > 0 && !matchesPin(chains, pins) {
+				return ErrPinMismatch
+			}
+
+			return nil
+		}
+	}
+
+	return cfg, nil
+}
+
+func verifyChain(certs []*x509.Certificate, roots *x509.CertPool, name string) ([][]*x509.Certificate, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("backend presented no certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+
+	return certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       name,
+	})
+}
+
+func matchesPin(chains [][]*x509.Certificate, pins []string) bool {
+	for _, chain := range chains {
+		for _, c := range chain {
+			sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+			if slices.Contains(pins, base64.StdEncoding.EncodeToString(sum[:])) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
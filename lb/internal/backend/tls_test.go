@@ -0,0 +1,263 @@
+package backend
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, issued by parent or self-signed.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func issue(t *testing.T, name string, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if isCA {
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.DNSNames = []string{name}
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) pin() string {
+	sum := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// tlsCert presents c followed by extra, which need not be its chain.
+func (c *testCert) tlsCert(extra ...*testCert) tls.Certificate {
+	tc := tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+	for _, e := range extra {
+		tc.Certificate = append(tc.Certificate, e.cert.Raw)
+	}
+	return tc
+}
+
+func writePEM(t *testing.T, typ string, der []byte) string {
+	t.Helper()
+
+	f, err := os.CreateTemp(t.TempDir(), "*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := pem.Encode(f, &pem.Block{Type: typ, Bytes: der}); err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
+
+// handshake connects to a TLS server configured by server with the client
+// configuration o builds, and returns the client's error.
+func handshake(t *testing.T, server *tls.Config, o *TLSOptions) error {
+	t.Helper()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if conn.(*tls.Conn).Handshake() == nil {
+			io.WriteString(conn, "ok")
+		}
+	}()
+
+	cfg, err := o.Config("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// A rejected client certificate only surfaces on the first read.
+	_, err = io.ReadFull(conn, make([]byte, 2))
+	return err
+}
+
+func TestTLSPins(t *testing.T) {
+	ca := issue(t, "ca", nil, true)
+	leaf := issue(t, "backend.internal", ca, false)
+	pinned := issue(t, "pinned", nil, false)
+	caFile := writePEM(t, "CERTIFICATE", ca.cert.Raw)
+
+	tests := []struct {
+		name   string
+		server tls.Certificate
+		opts   TLSOptions
+		want   error
+	}{
+		{
+			name:   "leaf pin",
+			server: leaf.tlsCert(),
+			opts:   TLSOptions{CAFile: caFile, Pins: []string{leaf.pin()}},
+		},
+		{
+			name:   "root pin",
+			server: leaf.tlsCert(),
+			opts:   TLSOptions{CAFile: caFile, Pins: []string{ca.pin()}},
+		},
+		{
+			name:   "no pin matches",
+			server: leaf.tlsCert(),
+			opts:   TLSOptions{CAFile: caFile, Pins: []string{pinned.pin()}},
+			want:   ErrPinMismatch,
+		},
+		{
+			// A CA-issued cert with the pinned one appended, but not
+			// chained, must not pass.
+			name:   "appended pin",
+			server: leaf.tlsCert(pinned),
+			opts:   TLSOptions{CAFile: caFile, Pins: []string{pinned.pin()}},
+			want:   ErrPinMismatch,
+		},
+		{
+			name:   "appended pin with VerifyName",
+			server: leaf.tlsCert(pinned),
+			opts:   TLSOptions{CAFile: caFile, VerifyName: "backend.internal", Pins: []string{pinned.pin()}},
+			want:   ErrPinMismatch,
+		},
+		{
+			name:   "insecure leaf pin",
+			server: pinned.tlsCert(),
+			opts:   TLSOptions{InsecureSkipVerify: true, Pins: []string{pinned.pin()}},
+		},
+		{
+			name:   "insecure appended pin",
+			server: leaf.tlsCert(pinned),
+			opts:   TLSOptions{InsecureSkipVerify: true, Pins: []string{pinned.pin()}},
+			want:   ErrPinMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := handshake(t, &tls.Config{Certificates: []tls.Certificate{tt.server}}, &tt.opts)
+			if tt.want == nil && err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTLSVerifyName(t *testing.T) {
+	ca := issue(t, "ca", nil, true)
+	leaf := issue(t, "backend.internal", ca, false)
+	caFile := writePEM(t, "CERTIFICATE", ca.cert.Raw)
+	server := &tls.Config{Certificates: []tls.Certificate{leaf.tlsCert()}}
+
+	// The SNI stays the dialled host while the name is checked separately.
+	if err := handshake(t, server, &TLSOptions{CAFile: caFile, ServerName: "other.example", VerifyName: "backend.internal"}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := handshake(t, server, &TLSOptions{CAFile: caFile, VerifyName: "elsewhere.internal"})
+	if hostErr := (x509.HostnameError{}); !errors.As(err, &hostErr) {
+		t.Fatalf("wrong VerifyName: err = %v", err)
+	}
+
+	// The chain is still checked against the configured roots.
+	other := issue(t, "other-ca", nil, true)
+	if err := handshake(t, server, &TLSOptions{CAFile: writePEM(t, "CERTIFICATE", other.cert.Raw), VerifyName: "backend.internal"}); err == nil {
+		t.Fatal("chain to an untrusted root accepted")
+	}
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	ca := issue(t, "ca", nil, true)
+	leaf := issue(t, "backend.internal", ca, false)
+	client := issue(t, "lb", ca, false)
+	caFile := writePEM(t, "CERTIFICATE", ca.cert.Raw)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	server := &tls.Config{
+		Certificates: []tls.Certificate{leaf.tlsCert()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS13,
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(client.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := writePEM(t, "CERTIFICATE", client.cert.Raw)
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handshake(t, server, &TLSOptions{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handshake(t, server, &TLSOptions{CAFile: caFile}); err == nil {
+		t.Fatal("server accepted a client without a certificate")
+	}
+}
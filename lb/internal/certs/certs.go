@@ -0,0 +1,203 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoCertificate = errors.New("no certificate for server name")
+
+type CertSpec struct {
+	CertFile string
+	KeyFile  string
+	// OCSPFile optionally holds a DER-encoded OCSP response to staple.
+	OCSPFile string
+	// Names overrides the DNS names taken from the certificate; entries may
+	// be wildcards such as "*.example.com".
+	Names []string
+}
+
+// Store serves certificates by SNI and reloads them from disk when the files
+// change. The first certificate is the default for clients without SNI or
+// with an unknown name.
+type Store struct {
+	specs []CertSpec
+
+	mu       sync.RWMutex
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+	modTimes map[string]time.Time
+}
+
+func NewStore(specs []CertSpec) (*Store, error) {
+	s := &Store{specs: specs}
+
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload loads every certificate again. On error the previous set stays in use.
+func (s *Store) Reload() error {
+	byName := make(map[string]*tls.Certificate)
+	modTimes := make(map[string]time.Time)
+	var fallback *tls.Certificate
+
+	for _, spec := range s.specs {
+		cert, err := loadCert(spec)
+		if err != nil {
+			return err
+		}
+
+		names := spec.Names
+		if len(names) == 0 {
+			names = certNames(cert.Leaf)
+		}
+
+		for _, name := range names {
+			byName[strings.ToLower(name)] = cert
+		}
+
+		if fallback == nil {
+			fallback = cert
+		}
+
+		for _, f := range spec.files() {
+			if fi, err := os.Stat(f); err == nil {
+				modTimes[f] = fi.ModTime()
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.byName = byName
+	s.fallback = fallback
+	s.modTimes = modTimes
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (spec CertSpec) files() []string {
+	files := []string{spec.CertFile, spec.KeyFile}
+	if spec.OCSPFile != "" {
+		files = append(files, spec.OCSPFile)
+	}
+
+	return files
+}
+
+func loadCert(spec CertSpec) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(spec.CertFile, spec.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate %s: %w", spec.CertFile, err)
+	}
+
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("parse certificate %s: %w", spec.CertFile, err)
+		}
+	}
+
+	if spec.OCSPFile != "" {
+		staple, err := os.ReadFile(spec.OCSPFile)
+		if err != nil {
+			return nil, fmt.Errorf("read OCSP response %s: %w", spec.OCSPFile, err)
+		}
+		cert.OCSPStaple = staple
+	}
+
+	return &cert, nil
+}
+
+func certNames(leaf *x509.Certificate) []string {
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames
+	}
+
+	if leaf.Subject.CommonName != "" {
+		return []string{leaf.Subject.CommonName}
+	}
+
+	return nil
+}
+
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	if cert, ok := s.byName[name]; ok {
+		return cert, nil
+	}
+
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := s.byName["*."+parent]; ok {
+			return cert, nil
+		}
+	}
+
+	if s.fallback != nil {
+		return s.fallback, nil
+	}
+
+	return nil, ErrNoCertificate
+}
+
+// Watch polls the certificate files every interval and reloads the store
+// when any of them changed, until ctx is done.
+func (s *Store) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if !s.changed() {
+					continue
+				}
+
+				if err := s.Reload(); err != nil {
+					log.Printf("certificate reload failed, keeping previous certificates: %v", err)
+				} else {
+					log.Println("certificates reloaded")
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (s *Store) changed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, spec := range s.specs {
+		for _, f := range spec.files() {
+			fi, err := os.Stat(f)
+			if err != nil {
+				continue
+			}
+
+			if !fi.ModTime().Equal(s.modTimes[f]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,187 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for names, with cn as its
+// common name, to dir and returns its spec.
+func writeCert(t *testing.T, dir, cn string, names ...string) CertSpec {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := CertSpec{CertFile: filepath.Join(dir, cn+".crt"), KeyFile: filepath.Join(dir, cn+".key")}
+	write(t, spec.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	write(t, spec.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+
+	return spec
+}
+
+// write replaces a file and moves its modification time on, so a change is
+// seen even within the file system's timestamp resolution.
+func write(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	var next time.Time
+	if fi, err := os.Stat(path); err == nil {
+		next = fi.ModTime().Add(time.Second)
+	}
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !next.IsZero() {
+		os.Chtimes(path, next, next)
+	}
+}
+
+// served returns the common name of the certificate s serves for name.
+func served(t *testing.T, s *Store, name string) string {
+	t.Helper()
+
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+	if err != nil {
+		t.Fatalf("%q: %v", name, err)
+	}
+
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestStoreSelection(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStore([]CertSpec{
+		writeCert(t, dir, "default", "default.example"),
+		writeCert(t, dir, "wildcard", "*.example.com"),
+		writeCert(t, dir, "exact", "api.example.com"),
+		// Without DNS names the common name is used.
+		writeCert(t, dir, "cn.example.org"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"api.example.com", "exact"},
+		{"API.Example.COM.", "exact"},
+		{"www.example.com", "wildcard"},
+		{"example.com", "default"},
+		// A wildcard covers a single label only.
+		{"a.b.example.com", "default"},
+		{"cn.example.org", "cn.example.org"},
+		{"default.example", "default"},
+		{"unknown.test", "default"},
+		{"", "default"},
+	}
+
+	for _, tt := range tests {
+		if got := served(t, s, tt.name); got != tt.want {
+			t.Errorf("%q: served %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStoreNamesOverride(t *testing.T) {
+	spec := writeCert(t, t.TempDir(), "override", "ignored.example")
+	spec.Names = []string{"*.internal"}
+
+	s, err := NewStore([]CertSpec{writeCert(t, t.TempDir(), "default", "default.example"), spec})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := served(t, s, "db.internal"); got != "override" {
+		t.Errorf("db.internal: served %s", got)
+	}
+	if got := served(t, s, "ignored.example"); got != "default" {
+		t.Errorf("ignored.example: served %s", got)
+	}
+}
+
+func TestStoreEmpty(t *testing.T) {
+	s, err := NewStore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example"}); err != ErrNoCertificate {
+		t.Fatalf("err = %v, want ErrNoCertificate", err)
+	}
+}
+
+func TestStoreWatchReloads(t *testing.T) {
+	dir := t.TempDir()
+	spec := writeCert(t, dir, "site", "site.example")
+
+	s, err := NewStore([]CertSpec{spec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Watch(t.Context(), 10*time.Millisecond)
+
+	serial := func() *big.Int {
+		cert, _ := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "site.example"})
+		return cert.Leaf.SerialNumber
+	}
+	waitFor := func(what string, done func() bool) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for !done() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// A broken certificate file is not loaded; the old one stays.
+	before := serial()
+	write(t, spec.CertFile, []byte("not a certificate"))
+	time.Sleep(100 * time.Millisecond)
+	if serial().Cmp(before) != 0 {
+		t.Fatal("broken certificate replaced the previous one")
+	}
+
+	writeCert(t, dir, "site", "site.example", "new.example")
+	waitFor("reload", func() bool { return serial().Cmp(before) != 0 })
+
+	if got := served(t, s, "new.example"); got != "site" {
+		t.Fatalf("new name served %s", got)
+	}
+}
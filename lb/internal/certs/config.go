@@ -0,0 +1,107 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+type Options struct {
+	MinVersion uint16
+	// CipherSuites applies to TLS 1.2 and below; TLS 1.3 suites are fixed.
+	CipherSuites []uint16
+
+	// ClientAuth and ClientCAs control client certificate authentication;
+	// use tls.VerifyClientCertIfGiven to let routes decide per request.
+	ClientAuth tls.ClientAuthType
+	ClientCAs  *x509.CertPool
+}
+
+// TLSConfig returns a server TLS configuration that selects certificates
+// from the store.
+func (s *Store) TLSConfig(opts Options) *tls.Config {
+	minVersion := opts.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+
+	return &tls.Config{
+		GetCertificate: s.GetCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   opts.CipherSuites,
+		ClientAuth:     opts.ClientAuth,
+		ClientCAs:      opts.ClientCAs,
+	}
+}
+
+// LoadCertPool reads PEM CA bundles into a pool.
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+
+	for _, f := range files {
+		pem, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle %s: %w", f, err)
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA bundle %s", f)
+		}
+	}
+
+	return pool, nil
+}
+
+func ParseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch s {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+
+	return tls.NoClientCert, fmt.Errorf("unknown client auth mode %q", s)
+}
+
+func ParseVersion(v string) (uint16, error) {
+	switch v {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+
+	return 0, fmt.Errorf("unknown TLS version %q", v)
+}
+
+// ParseCipherSuites maps IANA suite names, such as
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", to their IDs.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
@@ -1,10 +1,15 @@
 package circuitbreaker
 
 import (
-	"sync/atomic"
+	"errors"
+	"sync"
 	"time"
+
+	"go_loadbalancer/lb/internal/util"
 )
 
+var ErrOpen = errors.New("circuit breaker is open")
+
 type State int32
 
 const (
@@ -13,62 +18,325 @@ const (
 	HalfOpen
 )
 
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+
+	return "unknown"
+}
+
+type Mode int
+
+const (
+	// ConsecutiveFailures trips after FailureThreshold failures in a row.
+	ConsecutiveFailures Mode = iota
+	// CountWindow trips on the failure or slow-call rate of the last WindowSize calls.
+	CountWindow
+	// TimeWindow trips on the failure or slow-call rate of calls in the last WindowDuration.
+	TimeWindow
+)
+
+type Settings struct {
+	Mode             Mode
+	FailureThreshold int32
+	ResetTimeout     time.Duration
+
+	WindowSize      int
+	WindowDuration  time.Duration
+	MinimumRequests int
+
+	// Rates are percentages in (0, 100]; zero disables the check.
+	FailureRateThreshold  float64
+	SlowCallDuration      time.Duration
+	SlowCallRateThreshold float64
+
+	HalfOpenMaxRequests int
+
+	OnStateChange func(from, to State)
+	Clock         util.Clock
+}
+
 type CircuitBreaker struct {
 	FailureThreshold int32
 	ResetTimeout     time.Duration
-	state            atomic.Int32
-	lastFailure      atomic.Int64
-	failures         atomic.Int32
+
+	settings Settings
+	clock    util.Clock
+	window   window
+
+	mu    sync.Mutex
+	state State
+	// gen numbers the state periods; it changes whenever the state does and
+	// whenever half-open probing restarts.
+	gen               uint64
+	since             time.Time
+	failures          int32
+	halfOpenCalls     int
+	halfOpenSuccesses int
+}
+
+// Permit is an admission granted by Allow. Its outcome only counts while
+// the breaker is still in the state period the permit was issued in; results
+// that arrive later, such as a slow call from before the breaker tripped,
+// are dropped. The zero Permit records nothing.
+type Permit struct {
+	cb  *CircuitBreaker
+	gen uint64
+}
+
+// Record reports the outcome and latency of the admitted request.
+func (p Permit) Record(success bool, latency time.Duration) {
+	if p.cb == nil {
+		return
+	}
+
+	p.cb.mu.Lock()
+	var change *stateChange
+	if p.gen == p.cb.gen {
+		change = p.cb.record(p.cb.clock.Now(), success, latency)
+	}
+	p.cb.mu.Unlock()
+
+	p.cb.notify(change)
+}
+
+// Release returns the permit of a request that was abandoned before it
+// produced an outcome, such as a cancelled hedge.
+func (p Permit) Release() {
+	if p.cb == nil {
+		return
+	}
+
+	p.cb.mu.Lock()
+	defer p.cb.mu.Unlock()
+
+	if p.gen == p.cb.gen && p.cb.state == HalfOpen && p.cb.halfOpenCalls > 0 {
+		p.cb.halfOpenCalls--
+	}
+}
+
+type stateChange struct {
+	from, to State
 }
 
 func NewCircuitBreaker(threshold int32, resetTimeout time.Duration) *CircuitBreaker {
-	cb := &CircuitBreaker{
+	return NewCircuitBreakerWithSettings(Settings{
+		Mode:             ConsecutiveFailures,
 		FailureThreshold: threshold,
 		ResetTimeout:     resetTimeout,
+	})
+}
+
+func NewCircuitBreakerWithSettings(s Settings) *CircuitBreaker {
+	if s.HalfOpenMaxRequests <= 0 {
+		s.HalfOpenMaxRequests = 1
+	}
+
+	if s.Clock == nil {
+		s.Clock = util.SystemClock
+	}
+
+	cb := &CircuitBreaker{
+		FailureThreshold: s.FailureThreshold,
+		ResetTimeout:     s.ResetTimeout,
+		settings:         s,
+		clock:            s.Clock,
+		state:            Closed,
+	}
+
+	switch s.Mode {
+	case CountWindow:
+		cb.window = newCountWindow(s.WindowSize)
+	case TimeWindow:
+		cb.window = newTimeWindow(s.WindowDuration)
 	}
 
-	cb.state.Store(int32(Closed))
 	return cb
 }
 
-func (cb *CircuitBreaker) setState(s State) {
-	cb.state.Store(int32(s))
+// Allow reports whether a request may proceed and, if so, returns the
+// permit its outcome must be recorded with.
+func (cb *CircuitBreaker) Allow() (Permit, bool) {
+	cb.mu.Lock()
+	allowed, change := cb.beforeRequest(cb.clock.Now())
+	p := Permit{cb: cb, gen: cb.gen}
+	cb.mu.Unlock()
+
+	cb.notify(change)
+	if !allowed {
+		return Permit{}, false
+	}
+
+	return p, true
 }
 
+// BeforeRequest is Allow for callers that record outcomes with Record.
 func (cb *CircuitBreaker) BeforeRequest() bool {
-	switch cb.State() {
+	_, ok := cb.Allow()
+	return ok
+}
+
+func (cb *CircuitBreaker) beforeRequest(now time.Time) (bool, *stateChange) {
+	var change *stateChange
+
+	if cb.state == Open {
+		if now.Sub(cb.since) <= cb.ResetTimeout {
+			return false, nil
+		}
+		change = cb.setState(HalfOpen, now)
+	}
+
+	if cb.state == HalfOpen {
+		if cb.halfOpenCalls >= cb.settings.HalfOpenMaxRequests {
+			if now.Sub(cb.since) <= cb.ResetTimeout {
+				return false, change
+			}
+
+			// The probes never reported back; start probing afresh and
+			// ignore them if they ever do.
+			cb.gen++
+			cb.since = now
+			cb.halfOpenCalls = 0
+			cb.halfOpenSuccesses = 0
+		}
+		cb.halfOpenCalls++
+	}
+
+	return true, change
+}
+
+func (cb *CircuitBreaker) AfterRequestSuccess() {
+	cb.Record(true, 0)
+}
+
+func (cb *CircuitBreaker) AfterRequestFailure() {
+	cb.Record(false, 0)
+}
+
+// Record reports the outcome and latency of a request admitted by
+// BeforeRequest. Without a permit the outcome is charged to the current state
+// period; prefer Allow and Permit.Record.
+func (cb *CircuitBreaker) Record(success bool, latency time.Duration) {
+	cb.mu.Lock()
+	change := cb.record(cb.clock.Now(), success, latency)
+	cb.mu.Unlock()
+
+	cb.notify(change)
+}
+
+// Release returns a half-open permit for a request admitted by BeforeRequest
+// but abandoned before it produced an outcome.
+func (cb *CircuitBreaker) Release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == HalfOpen && cb.halfOpenCalls > 0 {
+		cb.halfOpenCalls--
+	}
+}
+
+func (cb *CircuitBreaker) record(now time.Time, success bool, latency time.Duration) *stateChange {
+	o := outcome{
+		failed: !success,
+		slow:   cb.settings.SlowCallDuration > 0 && latency >= cb.settings.SlowCallDuration,
+	}
+
+	switch cb.state {
+	case HalfOpen:
+		if o.failed || (o.slow && cb.settings.SlowCallRateThreshold > 0) {
+			return cb.setState(Open, now)
+		}
+
+		cb.halfOpenSuccesses++
+		if cb.halfOpenSuccesses >= cb.settings.HalfOpenMaxRequests {
+			return cb.setState(Closed, now)
+		}
+		return nil
+
 	case Open:
-		if time.Now().UnixNano()-cb.lastFailure.Load() > cb.ResetTimeout.Nanoseconds() {
-			cb.setState(HalfOpen)
-			return true
+		// Late result of a request admitted before the breaker tripped.
+		return nil
+	}
+
+	if cb.window == nil {
+		if !o.failed {
+			cb.failures = 0
+			return nil
+		}
+
+		cb.failures++
+		if cb.failures >= cb.FailureThreshold {
+			return cb.setState(Open, now)
 		}
+		return nil
+	}
+
+	cb.window.record(now, o)
+	if cb.shouldTrip(cb.window.snapshot(now)) {
+		return cb.setState(Open, now)
+	}
+
+	return nil
+}
+
+func (cb *CircuitBreaker) shouldTrip(c counts) bool {
+	if c.total == 0 || c.total < cb.settings.MinimumRequests {
 		return false
+	}
 
-	case HalfOpen:
+	if t := cb.settings.FailureRateThreshold; t > 0 && rate(c.failures, c.total) >= t {
 		return true
-	case Closed:
+	}
+
+	if t := cb.settings.SlowCallRateThreshold; t > 0 && rate(c.slow, c.total) >= t {
 		return true
 	}
 
-	return true
+	return false
 }
 
-func (cb *CircuitBreaker) AfterRequestSuccess() {
-	if cb.State() == HalfOpen {
-		cb.setState(Closed)
-	}
-	cb.failures.Store(0)
+func rate(n, total int) float64 {
+	return float64(n) * 100 / float64(total)
 }
 
-func (cb *CircuitBreaker) AfterRequestFailure() {
-	cb.failures.Add(1)
-	cb.lastFailure.Store(time.Now().UnixNano())
+func (cb *CircuitBreaker) setState(s State, now time.Time) *stateChange {
+	if cb.state == s {
+		return nil
+	}
+
+	change := &stateChange{from: cb.state, to: s}
+	cb.state = s
+	cb.gen++
+	cb.since = now
+	cb.halfOpenCalls = 0
+	cb.halfOpenSuccesses = 0
 
-	if cb.failures.Load() >= cb.FailureThreshold {
-		cb.setState(Open)
+	switch s {
+	case Closed:
+		cb.failures = 0
+		if cb.window != nil {
+			cb.window.reset()
+		}
+	}
+
+	return change
+}
+
+func (cb *CircuitBreaker) notify(change *stateChange) {
+	if change != nil && cb.settings.OnStateChange != nil {
+		cb.settings.OnStateChange(change.from, change.to)
 	}
 }
 
 func (cb *CircuitBreaker) State() State {
-	return State(cb.state.Load())
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.state
 }
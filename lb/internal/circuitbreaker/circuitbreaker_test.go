@@ -0,0 +1,251 @@
+package circuitbreaker
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// step is one action against a breaker; want is the state expected after it.
+type step struct {
+	advance time.Duration
+	// outcome is "ok", "fail" or "slow" to admit a request and record that
+	// result, or "rejected" to expect Allow to refuse it.
+	outcome string
+	want    State
+}
+
+func run(t *testing.T, s Settings, steps []step) {
+	t.Helper()
+
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	s.Clock = clock
+	cb := NewCircuitBreakerWithSettings(s)
+
+	for i, st := range steps {
+		clock.Advance(st.advance)
+
+		p, ok := cb.Allow()
+		switch st.outcome {
+		case "rejected":
+			if ok {
+				t.Fatalf("step %d: request admitted, want rejected", i)
+			}
+		default:
+			if !ok {
+				t.Fatalf("step %d: request rejected in state %v", i, cb.State())
+			}
+
+			latency := time.Millisecond
+			if st.outcome == "slow" {
+				latency = time.Second
+			}
+			p.Record(st.outcome != "fail", latency)
+		}
+
+		if got := cb.State(); got != st.want {
+			t.Fatalf("step %d: state %v, want %v", i, got, st.want)
+		}
+	}
+}
+
+func TestTransitions(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings Settings
+		steps    []step
+	}{
+		{
+			name:     "consecutive failures trip and recover",
+			settings: Settings{Mode: ConsecutiveFailures, FailureThreshold: 2, ResetTimeout: time.Second},
+			steps: []step{
+				{outcome: "fail", want: Closed},
+				{outcome: "ok", want: Closed},
+				{outcome: "fail", want: Closed},
+				{outcome: "fail", want: Open},
+				{advance: 500 * time.Millisecond, outcome: "rejected", want: Open},
+				{advance: time.Second, outcome: "ok", want: Closed},
+			},
+		},
+		{
+			name:     "failed probe reopens",
+			settings: Settings{Mode: ConsecutiveFailures, FailureThreshold: 1, ResetTimeout: time.Second},
+			steps: []step{
+				{outcome: "fail", want: Open},
+				{advance: 2 * time.Second, outcome: "fail", want: Open},
+				{outcome: "rejected", want: Open},
+				{advance: 2 * time.Second, outcome: "ok", want: Closed},
+			},
+		},
+		{
+			name: "count window trips on failure rate",
+			settings: Settings{
+				Mode: CountWindow, WindowSize: 4, MinimumRequests: 4,
+				FailureRateThreshold: 50, ResetTimeout: time.Second,
+			},
+			steps: []step{
+				{outcome: "fail", want: Closed},
+				{outcome: "ok", want: Closed},
+				{outcome: "ok", want: Closed},
+				{outcome: "fail", want: Open},
+			},
+		},
+		{
+			name: "count window forgets old failures",
+			settings: Settings{
+				Mode: CountWindow, WindowSize: 2, MinimumRequests: 2,
+				FailureRateThreshold: 100, ResetTimeout: time.Second,
+			},
+			steps: []step{
+				{outcome: "fail", want: Closed},
+				{outcome: "ok", want: Closed},
+				{outcome: "fail", want: Closed},
+				{outcome: "fail", want: Open},
+			},
+		},
+		{
+			name: "time window expires failures",
+			settings: Settings{
+				Mode: TimeWindow, WindowDuration: 10 * time.Second, MinimumRequests: 2,
+				FailureRateThreshold: 100, ResetTimeout: time.Second,
+			},
+			steps: []step{
+				{outcome: "fail", want: Closed},
+				{advance: 20 * time.Second, outcome: "fail", want: Closed},
+				{advance: time.Second, outcome: "fail", want: Open},
+			},
+		},
+		{
+			name: "slow calls trip",
+			settings: Settings{
+				Mode: CountWindow, WindowSize: 2, MinimumRequests: 2,
+				SlowCallDuration: 100 * time.Millisecond, SlowCallRateThreshold: 100,
+				ResetTimeout: time.Second,
+			},
+			steps: []step{
+				{outcome: "slow", want: Closed},
+				{outcome: "slow", want: Open},
+				{advance: 2 * time.Second, outcome: "slow", want: Open},
+				{advance: 2 * time.Second, outcome: "ok", want: Closed},
+			},
+		},
+		{
+			name: "half-open needs every probe to succeed",
+			settings: Settings{
+				Mode: ConsecutiveFailures, FailureThreshold: 1, ResetTimeout: time.Second,
+				HalfOpenMaxRequests: 2,
+			},
+			steps: []step{
+				{outcome: "fail", want: Open},
+				{advance: 2 * time.Second, outcome: "ok", want: HalfOpen},
+				{outcome: "ok", want: Closed},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run(t, tt.settings, tt.steps)
+		})
+	}
+}
+
+func TestHalfOpenPermitExpires(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	cb := NewCircuitBreakerWithSettings(Settings{
+		Mode: ConsecutiveFailures, FailureThreshold: 1, ResetTimeout: time.Second, Clock: clock,
+	})
+
+	p, _ := cb.Allow()
+	p.Record(false, 0)
+
+	clock.Advance(2 * time.Second)
+	lost, ok := cb.Allow()
+	if !ok || cb.State() != HalfOpen {
+		t.Fatalf("probe not admitted, state %v", cb.State())
+	}
+
+	if _, ok := cb.Allow(); ok {
+		t.Fatal("second probe admitted while the first is outstanding")
+	}
+
+	// The probe never reports back; after ResetTimeout a new one is allowed.
+	clock.Advance(2 * time.Second)
+	probe, ok := cb.Allow()
+	if !ok {
+		t.Fatal("breaker stuck half-open behind an abandoned probe")
+	}
+
+	// The abandoned probe's late failure belongs to the old period.
+	lost.Record(false, 0)
+	if cb.State() != HalfOpen {
+		t.Fatalf("stale probe result changed state to %v", cb.State())
+	}
+
+	probe.Record(true, 0)
+	if cb.State() != Closed {
+		t.Fatalf("state %v, want closed", cb.State())
+	}
+}
+
+func TestStalePermitIgnored(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	cb := NewCircuitBreakerWithSettings(Settings{
+		Mode: ConsecutiveFailures, FailureThreshold: 1, ResetTimeout: time.Second, Clock: clock,
+	})
+
+	slow, _ := cb.Allow()
+
+	p, _ := cb.Allow()
+	p.Record(false, 0)
+
+	clock.Advance(2 * time.Second)
+	probe, ok := cb.Allow()
+	if !ok || cb.State() != HalfOpen {
+		t.Fatalf("probe not admitted, state %v", cb.State())
+	}
+
+	// A success from before the trip must not close the breaker.
+	slow.Record(true, 0)
+	if cb.State() != HalfOpen {
+		t.Fatalf("stale success moved breaker to %v", cb.State())
+	}
+
+	probe.Release()
+	if _, ok := cb.Allow(); !ok {
+		t.Fatal("released probe permit was not returned")
+	}
+}
+
+func TestStateChangeNotified(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+
+	var changes []State
+	cb := NewCircuitBreakerWithSettings(Settings{
+		Mode: ConsecutiveFailures, FailureThreshold: 1, ResetTimeout: time.Second, Clock: clock,
+		OnStateChange: func(_, to State) { changes = append(changes, to) },
+	})
+
+	p, _ := cb.Allow()
+	p.Record(false, 0)
+	clock.Advance(2 * time.Second)
+	p, _ = cb.Allow()
+	p.Record(true, 0)
+
+	want := []State{Open, HalfOpen, Closed}
+	if len(changes) != len(want) {
+		t.Fatalf("changes %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Fatalf("changes %v, want %v", changes, want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package circuitbreaker
+
+import (
+	"time"
+
+	"go_loadbalancer/lb/internal/util"
+)
+
+type outcome struct {
+	failed bool
+	slow   bool
+}
+
+type counts struct {
+	total    int
+	failures int
+	slow     int
+}
+
+func (c *counts) add(o outcome, delta int) {
+	c.total += delta
+	if o.failed {
+		c.failures += delta
+	}
+	if o.slow {
+		c.slow += delta
+	}
+}
+
+type window interface {
+	record(now time.Time, o outcome)
+	snapshot(now time.Time) counts
+	reset()
+}
+
+// countWindow keeps the outcomes of the last size calls in a ring buffer.
+type countWindow struct {
+	outcomes []outcome
+	next     int
+	filled   int
+	totals   counts
+}
+
+func newCountWindow(size int) *countWindow {
+	if size <= 0 {
+		size = 1
+	}
+
+	return &countWindow{outcomes: make([]outcome, size)}
+}
+
+func (w *countWindow) record(_ time.Time, o outcome) {
+	if w.filled == len(w.outcomes) {
+		w.totals.add(w.outcomes[w.next], -1)
+	} else {
+		w.filled++
+	}
+
+	w.outcomes[w.next] = o
+	w.totals.add(o, 1)
+	w.next = (w.next + 1) % len(w.outcomes)
+}
+
+func (w *countWindow) snapshot(time.Time) counts {
+	return w.totals
+}
+
+func (w *countWindow) reset() {
+	for i := range w.outcomes {
+		w.outcomes[i] = outcome{}
+	}
+	w.next = 0
+	w.filled = 0
+	w.totals = counts{}
+}
+
+const timeWindowBuckets = 10
+
+// timeWindow aggregates outcomes over the last duration.
+type timeWindow struct {
+	buckets *util.Window[counts]
+}
+
+func newTimeWindow(d time.Duration) *timeWindow {
+	return &timeWindow{buckets: util.NewWindow[counts](d, timeWindowBuckets)}
+}
+
+func (w *timeWindow) record(now time.Time, o outcome) {
+	w.buckets.At(now).add(o, 1)
+}
+
+func (w *timeWindow) snapshot(now time.Time) counts {
+	var c counts
+	w.buckets.Each(now, func(b *counts) {
+		c.total += b.total
+		c.failures += b.failures
+		c.slow += b.slow
+	})
+
+	return c
+}
+
+func (w *timeWindow) reset() {
+	w.buckets.Reset()
+}
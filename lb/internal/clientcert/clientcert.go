@@ -0,0 +1,117 @@
+package clientcert
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	HeaderSubject     = "X-Client-Cert-Subject"
+	HeaderDNSNames    = "X-Client-Cert-DNS"
+	HeaderSPIFFEID    = "X-Client-Cert-SPIFFE-ID"
+	HeaderFingerprint = "X-Client-Cert-Fingerprint"
+)
+
+var identityHeaders = []string{HeaderSubject, HeaderDNSNames, HeaderSPIFFEID, HeaderFingerprint}
+
+// Verified returns the client certificate the listener verified for r, or
+// nil when the client sent none or it was not checked against a CA.
+func Verified(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return r.TLS.VerifiedChains[0][0]
+}
+
+func SPIFFEID(cert *x509.Certificate) string {
+	for _, u := range cert.URIs {
+		if u.Scheme == "spiffe" {
+			return u.String()
+		}
+	}
+
+	return ""
+}
+
+// Requirement restricts a route to clients whose verified certificate
+// matches. Patterns use path.Match syntax, so "spiffe://prod/ns/*/sa/api"
+// and "CN=*,O=Example" work. Within a field any pattern may match; every
+// non-empty field must match.
+type Requirement struct {
+	Subjects  []string
+	DNSNames  []string
+	SPIFFEIDs []string
+}
+
+func (req *Requirement) Allows(cert *x509.Certificate) bool {
+	if cert == nil {
+		return false
+	}
+
+	if len(req.Subjects) > 0 && !matchAny(req.Subjects, cert.Subject.String()) {
+		return false
+	}
+
+	if len(req.DNSNames) > 0 && !matchAny(req.DNSNames, cert.DNSNames...) {
+		return false
+	}
+
+	if len(req.SPIFFEIDs) > 0 && !matchAny(req.SPIFFEIDs, SPIFFEID(cert)) {
+		return false
+	}
+
+	return true
+}
+
+func matchAny(patterns []string, values ...string) bool {
+	for _, p := range patterns {
+		for _, v := range values {
+			if v == "" {
+				continue
+			}
+			if ok, _ := path.Match(p, v); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// SetHeaders replaces any client-supplied identity headers with the
+// identity of cert, so backends can trust them. A nil cert only strips them.
+func SetHeaders(h http.Header, cert *x509.Certificate) {
+	for _, name := range identityHeaders {
+		h.Del(name)
+	}
+
+	if cert == nil {
+		return
+	}
+
+	sum := sha256.Sum256(cert.Raw)
+
+	h.Set(HeaderSubject, cert.Subject.String())
+	h.Set(HeaderFingerprint, hex.EncodeToString(sum[:]))
+
+	if len(cert.DNSNames) > 0 {
+		h.Set(HeaderDNSNames, strings.Join(cert.DNSNames, ","))
+	}
+
+	if id := SPIFFEID(cert); id != "" {
+		h.Set(HeaderSPIFFEID, id)
+	}
+}
+
+// Middleware forwards the verified client identity to backends in headers.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetHeaders(r.Header, Verified(r))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,69 @@
+package clientcert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestMiddlewareStripsForgedHeaders(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://prod/ns/web/sa/api")
+	cert := &x509.Certificate{
+		Raw:      []byte("cert"),
+		Subject:  pkix.Name{CommonName: "api"},
+		DNSNames: []string{"api.internal"},
+		URIs:     []*url.URL{spiffe},
+	}
+
+	tests := []struct {
+		name string
+		tls  *tls.ConnectionState
+		want map[string]string
+	}{
+		{
+			name: "plain connection",
+			want: map[string]string{HeaderSubject: "", HeaderSPIFFEID: "", HeaderDNSNames: "", HeaderFingerprint: ""},
+		},
+		{
+			name: "unverified certificate",
+			tls:  &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+			want: map[string]string{HeaderSubject: "", HeaderSPIFFEID: ""},
+		},
+		{
+			name: "verified certificate",
+			tls:  &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			want: map[string]string{
+				HeaderSubject:  "CN=api",
+				HeaderDNSNames: "api.internal",
+				HeaderSPIFFEID: "spiffe://prod/ns/web/sa/api",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got http.Header
+			h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.TLS = tt.tls
+			for _, name := range identityHeaders {
+				r.Header.Set(name, "forged")
+			}
+
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			for name, want := range tt.want {
+				if v := got.Get(name); v != want {
+					t.Errorf("%s = %q, want %q", name, v, want)
+				}
+			}
+		})
+	}
+}
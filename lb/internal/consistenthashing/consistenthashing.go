@@ -67,3 +67,27 @@ func (ch *ConsistentHash) Next(instances []string, key string) string {
 
 	return ch.ring[idx].instance
 }
+
+// Get returns the instance owning key, passing over the instances skip
+// reports true for as if they had been removed from the ring. It returns ""
+// when every instance is skipped.
+func (ch *ConsistentHash) Get(key string, skip func(string) bool) string {
+	if len(ch.ring) == 0 {
+		return ""
+	}
+
+	h := hash(key)
+
+	idx := sort.Search(len(ch.ring), func(i int) bool {
+		return ch.ring[i].hash >= h
+	})
+
+	for i := range ch.ring {
+		inst := ch.ring[(idx+i)%len(ch.ring)].instance
+		if skip == nil || !skip(inst) {
+			return inst
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,28 @@
+package consistenthashing
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestGetSkipsLikeRemoval(t *testing.T) {
+	full := NewConsistentHash(100, []string{"a", "b", "c"})
+	without := NewConsistentHash(100, []string{"a", "c"})
+
+	for i := range 1000 {
+		key := "10.0.0." + strconv.Itoa(i)
+
+		got := full.Get(key, func(inst string) bool { return inst == "b" })
+		if want := without.Get(key, nil); got != want {
+			t.Fatalf("%s: got %s with b skipped, %s with b removed", key, got, want)
+		}
+
+		if got, want := full.Get(key, nil), full.Next(nil, key); got != want {
+			t.Fatalf("%s: Get %s, Next %s", key, got, want)
+		}
+	}
+
+	if got := full.Get("x", func(string) bool { return true }); got != "" {
+		t.Fatalf("every instance skipped: got %q", got)
+	}
+}
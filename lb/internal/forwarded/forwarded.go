@@ -0,0 +1,227 @@
+package forwarded
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	HeaderForwarded = "Forwarded"
+	HeaderXFF       = "X-Forwarded-For"
+	HeaderXFProto   = "X-Forwarded-Proto"
+	HeaderXFHost    = "X-Forwarded-Host"
+	HeaderXRealIP   = "X-Real-IP"
+)
+
+// Config decides how forwarding headers are trusted and written. Headers
+// from a peer in TrustedProxies are extended; from anyone else they are
+// dropped and rewritten, so clients cannot spoof their address.
+//
+// A nil Config trusts nobody, so incoming forwarding headers are always
+// replaced; a balancer behind another proxy or CDN must list it in
+// TrustedProxies to keep the original client address.
+type Config struct {
+	TrustedProxies []*net.IPNet
+	// Forwarded also emits the RFC 7239 Forwarded header.
+	Forwarded bool
+}
+
+func (c *Config) trusted(ip net.IP) bool {
+	if c == nil || ip == nil {
+		return false
+	}
+
+	for _, n := range c.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// ClientIP returns the original client address. It walks the proxy chain
+// from the nearest hop back, skipping trusted proxies, and takes the first
+// untrusted address. Forwarded wins over X-Forwarded-For when both are set.
+func (c *Config) ClientIP(r *http.Request) net.IP {
+	peer := remoteIP(r)
+	if !c.trusted(peer) {
+		return peer
+	}
+
+	chain := forwardedFor(r.Header.Values(HeaderForwarded))
+	if len(chain) == 0 {
+		chain = xffChain(r.Header.Values(HeaderXFF))
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := chain[i]
+		if ip == nil {
+			// Obfuscated or unknown hop: nothing behind it can be trusted.
+			return peer
+		}
+
+		if !c.trusted(ip) {
+			return ip
+		}
+
+		peer = ip
+	}
+
+	return peer
+}
+
+func xffChain(values []string) []net.IP {
+	var chain []net.IP
+
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			chain = append(chain, net.ParseIP(strings.TrimSpace(part)))
+		}
+	}
+
+	return chain
+}
+
+// forwardedFor extracts the for= node of every Forwarded element, with nil
+// for "unknown" and obfuscated identifiers.
+func forwardedFor(values []string) []net.IP {
+	var chain []net.IP
+
+	for _, v := range values {
+		for _, elem := range splitQuoted(v, ',') {
+			for _, pair := range splitQuoted(elem, ';') {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+
+				chain = append(chain, parseNode(value))
+			}
+		}
+	}
+
+	return chain
+}
+
+func parseNode(v string) net.IP {
+	v = strings.Trim(v, `"`)
+
+	if rest, ok := strings.CutPrefix(v, "["); ok {
+		host, _, _ := strings.Cut(rest, "]")
+		return net.ParseIP(host)
+	}
+
+	if host, _, err := net.SplitHostPort(v); err == nil {
+		v = host
+	}
+
+	return net.ParseIP(v)
+}
+
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case '\\':
+			i++
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// Apply rewrites the forwarding headers of an outgoing proxy request, before
+// its Host is changed. httputil.ReverseProxy appends the peer address to
+// X-Forwarded-For afterwards, which completes the chain.
+func (c *Config) Apply(out *http.Request) {
+	peer := remoteIP(out)
+	trusted := c.trusted(peer)
+
+	if !trusted {
+		for _, h := range []string{HeaderForwarded, HeaderXFF, HeaderXFProto, HeaderXFHost, HeaderXRealIP} {
+			out.Header.Del(h)
+		}
+	}
+
+	proto := "http"
+	if out.TLS != nil {
+		proto = "https"
+	}
+
+	if out.Header.Get(HeaderXFProto) == "" {
+		out.Header.Set(HeaderXFProto, proto)
+	}
+
+	if out.Header.Get(HeaderXFHost) == "" {
+		out.Header.Set(HeaderXFHost, out.Host)
+	}
+
+	if client := c.ClientIP(out); client != nil {
+		out.Header.Set(HeaderXRealIP, client.String())
+	}
+
+	if c != nil && c.Forwarded && peer != nil {
+		elem := "for=" + formatNode(peer) + ";host=" + quote(out.Host) + ";proto=" + proto
+		if prior := out.Header.Values(HeaderForwarded); len(prior) > 0 {
+			elem = strings.Join(prior, ", ") + ", " + elem
+		}
+		out.Header.Set(HeaderForwarded, elem)
+	}
+}
+
+// AppendFor adds the peer address to X-Forwarded-For the way
+// httputil.ReverseProxy does, for requests that are forwarded without it. A
+// header set to nil is left out, as ReverseProxy leaves it.
+func AppendFor(out *http.Request) {
+	host, _, err := net.SplitHostPort(out.RemoteAddr)
+	if err != nil {
+		return
+	}
+
+	prior, ok := out.Header[HeaderXFF]
+	if ok && prior == nil {
+		return
+	}
+	if len(prior) > 0 {
+		host = strings.Join(prior, ", ") + ", " + host
+	}
+
+	out.Header.Set(HeaderXFF, host)
+}
+
+func formatNode(ip net.IP) string {
+	if ip.To4() == nil {
+		return `"[` + ip.String() + `]"`
+	}
+
+	return ip.String()
+}
+
+func quote(s string) string {
+	if strings.ContainsAny(s, ":;,\" ") || s == "" {
+		return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+	}
+
+	return s
+}
@@ -0,0 +1,62 @@
+package forwarded
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+
+	tests := []struct {
+		name    string
+		cfg     *Config
+		peer    string
+		xff     string
+		wantXFF string
+		wantIP  string
+	}{
+		{
+			name:    "nil config drops client chain",
+			peer:    "203.0.113.9:1234",
+			xff:     "198.51.100.1",
+			wantXFF: "",
+			wantIP:  "203.0.113.9",
+		},
+		{
+			name:    "untrusted peer drops chain",
+			cfg:     &Config{TrustedProxies: []*net.IPNet{proxies}},
+			peer:    "203.0.113.9:1234",
+			xff:     "198.51.100.1",
+			wantXFF: "",
+			wantIP:  "203.0.113.9",
+		},
+		{
+			name:    "trusted peer keeps chain",
+			cfg:     &Config{TrustedProxies: []*net.IPNet{proxies}},
+			peer:    "10.0.0.2:1234",
+			xff:     "198.51.100.1, 10.0.0.7",
+			wantXFF: "198.51.100.1, 10.0.0.7",
+			wantIP:  "198.51.100.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.peer
+			r.Header.Set(HeaderXFF, tt.xff)
+
+			tt.cfg.Apply(r)
+
+			if got := r.Header.Get(HeaderXFF); got != tt.wantXFF {
+				t.Errorf("X-Forwarded-For %q, want %q", got, tt.wantXFF)
+			}
+			if got := r.Header.Get(HeaderXRealIP); got != tt.wantIP {
+				t.Errorf("X-Real-IP %q, want %q", got, tt.wantIP)
+			}
+		})
+	}
+}
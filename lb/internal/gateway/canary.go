@@ -0,0 +1,356 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"go_loadbalancer/lb/internal/util"
+)
+
+var ErrCanaryFailed = errors.New("canary analysis failed")
+
+const (
+	maxLatencySamples = 4096
+	statsBuckets      = 10
+)
+
+// variantStats collects the outcomes of a variant's requests over a rolling
+// window. It records nothing until a canary analysis resets it with a
+// window.
+type variantStats struct {
+	mu      sync.Mutex
+	buckets *util.Window[statsBucket]
+}
+
+type statsBucket struct {
+	requests  int
+	errors    int
+	latencies []time.Duration
+}
+
+// reset clears the figures and sets the window they cover.
+func (s *variantStats) reset(window time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buckets = util.NewWindow[statsBucket](window, statsBuckets)
+}
+
+func (s *variantStats) observe(now time.Time, failed bool, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.buckets == nil {
+		return
+	}
+
+	b := s.buckets.At(now)
+	b.requests++
+	if failed {
+		b.errors++
+	}
+
+	// Past the cap, keep a uniform sample of the bucket's latencies.
+	const perBucket = maxLatencySamples / statsBuckets
+	if len(b.latencies) < perBucket {
+		b.latencies = append(b.latencies, d)
+	} else if i := rand.IntN(b.requests); i < perBucket {
+		b.latencies[i] = d
+	}
+}
+
+// window returns the figures for the window ending at now.
+func (s *variantStats) window(now time.Time, percentile float64) WindowStats {
+	var ws WindowStats
+	var latencies []time.Duration
+
+	s.mu.Lock()
+	if s.buckets != nil {
+		s.buckets.Each(now, func(b *statsBucket) {
+			ws.Requests += b.requests
+			ws.Errors += b.errors
+			latencies = append(latencies, b.latencies...)
+		})
+	}
+	s.mu.Unlock()
+
+	if ws.Requests > 0 {
+		ws.ErrorRate = float64(ws.Errors) / float64(ws.Requests)
+	}
+
+	if len(latencies) > 0 {
+		slices.Sort(latencies)
+		idx := min(int(percentile/100*float64(len(latencies))), len(latencies)-1)
+		ws.Latency = latencies[max(idx, 0)]
+	}
+
+	return ws
+}
+
+// WindowStats summarises one variant over the rolling analysis window.
+// Latency is the configured percentile.
+type WindowStats struct {
+	Requests  int
+	Errors    int
+	ErrorRate float64
+	Latency   time.Duration
+}
+
+type CanaryDecision string
+
+const (
+	CanaryStarted  CanaryDecision = "started"
+	CanaryAdvanced CanaryDecision = "advanced"
+	CanaryHeld     CanaryDecision = "held"
+	CanaryPromoted CanaryDecision = "promoted"
+	CanaryRollback CanaryDecision = "rollback"
+)
+
+// CanaryEvent records one analysis decision.
+type CanaryEvent struct {
+	Time     time.Time
+	Decision CanaryDecision
+	// Weight is the canary's weight after the decision, out of 100.
+	Weight   int
+	Baseline WindowStats
+	Canary   WindowStats
+	Reason   string
+}
+
+// Canary progressively shifts a split route's traffic from a baseline
+// variant to a canary variant. Every Interval it compares the two over the
+// last Window: while the canary stays within the thresholds its weight grows
+// by StepWeight, and once it has failed Threshold consecutive analyses its
+// weight drops back to zero.
+type Canary struct {
+	Split    *TrafficSplit
+	Baseline string
+	Canary   string
+
+	StepWeight int
+	// MaxWeight is the highest weight the canary is analysed at. Once it
+	// passes an analysis there it is promoted and receives all traffic.
+	// Zero means 100.
+	MaxWeight int
+	Interval  time.Duration
+	// Window is how far back each analysis looks. Zero means Interval;
+	// longer windows overlap and smooth out bursts.
+	Window time.Duration
+
+	// MinRequests is the canary traffic a window needs to be judged; quieter
+	// analyses are held without counting as failures.
+	MinRequests int
+	// MaxErrorRate bounds the canary's error rate in absolute terms, and
+	// MaxErrorRateIncrease bounds it relative to the baseline's. Zero
+	// disables a check.
+	MaxErrorRate         float64
+	MaxErrorRateIncrease float64
+	// MaxLatencyRatio bounds the canary's latency at LatencyPercentile as a
+	// multiple of the baseline's, e.g. 1.2 for at most 20% slower.
+	MaxLatencyRatio   float64
+	LatencyPercentile float64
+	// Threshold is the number of consecutive failed analyses that trigger a
+	// rollback. Zero means 1.
+	Threshold int
+
+	OnEvent func(CanaryEvent)
+}
+
+// canaryRun is the state of one Run.
+type canaryRun struct {
+	baseline   *Variant
+	canary     *Variant
+	maxWeight  int
+	threshold  int
+	percentile float64
+
+	weight   int
+	failures int
+}
+
+// Run drives the analysis until the canary is promoted, rolled back, or ctx
+// is done. It returns ErrCanaryFailed after a rollback. When ctx ends early
+// the weights are left where they are.
+func (c *Canary) Run(ctx context.Context) error {
+	run, err := c.start()
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now = <-ticker.C:
+		}
+
+		done, err := c.analyze(run, now)
+		if done || err != nil {
+			return err
+		}
+	}
+}
+
+// start sets the first canary weight and clears the variants' figures.
+func (c *Canary) start() (*canaryRun, error) {
+	baseline, canary, err := c.variants()
+	if err != nil {
+		return nil, err
+	}
+	if c.StepWeight <= 0 || c.Interval <= 0 {
+		return nil, errors.New("canary step weight and interval must be positive")
+	}
+
+	run := &canaryRun{
+		baseline:   baseline,
+		canary:     canary,
+		maxWeight:  c.MaxWeight,
+		threshold:  max(c.Threshold, 1),
+		percentile: c.LatencyPercentile,
+	}
+	if run.maxWeight <= 0 || run.maxWeight > 100 {
+		run.maxWeight = 100
+	}
+	if run.percentile <= 0 {
+		run.percentile = 99
+	}
+
+	window := c.Window
+	if window <= 0 {
+		window = c.Interval
+	}
+
+	run.weight = min(c.StepWeight, run.maxWeight)
+	if err := c.setWeight(run.weight); err != nil {
+		return nil, err
+	}
+	baseline.stats.reset(window)
+	canary.stats.reset(window)
+	c.emit(CanaryEvent{Decision: CanaryStarted, Weight: run.weight})
+
+	return run, nil
+}
+
+// analyze judges the window ending at now and acts on the decision. It
+// reports whether the run is over; err is ErrCanaryFailed after a rollback.
+func (c *Canary) analyze(run *canaryRun, now time.Time) (bool, error) {
+	ev := CanaryEvent{
+		Baseline: run.baseline.stats.window(now, run.percentile),
+		Canary:   run.canary.stats.window(now, run.percentile),
+	}
+
+	if ev.Canary.Requests < c.MinRequests || ev.Canary.Requests == 0 {
+		ev.Decision, ev.Weight = CanaryHeld, run.weight
+		ev.Reason = fmt.Sprintf("%d canary requests, need %d", ev.Canary.Requests, max(c.MinRequests, 1))
+		c.emit(ev)
+		return false, nil
+	}
+
+	if reason := c.check(ev.Baseline, ev.Canary); reason != "" {
+		run.failures++
+		ev.Reason = reason
+
+		if run.failures >= run.threshold {
+			ev.Decision, ev.Weight = CanaryRollback, 0
+			if err := c.setWeight(0); err != nil {
+				return true, err
+			}
+			c.emit(ev)
+			return true, ErrCanaryFailed
+		}
+
+		ev.Decision, ev.Weight = CanaryHeld, run.weight
+		c.emit(ev)
+		return false, nil
+	}
+	run.failures = 0
+
+	if run.weight >= run.maxWeight {
+		// Passed at MaxWeight: hand the canary all traffic.
+		if err := c.setWeight(100); err != nil {
+			return true, err
+		}
+		ev.Decision, ev.Weight = CanaryPromoted, 100
+		c.emit(ev)
+		return true, nil
+	}
+
+	run.weight = min(run.weight+c.StepWeight, run.maxWeight)
+	if err := c.setWeight(run.weight); err != nil {
+		return true, err
+	}
+
+	ev.Decision, ev.Weight = CanaryAdvanced, run.weight
+	c.emit(ev)
+
+	return false, nil
+}
+
+func (c *Canary) variants() (*Variant, *Variant, error) {
+	if c.Split == nil {
+		return nil, nil, errors.New("canary has no traffic split")
+	}
+
+	baseline := c.Split.Variant(c.Baseline)
+	if baseline == nil {
+		return nil, nil, fmt.Errorf("%w %q", ErrUnknownVariant, c.Baseline)
+	}
+
+	canary := c.Split.Variant(c.Canary)
+	if canary == nil {
+		return nil, nil, fmt.Errorf("%w %q", ErrUnknownVariant, c.Canary)
+	}
+
+	return baseline, canary, nil
+}
+
+// check returns why the canary failed the window, or "" if it passed.
+func (c *Canary) check(baseline, canary WindowStats) string {
+	if c.MaxErrorRate > 0 && canary.ErrorRate > c.MaxErrorRate {
+		return fmt.Sprintf("error rate %.2f%% above %.2f%%", canary.ErrorRate*100, c.MaxErrorRate*100)
+	}
+
+	if c.MaxErrorRateIncrease > 0 && canary.ErrorRate-baseline.ErrorRate > c.MaxErrorRateIncrease {
+		return fmt.Sprintf("error rate %.2f%% vs baseline %.2f%%", canary.ErrorRate*100, baseline.ErrorRate*100)
+	}
+
+	// Latency can only be compared when the baseline served traffic too.
+	if c.MaxLatencyRatio > 0 && baseline.Latency > 0 &&
+		float64(canary.Latency) > float64(baseline.Latency)*c.MaxLatencyRatio {
+		return fmt.Sprintf("latency %v vs baseline %v", canary.Latency, baseline.Latency)
+	}
+
+	return ""
+}
+
+func (c *Canary) setWeight(weight int) error {
+	return c.Split.SetWeights(map[string]int{
+		c.Baseline: 100 - weight,
+		c.Canary:   weight,
+	})
+}
+
+func (c *Canary) emit(ev CanaryEvent) {
+	ev.Time = time.Now()
+
+	if c.OnEvent != nil {
+		c.OnEvent(ev)
+		return
+	}
+
+	if ev.Reason != "" {
+		log.Printf("canary %s: %s at weight %d: %s", c.Canary, ev.Decision, ev.Weight, ev.Reason)
+		return
+	}
+	log.Printf("canary %s: %s at weight %d", c.Canary, ev.Decision, ev.Weight)
+}
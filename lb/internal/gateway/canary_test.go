@@ -0,0 +1,146 @@
+package gateway
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type canaryTest struct {
+	t      *testing.T
+	c      *Canary
+	run    *canaryRun
+	now    time.Time
+	events []CanaryEvent
+}
+
+func newCanaryTest(t *testing.T, c *Canary) *canaryTest {
+	t.Helper()
+
+	split, err := NewTrafficSplit([]*Variant{{Name: "stable"}, {Name: "canary"}}, map[string]int{"stable": 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ct := &canaryTest{t: t, c: c, now: time.Unix(1000, 0)}
+	c.Split, c.Baseline, c.Canary = split, "stable", "canary"
+	c.Interval = 10 * time.Second
+	c.OnEvent = func(ev CanaryEvent) { ct.events = append(ct.events, ev) }
+
+	if ct.run, err = c.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	return ct
+}
+
+// serve records n requests per variant during the next interval, failing
+// the first canaryErrors of the canary's.
+func (ct *canaryTest) serve(n, canaryErrors int, canaryLatency time.Duration) {
+	at := ct.now.Add(ct.c.Interval / 2)
+	for i := range n {
+		ct.run.baseline.stats.observe(at, false, 10*time.Millisecond)
+		ct.run.canary.stats.observe(at, i < canaryErrors, canaryLatency)
+	}
+}
+
+// analyze ends the interval and checks the decision and resulting weight.
+func (ct *canaryTest) analyze(decision CanaryDecision, weight int) error {
+	ct.t.Helper()
+
+	ct.now = ct.now.Add(ct.c.Interval)
+	_, err := ct.c.analyze(ct.run, ct.now)
+
+	ev := ct.events[len(ct.events)-1]
+	if ev.Decision != decision || ev.Weight != weight {
+		ct.t.Fatalf("got %s at %d (%s), want %s at %d", ev.Decision, ev.Weight, ev.Reason, decision, weight)
+	}
+	if got := ct.c.Split.Weights()["canary"]; got != weight {
+		ct.t.Fatalf("split gives the canary %d, event says %d", got, weight)
+	}
+
+	return err
+}
+
+func TestCanaryAdvancesAndPromotes(t *testing.T) {
+	ct := newCanaryTest(t, &Canary{StepWeight: 10, MaxWeight: 30, MaxErrorRate: 0.05, MaxLatencyRatio: 2})
+
+	if ev := ct.events[0]; ev.Decision != CanaryStarted || ev.Weight != 10 {
+		t.Fatalf("started with %+v", ev)
+	}
+
+	for _, want := range []struct {
+		decision CanaryDecision
+		weight   int
+	}{
+		{CanaryAdvanced, 20},
+		{CanaryAdvanced, 30},
+		{CanaryPromoted, 100},
+	} {
+		ct.serve(20, 0, 15*time.Millisecond)
+		if err := ct.analyze(want.decision, want.weight); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCanaryHolds(t *testing.T) {
+	ct := newCanaryTest(t, &Canary{StepWeight: 10, MinRequests: 5, MaxErrorRate: 0.05, Threshold: 2})
+
+	ct.serve(4, 0, time.Millisecond)
+	ct.analyze(CanaryHeld, 10)
+
+	// One failed analysis is held until Threshold is reached.
+	ct.serve(20, 10, time.Millisecond)
+	ct.analyze(CanaryHeld, 10)
+
+	// A clean window resets the count; the old failures have left it.
+	ct.serve(20, 0, time.Millisecond)
+	ct.analyze(CanaryAdvanced, 20)
+}
+
+func TestCanaryRollsBack(t *testing.T) {
+	tests := []struct {
+		name    string
+		canary  *Canary
+		errors  int
+		latency time.Duration
+	}{
+		{name: "error rate", canary: &Canary{StepWeight: 10, MaxErrorRate: 0.05}, errors: 5},
+		{name: "error rate increase", canary: &Canary{StepWeight: 10, MaxErrorRateIncrease: 0.1}, errors: 5},
+		{name: "latency", canary: &Canary{StepWeight: 10, MaxLatencyRatio: 1.5}, latency: 100 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ct := newCanaryTest(t, tt.canary)
+
+			ct.serve(20, tt.errors, max(tt.latency, time.Millisecond))
+			if err := ct.analyze(CanaryRollback, 0); !errors.Is(err, ErrCanaryFailed) {
+				t.Fatalf("err = %v, want ErrCanaryFailed", err)
+			}
+		})
+	}
+}
+
+func TestVariantStatsRollingWindow(t *testing.T) {
+	var s variantStats
+	s.reset(30 * time.Second)
+
+	base := time.Unix(1000, 0)
+	s.observe(base.Add(5*time.Second), true, time.Second)
+	s.observe(base.Add(25*time.Second), false, time.Millisecond)
+
+	if ws := s.window(base.Add(30*time.Second), 99); ws.Requests != 2 || ws.Errors != 1 || ws.Latency != time.Second {
+		t.Fatalf("full window: %+v", ws)
+	}
+
+	// The failure slides out while the later request stays.
+	if ws := s.window(base.Add(45*time.Second), 99); ws.Requests != 1 || ws.Errors != 0 || ws.Latency != time.Millisecond {
+		t.Fatalf("after 45s: %+v", ws)
+	}
+
+	if ws := s.window(base.Add(time.Hour), 99); ws.Requests != 0 {
+		t.Fatalf("stale buckets counted: %+v", ws)
+	}
+}
@@ -0,0 +1,74 @@
+package gateway
+
+import (
+	"net/http"
+
+	"go_loadbalancer/lb/internal/handler"
+	"go_loadbalancer/lb/internal/registry"
+	"go_loadbalancer/lb/internal/strategy"
+)
+
+// Fallback is served when a route's or its pool's circuit breaker is open.
+// A secondary pool takes precedence over a redirect, which takes precedence
+// over a static response.
+type Fallback struct {
+	Status int
+	Header http.Header
+	Body   []byte
+
+	RedirectURL    string
+	RedirectStatus int
+
+	Registry *registry.BackendRegistry
+	Strategy strategy.Strategy
+}
+
+func StaticFallback(status int, body []byte) *Fallback {
+	return &Fallback{Status: status, Body: body}
+}
+
+func RedirectFallback(url string, status int) *Fallback {
+	return &Fallback{RedirectURL: url, RedirectStatus: status}
+}
+
+func PoolFallback(reg *registry.BackendRegistry, strat strategy.Strategy) *Fallback {
+	return &Fallback{Registry: reg, Strategy: strat}
+}
+
+func (f *Fallback) serve(w http.ResponseWriter, r *http.Request, h *handler.LBHandler) {
+	if f == nil {
+		http.Error(w, "circuit open", http.StatusServiceUnavailable)
+		return
+	}
+
+	if f.Registry != nil {
+		if err := h.ServePool(w, r, f.Registry, f.Strategy); err != nil {
+			http.Error(w, "circuit open", http.StatusServiceUnavailable)
+		}
+		return
+	}
+
+	if f.RedirectURL != "" {
+		status := f.RedirectStatus
+		if status == 0 {
+			status = http.StatusFound
+		}
+
+		http.Redirect(w, r, f.RedirectURL, status)
+		return
+	}
+
+	for k, vv := range f.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+
+	status := f.Status
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.WriteHeader(status)
+	_, _ = w.Write(f.Body)
+}
@@ -0,0 +1,163 @@
+package gateway
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go_loadbalancer/lb/internal/circuitbreaker"
+	"go_loadbalancer/lb/internal/strategy/roundrobin"
+)
+
+// openBreaker returns a breaker that is already open.
+func openBreaker(reset time.Duration) *circuitbreaker.CircuitBreaker {
+	cb := circuitbreaker.NewCircuitBreaker(1, reset)
+	permit, _ := cb.Allow()
+	permit.Record(false, 0)
+
+	return cb
+}
+
+func TestFallbacks(t *testing.T) {
+	var hits atomic.Int32
+	primary := poolFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.WriteString(w, "primary")
+	})
+
+	static := StaticFallback(http.StatusTeapot, []byte("maintenance"))
+	static.Header = http.Header{"Retry-After": {"30"}}
+
+	tests := []struct {
+		name     string
+		fallback *Fallback
+		status   int
+		body     string
+		header   [2]string
+	}{
+		{name: "none", fallback: nil, status: http.StatusServiceUnavailable, body: "circuit open\n"},
+		{name: "static", fallback: static, status: http.StatusTeapot, body: "maintenance", header: [2]string{"Retry-After", "30"}},
+		{name: "static default status", fallback: StaticFallback(0, nil), status: http.StatusServiceUnavailable},
+		{
+			name:     "redirect",
+			fallback: RedirectFallback("https://status.example/", 0),
+			status:   http.StatusFound,
+			header:   [2]string{"Location", "https://status.example/"},
+		},
+		{
+			name:     "redirect status",
+			fallback: RedirectFallback("https://status.example/", http.StatusTemporaryRedirect),
+			status:   http.StatusTemporaryRedirect,
+			header:   [2]string{"Location", "https://status.example/"},
+		},
+		{
+			name:     "pool",
+			fallback: PoolFallback(pool(t, "secondary"), roundrobin.New()),
+			status:   http.StatusOK,
+			body:     "secondary",
+		},
+		{
+			// A pool takes precedence over the static response.
+			name:     "pool over static",
+			fallback: &Fallback{Status: http.StatusTeapot, Registry: pool(t, "secondary"), Strategy: roundrobin.New()},
+			status:   http.StatusOK,
+			body:     "secondary",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGateway(t, &Route{
+				Name:     "api",
+				Prefix:   "/api",
+				Registry: primary,
+				Strategy: roundrobin.New(),
+				CB:       openBreaker(time.Minute),
+				Fallback: tt.fallback,
+			})
+
+			w := serve(g, http.MethodGet, "/api/x")
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Fatalf("body %q, want %q", w.Body, tt.body)
+			}
+			if k := tt.header[0]; k != "" && w.Header().Get(k) != tt.header[1] {
+				t.Fatalf("%s = %q, want %q", k, w.Header().Get(k), tt.header[1])
+			}
+		})
+	}
+
+	if n := hits.Load(); n != 0 {
+		t.Fatalf("primary hit %d times behind an open breaker", n)
+	}
+}
+
+func TestFallbackOnOpenPoolBreaker(t *testing.T) {
+	primary := pool(t, "primary")
+	primary.CB = openBreaker(50 * time.Millisecond)
+
+	routeCB := circuitbreaker.NewCircuitBreaker(1, time.Minute)
+	g := newTestGateway(t, &Route{
+		Name:     "api",
+		Prefix:   "/api",
+		Registry: primary,
+		Strategy: roundrobin.New(),
+		CB:       routeCB,
+		Fallback: PoolFallback(pool(t, "secondary"), roundrobin.New()),
+	})
+
+	// The pool's open breaker sends requests to the fallback without
+	// counting against the route's breaker.
+	for range 3 {
+		if w := serve(g, http.MethodGet, "/api/x"); w.Body.String() != "secondary" {
+			t.Fatalf("got %d %q with the pool breaker open", w.Code, w.Body)
+		}
+	}
+	if s := routeCB.State(); s != circuitbreaker.Closed {
+		t.Fatalf("route breaker %s, want closed", s)
+	}
+
+	// Once the pool recovers the route serves from it again.
+	time.Sleep(60 * time.Millisecond)
+	if w := serve(g, http.MethodGet, "/api/x"); w.Body.String() != "primary" {
+		t.Fatalf("got %d %q after the pool recovered", w.Code, w.Body)
+	}
+}
+
+func TestRouteBreakerTripsToFallback(t *testing.T) {
+	var hits atomic.Int32
+	primary := poolFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+
+	routeCB := circuitbreaker.NewCircuitBreaker(2, time.Minute)
+	g := newTestGateway(t, &Route{
+		Name:     "api",
+		Prefix:   "/api",
+		Registry: primary,
+		Strategy: roundrobin.New(),
+		CB:       routeCB,
+		Fallback: StaticFallback(http.StatusServiceUnavailable, []byte("fallback")),
+	})
+
+	for range 2 {
+		if w := serve(g, http.MethodGet, "/api/x"); w.Code < 500 {
+			t.Fatalf("status %d before the route breaker tripped", w.Code)
+		}
+	}
+	if s := routeCB.State(); s != circuitbreaker.Open {
+		t.Fatalf("route breaker %s after two 5xx, want open", s)
+	}
+
+	if w := serve(g, http.MethodGet, "/api/x"); w.Body.String() != "fallback" {
+		t.Fatalf("got %d %q with the route breaker open", w.Code, w.Body)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("primary hit %d times, want 2", n)
+	}
+}
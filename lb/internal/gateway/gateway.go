@@ -1,36 +1,371 @@
 package gateway
 
 import (
-	"go_loadbalancer/lb/internal/handler"
+	"bufio"
+	"errors"
+	"net"
 	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go_loadbalancer/lb/internal/circuitbreaker"
+	"go_loadbalancer/lb/internal/clientcert"
+	"go_loadbalancer/lb/internal/forwarded"
+	"go_loadbalancer/lb/internal/handler"
+	"go_loadbalancer/lb/internal/registry"
+	"go_loadbalancer/lb/internal/strategy"
 )
 
+// Gateway dispatches requests to per-route pipelines. The route table is
+// immutable once installed and replaced atomically, so requests never see a
+// half-updated table and routes never share a pool by accident.
 type Gateway struct {
-	Routes  []*Route
+	// Handler supplies defaults for routes that do not set their own retry
+	// policy, and the tunnel manager shared by all routes.
 	Handler *handler.LBHandler
+	// Forwarding decides whose forwarding headers are believed when
+	// resolving ${client_ip}; it should match the backends' own.
+	Forwarding *forwarded.Config
+
+	mu    sync.Mutex
+	table atomic.Pointer[routeTable]
+}
+
+type routeTable struct {
+	routes []*compiledRoute
+	index  radixNode
+}
+
+type compiledRoute struct {
+	*Route
+	// segments is the parsed PathTemplate and rewrite the parsed
+	// PathRewrite template.
+	segments []segment
+	rewrite  []segment
+	pipeline *handler.LBHandler
+	variants map[*Variant]*handler.LBHandler
+}
+
+func (cr *compiledRoute) match(req *http.Request) (map[string]string, rank, bool) {
+	return cr.Route.match(req, cr.segments)
+}
+
+func (cr *compiledRoute) rewritePath(req *http.Request) string {
+	return cr.Route.rewrite(req, cr.rewrite)
 }
 
 func NewGateway(h *handler.LBHandler) *Gateway {
-	return &Gateway{
-		Routes:  make([]*Route, 0),
-		Handler: h,
+	g := &Gateway{Handler: h}
+	g.table.Store(&routeTable{})
+
+	return g
+}
+
+// Register appends r to the route table.
+func (g *Gateway) Register(r *Route) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.install(append(g.Routes(), r))
+}
+
+// SetRoutes replaces the whole route table. In-flight requests finish on
+// the table they started with. An invalid table is rejected as a whole and
+// the current one stays in place. Weight shifts of splits that are not in
+// the new table are stopped.
+func (g *Gateway) SetRoutes(routes []*Route) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.install(routes)
+}
+
+func (g *Gateway) install(routes []*Route) error {
+	t, err := g.compile(routes)
+	if err != nil {
+		return err
 	}
+
+	old := g.table.Swap(t)
+
+	// A split that left the table can no longer be reached, so stop its
+	// shift rather than leave it running.
+	for _, cr := range old.routes {
+		if cr.Split != nil && !slices.ContainsFunc(t.routes, func(n *compiledRoute) bool { return n.Split == cr.Split }) {
+			cr.Split.Stop()
+		}
+	}
+
+	return nil
 }
 
-func (g *Gateway) Register(r *Route) {
-	g.Routes = append(g.Routes, r)
+// Routes returns the installed routes in registration order. It replaced
+// the exported Routes field when the table became immutable; change routes
+// with Register or SetRoutes rather than by editing the returned slice.
+func (g *Gateway) Routes() []*Route {
+	t := g.table.Load()
+
+	routes := make([]*Route, len(t.routes))
+	for i, cr := range t.routes {
+		routes[i] = cr.Route
+	}
+
+	return routes
+}
+
+func (g *Gateway) compile(routes []*Route) (*routeTable, error) {
+	t := &routeTable{
+		routes: make([]*compiledRoute, len(routes)),
+	}
+
+	for i, r := range routes {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+
+		rewrite, err := r.rewriteSegments()
+		if err != nil {
+			return nil, err
+		}
+
+		cr := &compiledRoute{
+			Route:    r,
+			segments: r.segments(),
+			rewrite:  rewrite,
+			pipeline: g.pipeline(r, r.Registry, r.Strategy),
+		}
+
+		if r.Split != nil {
+			cr.variants = make(map[*Variant]*handler.LBHandler, len(r.Split.Variants))
+			for _, v := range r.Split.Variants {
+				cr.variants[v] = g.pipeline(r, v.Registry, v.Strategy)
+			}
+		}
+
+		t.routes[i] = cr
+		t.index.insert(r.indexKey(), i)
+	}
+
+	return t, nil
+}
+
+func (g *Gateway) pipeline(r *Route, reg *registry.BackendRegistry, strat strategy.Strategy) *handler.LBHandler {
+	policy := g.Handler.Policy
+	if r.Policy != nil {
+		policy = *r.Policy
+	}
+
+	return &handler.LBHandler{
+		Registry:      reg,
+		Strategy:      strat,
+		Policy:        policy,
+		Hedge:         r.Hedge,
+		GlobalLimiter: r.Limiter,
+		Tunnels:       g.Handler.Tunnels,
+		Mirror:        r.Mirror,
+	}
+}
+
+// Route returns the route with the given name, or nil.
+func (g *Gateway) Route(name string) *Route {
+	for _, cr := range g.table.Load().routes {
+		if cr.Name == name {
+			return cr.Route
+		}
+	}
+
+	return nil
 }
 
 func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	for _, route := range g.Routes {
-		if route.Match(r.URL.Path) {
-			r.URL.Path = route.Rewrite(r.URL.Path)
-			g.Handler.Registry = route.Registry
-			g.Handler.Strategy = route.Strategy
-			g.Handler.ServeBackend(w, r)
+	t := g.table.Load()
+
+	i, params, ok := best(t.routes, &t.index, r)
+	if !ok {
+		http.Error(w, "route not found", http.StatusNotFound)
+		return
+	}
+
+	route := t.routes[i]
+	r = withParams(r, params)
+
+	// Backends trust these headers, so clients must never supply their own.
+	clientcert.SetHeaders(r.Header, clientcert.Verified(r))
+
+	if route.RequestHeaders != nil || route.ResponseHeaders != nil {
+		// Fix the request ID before forwarding so the backend and the
+		// response carry the same one.
+		requestID(r)
+
+		vars := requestVars(r, route.Route, g.Forwarding)
+		route.RequestHeaders.apply(r.Header, vars)
+
+		if route.ResponseHeaders != nil {
+			w = &headerRewriter{ResponseWriter: w, rules: route.ResponseHeaders, vars: vars}
+		}
+	}
+
+	g.serveRoute(w, withPath(r, route.rewritePath(r)), route)
+}
+
+// withPath returns a shallow copy of r with a new path, leaving r untouched.
+func withPath(r *http.Request, path string) *http.Request {
+	if path == r.URL.Path {
+		return r
+	}
+
+	r2 := new(http.Request)
+	*r2 = *r
+
+	u := *r.URL
+	u.Path = path
+	u.RawPath = ""
+	r2.URL = &u
+
+	return r2
+}
+
+func (g *Gateway) serveRoute(w http.ResponseWriter, r *http.Request, route *compiledRoute) {
+	if route.ClientCert != nil {
+		cert := clientcert.Verified(r)
+		if cert == nil {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+
+		if !route.ClientCert.Allows(cert) {
+			http.Error(w, "client certificate not allowed", http.StatusForbidden)
 			return
 		}
 	}
 
-	http.Error(w, "route not found", http.StatusNotFound)
+	if route.JWT != nil {
+		if r = route.JWT.authorize(w, r); r == nil {
+			return
+		}
+	}
+
+	pipeline := route.pipeline
+	var variant *Variant
+	if route.Split != nil {
+		variant = route.Split.Pick(r)
+		if variant == nil {
+			http.Error(w, "no variant available", http.StatusServiceUnavailable)
+			return
+		}
+		pipeline = route.variants[variant]
+	}
+
+	var permit circuitbreaker.Permit
+	if route.CB != nil {
+		var ok bool
+		if permit, ok = route.CB.Allow(); !ok {
+			route.Fallback.serve(w, r, pipeline)
+			return
+		}
+	}
+
+	start := time.Now()
+	record := func(ok bool) {
+		elapsed := time.Since(start)
+		if variant != nil {
+			variant.stats.observe(start.Add(elapsed), !ok, elapsed)
+		}
+		permit.Record(ok, elapsed)
+	}
+
+	// An upgraded connection is judged on its handshake, not on how long
+	// the tunnel then stays open.
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK, onHijack: func() { record(true) }}
+
+	err := pipeline.Serve(sw, r)
+	if sw.hijacked {
+		return
+	}
+
+	if errors.Is(err, circuitbreaker.ErrOpen) {
+		// The pool's own breaker already accounts for this; charging the
+		// route too would keep it on the fallback after the pool recovers.
+		if variant != nil {
+			elapsed := time.Since(start)
+			variant.stats.observe(start.Add(elapsed), true, elapsed)
+		}
+		permit.Release()
+		route.Fallback.serve(w, r, pipeline)
+		return
+	}
+
+	record(err == nil && sw.status < 500)
+}
+
+// headerRewriter applies response header rules just before the headers are
+// sent.
+type headerRewriter struct {
+	http.ResponseWriter
+	rules   *HeaderRules
+	vars    func(string) string
+	applied bool
+}
+
+func (hw *headerRewriter) WriteHeader(status int) {
+	hw.apply()
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *headerRewriter) apply() {
+	if !hw.applied {
+		hw.applied = true
+		hw.rules.apply(hw.Header(), hw.vars)
+	}
+}
+
+func (hw *headerRewriter) Write(b []byte) (int, error) {
+	if !hw.applied {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(b)
+}
+
+func (hw *headerRewriter) Flush() {
+	// Flushing first sends the headers, so the rules must be in place.
+	hw.apply()
+	_ = http.NewResponseController(hw.ResponseWriter).Flush()
+}
+
+func (hw *headerRewriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+
+	onHijack func()
+	hijacked bool
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Flush() {
+	_ = http.NewResponseController(sw.ResponseWriter).Flush()
+}
+
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(sw.ResponseWriter).Hijack()
+	if err == nil && !sw.hijacked {
+		sw.hijacked = true
+		sw.status = http.StatusSwitchingProtocols
+		sw.onHijack()
+	}
+
+	return conn, buf, err
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
 }
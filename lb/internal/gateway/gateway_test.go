@@ -0,0 +1,197 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go_loadbalancer/lb/internal/backend"
+	"go_loadbalancer/lb/internal/handler"
+	"go_loadbalancer/lb/internal/registry"
+	"go_loadbalancer/lb/internal/strategy/roundrobin"
+)
+
+// pool returns a one-backend registry whose backend answers with name.
+func pool(t *testing.T, name string) *registry.BackendRegistry {
+	t.Helper()
+
+	return poolFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	})
+}
+
+func poolFunc(t *testing.T, h http.HandlerFunc) *registry.BackendRegistry {
+	t.Helper()
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	b, err := backend.CreateNewBackend(srv.URL, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := registry.NewRegistry()
+	reg.Add(b)
+
+	return reg
+}
+
+func newTestGateway(t *testing.T, routes ...*Route) *Gateway {
+	t.Helper()
+
+	g := NewGateway(handler.NewHandler(registry.NewRegistry(), roundrobin.New(), 1, nil))
+	if err := g.SetRoutes(routes); err != nil {
+		t.Fatal(err)
+	}
+
+	return g
+}
+
+func serve(g http.Handler, method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+
+	return w
+}
+
+func TestSetRoutesUnderLoad(t *testing.T) {
+	pools := map[string]*registry.BackendRegistry{}
+	for _, name := range []string{"a1", "a2", "b1", "b2"} {
+		pools[name] = pool(t, name)
+	}
+
+	table := func(gen string) []*Route {
+		return []*Route{
+			{Name: "a", Prefix: "/a", Registry: pools["a"+gen], Strategy: roundrobin.New()},
+			{Name: "b", Prefix: "/b", Registry: pools["b"+gen], Strategy: roundrobin.New()},
+		}
+	}
+
+	g := newTestGateway(t, table("1")...)
+	srv := httptest.NewServer(g)
+	defer srv.Close()
+
+	stop := make(chan struct{})
+	var swaps atomic.Int32
+
+	var swapper sync.WaitGroup
+	swapper.Add(1)
+	go func() {
+		defer swapper.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			if err := g.SetRoutes(table(fmt.Sprint(i%2 + 1))); err != nil {
+				t.Error(err)
+				return
+			}
+			swaps.Add(1)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	var clients sync.WaitGroup
+	for c := range 8 {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+
+			route := []string{"a", "b"}[c%2]
+			for range 50 {
+				resp, err := http.Get(srv.URL + "/" + route)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+
+				// Either table may serve the request, never the other route.
+				if got := string(body); got != route+"1" && got != route+"2" {
+					t.Errorf("/%s answered %q (status %d)", route, got, resp.StatusCode)
+					return
+				}
+			}
+		}()
+	}
+
+	clients.Wait()
+	close(stop)
+	swapper.Wait()
+
+	if swaps.Load() == 0 {
+		t.Fatal("route table was never swapped")
+	}
+}
+
+func TestSetRoutesRejectsInvalidTable(t *testing.T) {
+	g := newTestGateway(t, &Route{Name: "a", Prefix: "/", Registry: pool(t, "a"), Strategy: roundrobin.New()})
+
+	bad := &Route{Name: "bad", Prefix: "/", Fallback: &Fallback{Registry: pool(t, "f")}}
+	if err := g.SetRoutes([]*Route{bad}); err == nil {
+		t.Fatal("invalid table installed")
+	}
+
+	if got := serve(g, http.MethodGet, "/").Body.String(); got != "a" {
+		t.Fatalf("old table lost: got %q", got)
+	}
+	if routes := g.Routes(); len(routes) != 1 || routes[0].Name != "a" {
+		t.Fatalf("Routes() = %v", routes)
+	}
+}
+
+func TestSetRoutesStopsDroppedShift(t *testing.T) {
+	newSplit := func() *TrafficSplit {
+		ts, err := NewTrafficSplit([]*Variant{
+			{Name: "stable", Registry: pool(t, "stable"), Strategy: roundrobin.New()},
+			{Name: "canary", Registry: pool(t, "canary"), Strategy: roundrobin.New()},
+		}, map[string]int{"stable": 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+
+	kept, dropped := newSplit(), newSplit()
+	g := newTestGateway(t,
+		&Route{Name: "kept", Prefix: "/kept", Split: kept},
+		&Route{Name: "dropped", Prefix: "/dropped", Split: dropped},
+	)
+
+	target := map[string]int{"stable": 0, "canary": 100}
+	for _, ts := range []*TrafficSplit{kept, dropped} {
+		if err := ts.ShiftTo(context.Background(), target, 1, time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A new Route value sharing the split keeps its shift running.
+	if err := g.SetRoutes([]*Route{{Name: "kept", Prefix: "/kept", Split: kept}}); err != nil {
+		t.Fatal(err)
+	}
+	stopped := dropped.Weights()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for kept.Weights()["canary"] != 100 {
+		if time.Now().After(deadline) {
+			t.Fatalf("kept split stuck at %v", kept.Weights())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if got := dropped.Weights(); !maps.Equal(got, stopped) {
+		t.Fatalf("dropped split kept shifting: %v, then %v", stopped, got)
+	}
+}
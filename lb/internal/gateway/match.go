@@ -0,0 +1,183 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ValueMatch matches a header or query parameter by name. With Regex set
+// any value must match it, with Value set any value must equal it, and with
+// neither the parameter only has to be present.
+type ValueMatch struct {
+	Name  string
+	Value string
+	Regex *regexp.Regexp
+}
+
+func (m ValueMatch) match(values []string) bool {
+	if len(values) == 0 {
+		return false
+	}
+
+	if m.Regex != nil {
+		return slices.ContainsFunc(values, m.Regex.MatchString)
+	}
+
+	if m.Value != "" {
+		return slices.Contains(values, m.Value)
+	}
+
+	return true
+}
+
+type paramsKey struct{}
+
+// PathParams returns the parameters captured by the route template that
+// matched r, such as "id" for "/users/{id}".
+func PathParams(r *http.Request) map[string]string {
+	params, _ := r.Context().Value(paramsKey{}).(map[string]string)
+	return params
+}
+
+func withParams(r *http.Request, params map[string]string) *http.Request {
+	if len(params) == 0 {
+		return r
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), paramsKey{}, params))
+}
+
+// segment is one "/"-separated part of a path template: a literal, a
+// "{name}" parameter or a trailing "{name...}" catch-all.
+type segment struct {
+	literal  string
+	param    string
+	catchAll bool
+}
+
+func parseTemplate(tmpl string) []segment {
+	parts := strings.Split(strings.TrimPrefix(tmpl, "/"), "/")
+	segs := make([]segment, len(parts))
+
+	for i, p := range parts {
+		name, ok := strings.CutPrefix(p, "{")
+		if name, ok2 := strings.CutSuffix(name, "}"); ok && ok2 {
+			name, catchAll := strings.CutSuffix(name, "...")
+			segs[i] = segment{param: name, catchAll: catchAll && i == len(parts)-1}
+			continue
+		}
+		segs[i] = segment{literal: p}
+	}
+
+	return segs
+}
+
+func matchTemplate(segs []segment, path string) (map[string]string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+
+	var params map[string]string
+	for i, seg := range segs {
+		if seg.catchAll {
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[seg.param] = strings.Join(parts[i:], "/")
+			return params, true
+		}
+
+		if i >= len(parts) {
+			return nil, false
+		}
+
+		if seg.param == "" {
+			if parts[i] != seg.literal {
+				return nil, false
+			}
+			continue
+		}
+
+		if parts[i] == "" {
+			return nil, false
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[seg.param] = parts[i]
+	}
+
+	if len(parts) != len(segs) {
+		return nil, false
+	}
+
+	return params, true
+}
+
+// templatePrefix is the literal part of a template before its first
+// parameter, used to place the route in the radix tree.
+func templatePrefix(tmpl string) string {
+	prefix, _, _ := strings.Cut(tmpl, "{")
+	return prefix
+}
+
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// matchHost returns how specifically pattern matched host: 0 for no match,
+// higher for exact names than for wildcards, and longer wildcards higher.
+func matchHost(pattern, host string) int {
+	pattern = strings.ToLower(pattern)
+
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+			return 1 + len(suffix)
+		}
+		return 0
+	}
+
+	if pattern == host {
+		return 1 << 16
+	}
+
+	return 0
+}
+
+// rank orders matching routes: explicit priority first, then host and path
+// specificity, then the number of extra conditions.
+type rank struct {
+	priority int
+	host     int
+	path     int
+	conds    int
+}
+
+func (a rank) less(b rank) bool {
+	if a.priority != b.priority {
+		return a.priority < b.priority
+	}
+	if a.host != b.host {
+		return a.host < b.host
+	}
+	if a.path != b.path {
+		return a.path < b.path
+	}
+	return a.conds < b.conds
+}
+
+// Path specificity tiers; within a tier longer literals win.
+const (
+	pathAny = iota << 16
+	pathPrefix
+	pathRegex
+	pathTemplate
+	pathExact
+)
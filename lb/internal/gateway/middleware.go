@@ -1,15 +1,146 @@
 package gateway
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go_loadbalancer/lb/internal/jwt"
 )
 
-func JWTMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("Authorization")
+// JWTAuth admits requests carrying a valid bearer token.
+type JWTAuth struct {
+	Verifier *jwt.Verifier
+
+	// RequiredClaims maps a claim to the values it must contain at least one
+	// of; array claims and space-separated strings such as "scope" match on
+	// any element. An empty list only requires the claim to be present.
+	RequiredClaims map[string][]string
+
+	// ClaimHeaders forwards claims to the backend, mapping a claim name to a
+	// header name. Incoming copies of these headers are always removed so
+	// clients cannot forge them.
+	ClaimHeaders map[string]string
+}
+
+type claimsKey struct{}
+
+// JWTClaims returns the verified token claims for r, or nil.
+func JWTClaims(r *http.Request) jwt.Claims {
+	c, _ := r.Context().Value(claimsKey{}).(jwt.Claims)
+	return c
+}
+
+// authorize verifies r's token, writing a 401 or 403 and returning nil if it
+// is not acceptable. On success it returns r carrying the claims.
+func (a *JWTAuth) authorize(w http.ResponseWriter, r *http.Request) *http.Request {
+	for _, h := range a.ClaimHeaders {
+		r.Header.Del(h)
+	}
+
+	token, ok := bearerToken(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+
+	claims, err := a.Verifier.Verify(r.Context(), token)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+
+	for name, values := range a.RequiredClaims {
+		if !hasClaim(claims, name, values) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return nil
+		}
+	}
+
+	for name, h := range a.ClaimHeaders {
+		if v, ok := claimValue(claims[name]); ok {
+			r.Header.Set(h, v)
+		}
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims))
+}
 
-		if token == "" {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func hasClaim(claims jwt.Claims, name string, values []string) bool {
+	if _, ok := claims[name]; !ok {
+		return false
+	}
+	if len(values) == 0 {
+		return true
+	}
+
+	if s, ok := claims[name].(string); ok && slices.Contains(values, s) {
+		return true
+	}
+
+	return slices.ContainsFunc(claims.Strings(name), func(v string) bool {
+		return slices.Contains(values, v)
+	})
+}
+
+// claimValue renders a claim as a header value: strings as they are, arrays
+// of strings comma-separated, anything else as JSON.
+func claimValue(v any) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case []any:
+		parts := make([]string, 0, len(v))
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return jsonValue(v)
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), true
+	}
+
+	return jsonValue(v)
+}
+
+func jsonValue(v any) (string, bool) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", false
+	}
+
+	return string(b), true
+}
+
+// JWTMiddleware only passes requests that auth admits to next.
+func JWTMiddleware(auth *JWTAuth, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = auth.authorize(w, r)
+		if r == nil {
+			return
 		}
 
 		next.ServeHTTP(w, r)
@@ -0,0 +1,107 @@
+package gateway
+
+import (
+	"net/http"
+	"strings"
+)
+
+// radixNode indexes routes by the literal path prefix they require. A lookup
+// walks the request path once and yields every route stored along the way,
+// so only routes that can possibly match are checked.
+type radixNode struct {
+	prefix   string
+	children []*radixNode
+	items    []int
+}
+
+func (n *radixNode) insert(key string, item int) {
+	for {
+		if key == "" {
+			n.items = append(n.items, item)
+			return
+		}
+
+		child := n.child(key[0])
+		if child == nil {
+			n.children = append(n.children, &radixNode{prefix: key, items: []int{item}})
+			return
+		}
+
+		common := commonPrefix(child.prefix, key)
+		if common < len(child.prefix) {
+			// Split the child so that the shared part becomes its own node.
+			split := &radixNode{
+				prefix:   child.prefix[common:],
+				children: child.children,
+				items:    child.items,
+			}
+			child.prefix = child.prefix[:common]
+			child.children = []*radixNode{split}
+			child.items = nil
+		}
+
+		n = child
+		key = key[common:]
+	}
+}
+
+func (n *radixNode) child(b byte) *radixNode {
+	for _, c := range n.children {
+		if c.prefix[0] == b {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// collect calls fn for every item whose key is a prefix of path.
+func (n *radixNode) collect(path string, fn func(int)) {
+	for {
+		for _, item := range n.items {
+			fn(item)
+		}
+
+		if path == "" {
+			return
+		}
+
+		child := n.child(path[0])
+		if child == nil || !strings.HasPrefix(path, child.prefix) {
+			return
+		}
+
+		n = child
+		path = path[len(child.prefix):]
+	}
+}
+
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	return i
+}
+
+// best returns the highest-ranked route in routes that matches r, using
+// index to skip routes whose path cannot match.
+func best(routes []*compiledRoute, index *radixNode, r *http.Request) (int, map[string]string, bool) {
+	found := -1
+	var bestRank rank
+	var bestParams map[string]string
+
+	index.collect(r.URL.Path, func(i int) {
+		params, rk, ok := routes[i].match(r)
+		if !ok {
+			return
+		}
+
+		if found < 0 || bestRank.less(rk) || (!rk.less(bestRank) && i < found) {
+			found, bestRank, bestParams = i, rk, params
+		}
+	})
+
+	return found, bestParams, found >= 0
+}
@@ -0,0 +1,172 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"go_loadbalancer/lb/internal/forwarded"
+)
+
+const RequestIDHeader = "X-Request-Id"
+
+// PathRewrite changes the path, not the query, sent to the backend. The
+// first configured form applies:
+//
+//   - Template builds the path from the route's path parameters, e.g.
+//     "/v2/accounts/{id}"; each parameter must appear in the route's
+//     PathTemplate.
+//   - Regex replaces matches with Replacement, which may use $1 or ${name}.
+//   - ReplacePrefix substitutes the route's Prefix.
+type PathRewrite struct {
+	Template string
+
+	Regex       *regexp.Regexp
+	Replacement string
+
+	ReplacePrefix string
+}
+
+// HeaderRules edit headers in the order Remove, Set, Add. Values may use
+// ${client_ip}, ${request_id}, ${route}, ${host}, ${method}, ${path} and
+// ${param.<name>}.
+type HeaderRules struct {
+	Remove []string
+	Set    map[string]string
+	Add    map[string]string
+}
+
+func (hr *HeaderRules) apply(h http.Header, vars func(string) string) {
+	if hr == nil {
+		return
+	}
+
+	for _, name := range hr.Remove {
+		h.Del(name)
+	}
+
+	for name, v := range hr.Set {
+		h.Set(name, interpolate(v, vars))
+	}
+
+	for name, v := range hr.Add {
+		h.Add(name, interpolate(v, vars))
+	}
+}
+
+var varPattern = regexp.MustCompile(`\$\{([a-z_]+(?:\.[^}]+)?)\}`)
+
+func interpolate(s string, vars func(string) string) string {
+	if !strings.Contains(s, "${") {
+		return s
+	}
+
+	return varPattern.ReplaceAllStringFunc(s, func(m string) string {
+		return vars(m[2 : len(m)-1])
+	})
+}
+
+// requestVars resolves interpolation variables for r. The client IP is
+// the original client's as fwd establishes it. The request ID is taken from
+// the incoming header or generated, and then set on r so the backend sees
+// the same value.
+func requestVars(r *http.Request, route *Route, fwd *forwarded.Config) func(string) string {
+	return func(name string) string {
+		switch name {
+		case "client_ip":
+			if ip := fwd.ClientIP(r); ip != nil {
+				return ip.String()
+			}
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				return r.RemoteAddr
+			}
+			return host
+		case "request_id":
+			return requestID(r)
+		case "route":
+			return route.Name
+		case "host":
+			return r.Host
+		case "method":
+			return r.Method
+		case "path":
+			return r.URL.Path
+		}
+
+		if param, ok := strings.CutPrefix(name, "param."); ok {
+			return PathParams(r)[param]
+		}
+
+		return ""
+	}
+}
+
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(RequestIDHeader); id != "" {
+		return id
+	}
+
+	var b [16]byte
+	rand.Read(b[:])
+	id := hex.EncodeToString(b[:])
+	r.Header.Set(RequestIDHeader, id)
+
+	return id
+}
+
+// apply rewrites path; segs is pr's parsed Template.
+func (pr *PathRewrite) apply(path, prefix string, params map[string]string, segs []segment) string {
+	switch {
+	case pr.Template != "":
+		parts := make([]string, len(segs))
+		for i, seg := range segs {
+			if seg.param != "" {
+				parts[i] = params[seg.param]
+			} else {
+				parts[i] = seg.literal
+			}
+		}
+		return "/" + strings.Join(parts, "/")
+	case pr.Regex != nil:
+		return pr.Regex.ReplaceAllString(path, pr.Replacement)
+	case prefix != "" && strings.HasPrefix(path, prefix):
+		return pr.ReplacePrefix + path[len(prefix):]
+	}
+
+	return path
+}
+
+// parseRewriteTemplate parses a rewrite Template, rejecting empty
+// parameter names and braces outside a "{name}" segment.
+func parseRewriteTemplate(tmpl string) ([]segment, error) {
+	for _, part := range strings.Split(strings.TrimPrefix(tmpl, "/"), "/") {
+		name, isParam := strings.CutPrefix(part, "{")
+		if isParam {
+			var closed bool
+			name, closed = strings.CutSuffix(name, "}")
+			name = strings.TrimSuffix(name, "...")
+			if !closed || name == "" {
+				return nil, fmt.Errorf("malformed rewrite parameter %q", part)
+			}
+		}
+
+		if strings.ContainsAny(name, "{}") {
+			return nil, fmt.Errorf("stray brace in rewrite segment %q", part)
+		}
+	}
+
+	return parseTemplate(tmpl), nil
+}
+
+func cleanRewritten(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	return path
+}
@@ -0,0 +1,145 @@
+package gateway
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go_loadbalancer/lb/internal/forwarded"
+	"go_loadbalancer/lb/internal/handler"
+	"go_loadbalancer/lb/internal/registry"
+	"go_loadbalancer/lb/internal/strategy/roundrobin"
+	"go_loadbalancer/lb/internal/util"
+)
+
+func TestHeaderRewriterFlush(t *testing.T) {
+	rec := httptest.NewRecorder()
+	hw := &headerRewriter{
+		ResponseWriter: rec,
+		rules:          &HeaderRules{Set: map[string]string{"X-Route": "${route}"}, Remove: []string{"Server"}},
+		vars:           func(string) string { return "api" },
+	}
+
+	hw.Header().Set("Server", "backend")
+	hw.Flush()
+	hw.Write([]byte("body"))
+
+	h := rec.Result().Header
+	if got := h.Get("X-Route"); got != "api" {
+		t.Errorf("X-Route = %q, want %q", got, "api")
+	}
+	if got := h.Get("Server"); got != "" {
+		t.Errorf("Server = %q, want it removed", got)
+	}
+}
+
+func TestRewriteTemplateParams(t *testing.T) {
+	tests := []struct {
+		name  string
+		route *Route
+		ok    bool
+	}{
+		{
+			name:  "defined",
+			route: &Route{PathTemplate: "/users/{id}/{rest...}", PathRewrite: &PathRewrite{Template: "/v2/accounts/{id}/{rest}"}},
+			ok:    true,
+		},
+		{
+			name:  "undefined",
+			route: &Route{PathTemplate: "/users/{id}", PathRewrite: &PathRewrite{Template: "/v2/accounts/{uid}"}},
+		},
+		{
+			name:  "no path template",
+			route: &Route{Prefix: "/users", PathRewrite: &PathRewrite{Template: "/v2/{id}"}},
+		},
+		{
+			name:  "literal only",
+			route: &Route{Prefix: "/users", PathRewrite: &PathRewrite{Template: "/v2/users"}},
+			ok:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.route.validate()
+			if tt.ok && err != nil {
+				t.Fatal(err)
+			}
+			if !tt.ok && !errors.Is(err, ErrInvalidRoute) {
+				t.Fatalf("validate() = %v, want ErrInvalidRoute", err)
+			}
+		})
+	}
+}
+
+func TestRewriteTemplate(t *testing.T) {
+	route := &Route{PathTemplate: "/users/{id}/{rest...}", PathRewrite: &PathRewrite{Template: "/v2/accounts/{id}/{rest}"}}
+
+	req := httptest.NewRequest(http.MethodGet, "/users/42/posts/7", nil)
+	params, _, ok := route.match(req, route.segments())
+	if !ok {
+		t.Fatal("route did not match")
+	}
+
+	if got := route.Rewrite(withParams(req, params)); got != "/v2/accounts/42/posts/7" {
+		t.Fatalf("Rewrite() = %q", got)
+	}
+}
+
+func TestRewriteTemplateMalformed(t *testing.T) {
+	for _, tmpl := range []string{"/v2/{id", "/v2/id}", "/v2/{}", "/v2/{...}", "/v2/a{id}", "/v2/{a{id}}"} {
+		route := &Route{PathTemplate: "/users/{id}", PathRewrite: &PathRewrite{Template: tmpl}}
+		if err := route.validate(); !errors.Is(err, ErrInvalidRoute) {
+			t.Errorf("%q: validate() = %v, want ErrInvalidRoute", tmpl, err)
+		}
+	}
+
+	g := NewGateway(handler.NewHandler(registry.NewRegistry(), roundrobin.New(), 1, nil))
+	err := g.SetRoutes([]*Route{{Name: "bad", PathTemplate: "/users/{id}", PathRewrite: &PathRewrite{Template: "/v2/{id"}}})
+	if !errors.Is(err, ErrInvalidRoute) {
+		t.Fatalf("SetRoutes() = %v, want ErrInvalidRoute", err)
+	}
+}
+
+func TestClientIPVariable(t *testing.T) {
+	reg := poolFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Client-IP"))
+	})
+
+	trusted, _ := util.ParseCIDRs([]string{"192.0.2.0/24"})
+
+	tests := []struct {
+		name       string
+		forwarding *forwarded.Config
+		remote     string
+		want       string
+	}{
+		{name: "trusted proxy", forwarding: &forwarded.Config{TrustedProxies: trusted}, remote: "192.0.2.10:1234", want: "203.0.113.5"},
+		{name: "untrusted peer", forwarding: &forwarded.Config{TrustedProxies: trusted}, remote: "198.51.100.7:1234", want: "198.51.100.7"},
+		{name: "no config", remote: "192.0.2.10:1234", want: "192.0.2.10"},
+	}
+
+	for _, tt := range tests {
+		g := newTestGateway(t, &Route{
+			Name:           "api",
+			Prefix:         "/api",
+			Registry:       reg,
+			Strategy:       roundrobin.New(),
+			RequestHeaders: &HeaderRules{Set: map[string]string{"X-Client-IP": "${client_ip}"}},
+		})
+		g.Forwarding = tt.forwarding
+
+		req := httptest.NewRequest(http.MethodGet, "/api", nil)
+		req.RemoteAddr = tt.remote
+		req.Header.Set("X-Forwarded-For", "203.0.113.5")
+
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+
+		if got := w.Body.String(); got != tt.want {
+			t.Errorf("%s: client_ip = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,26 +1,258 @@
 package gateway
 
 import (
+	"errors"
+	"fmt"
+	"go_loadbalancer/lb/internal/circuitbreaker"
+	"go_loadbalancer/lb/internal/clientcert"
+	"go_loadbalancer/lb/internal/handler"
+	"go_loadbalancer/lb/internal/ratelimit"
 	"go_loadbalancer/lb/internal/registry"
+	"go_loadbalancer/lb/internal/retry"
 	"go_loadbalancer/lb/internal/strategy"
+	"net/http"
+	"regexp"
+	"slices"
 	"strings"
 )
 
+// Route matches requests by path and, optionally, host, method, headers and
+// query. Exactly one path matcher applies, checked in this order: GRPCService,
+// Path, PathTemplate, PathRegex, Prefix. Among matching routes the one with
+// the highest Priority wins, then the most specific one, then the first
+// registered.
 type Route struct {
+	Name string
+
 	Prefix       string
 	StringPrefix bool
-	Registry     *registry.BackendRegistry
-	Strategy     strategy.Strategy
+	// Path matches the path exactly.
+	Path string
+	// PathTemplate matches segments such as "/users/{id}" or "/files/{rest...}";
+	// the values are available through PathParams.
+	PathTemplate string
+	// PathRegex matches the path; anchor it with ^ and $ as needed.
+	PathRegex *regexp.Regexp
+
+	// Hosts are host names, or wildcards such as "*.example.com", any of
+	// which must equal the request host.
+	Hosts   []string
+	Methods []string
+	Headers []ValueMatch
+	Query   []ValueMatch
+
+	Priority int
+
+	PathRewrite     *PathRewrite
+	RequestHeaders  *HeaderRules
+	ResponseHeaders *HeaderRules
+
+	Registry *registry.BackendRegistry
+	Strategy strategy.Strategy
+	// Split, when set, sends traffic to its variants' pools instead of
+	// Registry.
+	Split *TrafficSplit
+
+	// Policy, Hedge and Limiter configure the route's own pipeline; a nil
+	// Policy uses the gateway handler's.
+	Policy  *retry.RetryPolicy
+	Hedge   *retry.HedgePolicy
+	Limiter *ratelimit.TokenBucket
+	// Mirror, when set, copies a share of the route's requests to a shadow
+	// pool.
+	Mirror *handler.Mirror
+
+	// GRPCService and GRPCMethod, when set, match gRPC calls by
+	// "/package.Service/Method" instead of by Prefix.
+	GRPCService string
+	GRPCMethod  string
+
+	CB       *circuitbreaker.CircuitBreaker
+	Fallback *Fallback
+
+	// ClientCert, when set, only admits clients presenting a verified
+	// certificate that satisfies it.
+	ClientCert *clientcert.Requirement
+	// JWT, when set, only admits requests with a bearer token it accepts.
+	JWT *JWTAuth
+}
+
+var ErrInvalidRoute = errors.New("invalid route")
+
+func (r *Route) validate() error {
+	if f := r.Fallback; f != nil && f.Registry != nil && f.Strategy == nil {
+		return fmt.Errorf("%w %q: fallback pool has no strategy", ErrInvalidRoute, r.Name)
+	}
+
+	if _, err := r.rewriteSegments(); err != nil {
+		return err
+	}
+
+	return nil
 }
 
-func (r *Route) Match(path string) bool {
-	return strings.HasPrefix(path, r.Prefix)
+// rewriteSegments parses the PathRewrite template, checking it is well
+// formed and only uses parameters of the route's PathTemplate.
+func (r *Route) rewriteSegments() ([]segment, error) {
+	pr := r.PathRewrite
+	if pr == nil || pr.Template == "" {
+		return nil, nil
+	}
+
+	segs, err := parseRewriteTemplate(pr.Template)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %w", ErrInvalidRoute, r.Name, err)
+	}
+
+	defined := make(map[string]bool)
+	for _, seg := range r.segments() {
+		if seg.param != "" {
+			defined[seg.param] = true
+		}
+	}
+
+	for _, seg := range segs {
+		if seg.param != "" && !defined[seg.param] {
+			return nil, fmt.Errorf("%w %q: rewrite parameter %q is not in the path template", ErrInvalidRoute, r.Name, seg.param)
+		}
+	}
+
+	return segs, nil
+}
+
+// Match reports whether req matches r. It parses PathTemplate on every
+// call; the gateway and Router parse it once when the route is added.
+func (r *Route) Match(req *http.Request) bool {
+	_, _, ok := r.match(req, r.segments())
+	return ok
 }
 
-func (r *Route) Rewrite(path string) string {
-	if r.StringPrefix {
-		return strings.TrimPrefix(path, r.Prefix)
+// match checks req against r; segs is r's parsed PathTemplate.
+func (r *Route) match(req *http.Request, segs []segment) (map[string]string, rank, bool) {
+	rk := rank{priority: r.Priority}
+
+	if len(r.Hosts) > 0 {
+		host := requestHost(req)
+		for _, h := range r.Hosts {
+			rk.host = max(rk.host, matchHost(h, host))
+		}
+		if rk.host == 0 {
+			return nil, rk, false
+		}
+	}
+
+	if len(r.Methods) > 0 {
+		if !slices.Contains(r.Methods, req.Method) {
+			return nil, rk, false
+		}
+		rk.conds++
+	}
+
+	for _, m := range r.Headers {
+		if !m.match(req.Header.Values(m.Name)) {
+			return nil, rk, false
+		}
+		rk.conds++
+	}
+
+	if len(r.Query) > 0 {
+		query := req.URL.Query()
+		for _, m := range r.Query {
+			if !m.match(query[m.Name]) {
+				return nil, rk, false
+			}
+			rk.conds++
+		}
+	}
+
+	params, pathRank, ok := r.matchPath(req.URL.Path, segs)
+	rk.path = pathRank
+
+	return params, rk, ok
+}
+
+func (r *Route) matchPath(path string, segs []segment) (map[string]string, int, bool) {
+	switch {
+	case r.GRPCService != "":
+		service, method, ok := ParseGRPCPath(path)
+		ok = ok && service == r.GRPCService && (r.GRPCMethod == "" || method == r.GRPCMethod)
+		if r.GRPCMethod == "" {
+			return nil, pathPrefix + len(r.GRPCService) + 2, ok
+		}
+		return nil, pathExact + len(path), ok
+	case r.Path != "":
+		return nil, pathExact + len(r.Path), path == r.Path
+	case r.PathTemplate != "":
+		params, ok := matchTemplate(segs, path)
+		return params, pathTemplate + len(templatePrefix(r.PathTemplate)), ok
+	case r.PathRegex != nil:
+		prefix, _ := r.PathRegex.LiteralPrefix()
+		return nil, pathRegex + len(prefix), r.PathRegex.MatchString(path)
+	case r.Prefix != "":
+		return nil, pathPrefix + len(r.Prefix), strings.HasPrefix(path, r.Prefix)
+	}
+
+	return nil, pathAny, true
+}
+
+// indexKey is the literal path prefix every request matching r starts with.
+func (r *Route) indexKey() string {
+	switch {
+	case r.GRPCService != "":
+		return "/" + r.GRPCService + "/"
+	case r.Path != "":
+		return r.Path
+	case r.PathTemplate != "":
+		return templatePrefix(r.PathTemplate)
+	case r.PathRegex != nil:
+		return ""
+	}
+
+	return r.Prefix
+}
+
+func (r *Route) segments() []segment {
+	if r.PathTemplate == "" {
+		return nil
+	}
+
+	return parseTemplate(r.PathTemplate)
+}
+
+func ParseGRPCPath(path string) (service, method string, ok bool) {
+	rest, found := strings.CutPrefix(path, "/")
+	if !found {
+		return "", "", false
+	}
+
+	service, method, ok = strings.Cut(rest, "/")
+	if !ok || service == "" || method == "" || strings.Contains(method, "/") {
+		return "", "", false
+	}
+
+	return service, method, true
+}
+
+// Rewrite returns the path to send to the backend for req. It parses the
+// rewrite template on every call; the gateway parses it once when the
+// route is added.
+func (r *Route) Rewrite(req *http.Request) string {
+	segs, _ := r.rewriteSegments()
+	return r.rewrite(req, segs)
+}
+
+// rewrite is Rewrite with the rewrite template already parsed into segs.
+func (r *Route) rewrite(req *http.Request, segs []segment) string {
+	path := req.URL.Path
+
+	switch {
+	case r.PathRewrite != nil:
+		path = r.PathRewrite.apply(path, r.Prefix, PathParams(req), segs)
+	case r.StringPrefix:
+		path = strings.TrimPrefix(path, r.Prefix)
+	default:
+		return path
 	}
 
-	return path
+	return cleanRewritten(path)
 }
@@ -0,0 +1,233 @@
+package gateway
+
+import (
+	"cmp"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"testing"
+)
+
+func TestRouterPrecedence(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes []*Route
+		method string
+		target string
+		header map[string]string
+		want   string
+		params map[string]string
+	}{
+		{
+			name: "exact host beats wildcard",
+			routes: []*Route{
+				{Name: "wild", Hosts: []string{"*.example.com"}, Prefix: "/"},
+				{Name: "exact", Hosts: []string{"api.example.com"}, Prefix: "/"},
+			},
+			target: "http://api.example.com/",
+			want:   "exact",
+		},
+		{
+			name: "longer wildcard beats shorter",
+			routes: []*Route{
+				{Name: "short", Hosts: []string{"*.com"}, Prefix: "/"},
+				{Name: "long", Hosts: []string{"*.example.com"}, Prefix: "/"},
+			},
+			target: "http://api.example.com:8080/",
+			want:   "long",
+		},
+		{
+			name: "wildcard needs a subdomain",
+			routes: []*Route{
+				{Name: "wild", Hosts: []string{"*.example.com"}, Prefix: "/"},
+				{Name: "any", Prefix: "/"},
+			},
+			target: "http://example.com/",
+			want:   "any",
+		},
+		{
+			name: "host beats path",
+			routes: []*Route{
+				{Name: "path", Path: "/users"},
+				{Name: "host", Hosts: []string{"api.example.com"}, Prefix: "/"},
+			},
+			target: "http://api.example.com/users",
+			want:   "host",
+		},
+		{
+			name: "method filters",
+			routes: []*Route{
+				{Name: "post", Prefix: "/", Methods: []string{http.MethodPost}},
+				{Name: "get", Prefix: "/", Methods: []string{http.MethodGet}},
+			},
+			method: http.MethodPost,
+			target: "/",
+			want:   "post",
+		},
+		{
+			name: "more conditions win",
+			routes: []*Route{
+				{Name: "plain", Prefix: "/"},
+				{Name: "header", Prefix: "/", Headers: []ValueMatch{{Name: "X-Env", Value: "canary"}}},
+				{Name: "header+query", Prefix: "/", Headers: []ValueMatch{{Name: "X-Env"}}, Query: []ValueMatch{{Name: "v", Regex: regexp.MustCompile(`^2`)}}},
+			},
+			target: "/?v=2",
+			header: map[string]string{"X-Env": "canary"},
+			want:   "header+query",
+		},
+		{
+			name: "unmatched header falls through",
+			routes: []*Route{
+				{Name: "plain", Prefix: "/"},
+				{Name: "header", Prefix: "/", Headers: []ValueMatch{{Name: "X-Env", Value: "canary"}}},
+			},
+			target: "/",
+			header: map[string]string{"X-Env": "prod"},
+			want:   "plain",
+		},
+		{
+			name: "exact beats template",
+			routes: []*Route{
+				{Name: "template", PathTemplate: "/users/{id}"},
+				{Name: "exact", Path: "/users/me"},
+			},
+			target: "/users/me",
+			want:   "exact",
+		},
+		{
+			name: "template beats regex",
+			routes: []*Route{
+				{Name: "regex", PathRegex: regexp.MustCompile(`^/users/[0-9]+$`)},
+				{Name: "template", PathTemplate: "/users/{id}"},
+			},
+			target: "/users/42",
+			want:   "template",
+			params: map[string]string{"id": "42"},
+		},
+		{
+			name: "regex beats prefix",
+			routes: []*Route{
+				{Name: "prefix", Prefix: "/users/"},
+				{Name: "regex", PathRegex: regexp.MustCompile(`^/users/[0-9]+$`)},
+			},
+			target: "/users/42",
+			want:   "regex",
+		},
+		{
+			name: "longer prefix wins",
+			routes: []*Route{
+				{Name: "short", Prefix: "/api"},
+				{Name: "long", Prefix: "/api/v2"},
+			},
+			target: "/api/v2/users",
+			want:   "long",
+		},
+		{
+			name: "catch-all template",
+			routes: []*Route{
+				{Name: "prefix", Prefix: "/files"},
+				{Name: "files", PathTemplate: "/files/{rest...}"},
+			},
+			target: "/files/a/b.txt",
+			want:   "files",
+			params: map[string]string{"rest": "a/b.txt"},
+		},
+		{
+			name: "priority overrides specificity",
+			routes: []*Route{
+				{Name: "exact", Path: "/users/me"},
+				{Name: "prefix", Prefix: "/", Priority: 1},
+			},
+			target: "/users/me",
+			want:   "prefix",
+		},
+		{
+			name: "first registered breaks ties",
+			routes: []*Route{
+				{Name: "first", Prefix: "/api"},
+				{Name: "second", Prefix: "/api"},
+			},
+			target: "/api",
+			want:   "first",
+		},
+		{
+			name: "no match",
+			routes: []*Route{
+				{Name: "users", PathTemplate: "/users/{id}"},
+			},
+			target: "/users/1/posts",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := NewRouter()
+			for _, r := range tt.routes {
+				router.Register(r)
+			}
+
+			req := httptest.NewRequest(cmp.Or(tt.method, http.MethodGet), tt.target, nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+
+			got, err := router.Resolve(req)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("resolved to %q, want no match", got.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Name != tt.want {
+				t.Fatalf("resolved to %q, want %q", got.Name, tt.want)
+			}
+
+			i, params, _ := best(router.routes, &router.index, req)
+			if router.routes[i].Route != got {
+				t.Fatalf("best disagrees with Resolve")
+			}
+			if !maps.Equal(params, tt.params) {
+				t.Fatalf("params = %v, want %v", params, tt.params)
+			}
+		})
+	}
+}
+
+func TestRadixCollect(t *testing.T) {
+	keys := []string{"", "/api", "/api/v1", "/api/v2", "/apix", "/static/"}
+
+	var index radixNode
+	for i, k := range keys {
+		index.insert(k, i)
+	}
+
+	tests := []struct {
+		path string
+		want []int
+	}{
+		{"/", []int{0}},
+		{"/ap", []int{0}},
+		{"/api", []int{0, 1}},
+		{"/api/v1/users", []int{0, 1, 2}},
+		{"/api/v2", []int{0, 1, 3}},
+		{"/api/v3", []int{0, 1}},
+		{"/apix/y", []int{0, 1, 4}},
+		{"/static", []int{0}},
+		{"/static/app.js", []int{0, 5}},
+	}
+
+	for _, tt := range tests {
+		var got []int
+		index.collect(tt.path, func(i int) { got = append(got, i) })
+		slices.Sort(got)
+
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("collect(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
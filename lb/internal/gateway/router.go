@@ -2,30 +2,32 @@ package gateway
 
 import (
 	"errors"
+	"net/http"
 )
 
 var ErrRouteNotFound = errors.New("route not found")
 
 type Router struct {
-	routes []*Route
+	routes []*compiledRoute
+	index  radixNode
 }
 
 func NewRouter() *Router {
 	return &Router{
-		routes: make([]*Route, 0),
+		routes: make([]*compiledRoute, 0),
 	}
 }
 
 func (r *Router) Register(route *Route) {
-	r.routes = append(r.routes, route)
+	r.index.insert(route.indexKey(), len(r.routes))
+	r.routes = append(r.routes, &compiledRoute{Route: route, segments: route.segments()})
 }
 
-func (r *Router) Resolve(path string) (*Route, error) {
-	for _, route := range r.routes {
-		if route.Match(path) {
-			return route, nil
-		}
+func (r *Router) Resolve(req *http.Request) (*Route, error) {
+	i, _, ok := best(r.routes, &r.index, req)
+	if !ok {
+		return nil, ErrRouteNotFound
 	}
 
-	return nil, ErrRouteNotFound
+	return r.routes[i].Route, nil
 }
@@ -0,0 +1,275 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"go_loadbalancer/lb/internal/registry"
+	"go_loadbalancer/lb/internal/strategy"
+)
+
+var ErrUnknownVariant = errors.New("unknown variant")
+
+// Variant is one pool a split route sends traffic to.
+type Variant struct {
+	Name     string
+	Registry *registry.BackendRegistry
+	Strategy strategy.Strategy
+
+	stats variantStats
+}
+
+// TrafficSplit divides a route's traffic between variants by weight, e.g.
+// 95 to "stable" and 5 to "canary". Weights are relative and can be changed
+// while traffic flows.
+type TrafficSplit struct {
+	Variants []*Variant
+
+	// OverrideHeader and OverrideCookie name a variant explicitly, pinning
+	// the request to it regardless of weights.
+	OverrideHeader string
+	OverrideCookie string
+	// HashHeader and HashCookie identify the user; requests with the same
+	// value land on the same variant while the weights stay the same.
+	// Requests without one are assigned at random.
+	HashHeader string
+	HashCookie string
+
+	mu      sync.RWMutex
+	weights map[string]int
+	shift   context.CancelFunc
+}
+
+func NewTrafficSplit(variants []*Variant, weights map[string]int) (*TrafficSplit, error) {
+	ts := &TrafficSplit{Variants: variants}
+
+	if err := ts.SetWeights(weights); err != nil {
+		return nil, err
+	}
+
+	return ts, nil
+}
+
+func (ts *TrafficSplit) Variant(name string) *Variant {
+	for _, v := range ts.Variants {
+		if v.Name == name {
+			return v
+		}
+	}
+
+	return nil
+}
+
+func (ts *TrafficSplit) Weights() map[string]int {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	out := make(map[string]int, len(ts.weights))
+	for k, v := range ts.weights {
+		out[k] = v
+	}
+
+	return out
+}
+
+// SetWeights replaces the weights and stops any gradual shift in progress.
+// Variants missing from weights get none.
+func (ts *TrafficSplit) SetWeights(weights map[string]int) error {
+	if err := ts.validate(weights); err != nil {
+		return err
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.stopShift()
+	ts.weights = copyWeights(weights)
+
+	return nil
+}
+
+// Stop cancels any gradual shift in progress and leaves the weights where
+// they are. The gateway calls it when SetRoutes drops the split.
+func (ts *TrafficSplit) Stop() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.stopShift()
+}
+
+func (ts *TrafficSplit) stopShift() {
+	if ts.shift != nil {
+		ts.shift()
+		ts.shift = nil
+	}
+}
+
+func (ts *TrafficSplit) validate(weights map[string]int) error {
+	total := 0
+	for name, w := range weights {
+		if ts.Variant(name) == nil {
+			return fmt.Errorf("%w %q", ErrUnknownVariant, name)
+		}
+		if w < 0 {
+			return fmt.Errorf("negative weight for %q", name)
+		}
+		total += w
+	}
+
+	if total == 0 {
+		return errors.New("weights must not all be zero")
+	}
+
+	return nil
+}
+
+func copyWeights(weights map[string]int) map[string]int {
+	out := make(map[string]int, len(weights))
+	for k, v := range weights {
+		out[k] = v
+	}
+
+	return out
+}
+
+// ShiftTo moves the weights towards target by at most step per variant
+// every interval, until they match or ctx is done. It replaces any shift in
+// progress; SetWeights and Stop cancel it.
+func (ts *TrafficSplit) ShiftTo(ctx context.Context, target map[string]int, step int, interval time.Duration) error {
+	if err := ts.validate(target); err != nil {
+		return err
+	}
+	if step <= 0 || interval <= 0 {
+		return errors.New("step and interval must be positive")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	ts.mu.Lock()
+	ts.stopShift()
+	ts.shift = cancel
+	ts.mu.Unlock()
+
+	go func() {
+		defer cancel()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			ts.mu.Lock()
+			if ctx.Err() != nil {
+				ts.mu.Unlock()
+				return
+			}
+
+			next, done := stepWeights(ts.weights, target, step)
+			ts.weights = next
+			if done {
+				ts.shift = nil
+			}
+			ts.mu.Unlock()
+
+			if done {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func stepWeights(current, target map[string]int, step int) (map[string]int, bool) {
+	next := copyWeights(current)
+	done := true
+
+	names := make(map[string]struct{})
+	for k := range current {
+		names[k] = struct{}{}
+	}
+	for k := range target {
+		names[k] = struct{}{}
+	}
+
+	for name := range names {
+		cur, want := current[name], target[name]
+		switch {
+		case want > cur:
+			next[name] = min(cur+step, want)
+		case want < cur:
+			next[name] = max(cur-step, want)
+		}
+
+		if next[name] != want {
+			done = false
+		}
+	}
+
+	return next, done
+}
+
+// Pick chooses the variant for r.
+func (ts *TrafficSplit) Pick(r *http.Request) *Variant {
+	if name := ts.requestValue(r, ts.OverrideHeader, ts.OverrideCookie); name != "" {
+		if v := ts.Variant(name); v != nil {
+			return v
+		}
+	}
+
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	total := 0
+	for _, v := range ts.Variants {
+		total += ts.weights[v.Name]
+	}
+	if total == 0 {
+		return nil
+	}
+
+	var n int
+	if key := ts.requestValue(r, ts.HashHeader, ts.HashCookie); key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		n = int(h.Sum32() % uint32(total))
+	} else {
+		n = rand.IntN(total)
+	}
+
+	for _, v := range ts.Variants {
+		n -= ts.weights[v.Name]
+		if n < 0 {
+			return v
+		}
+	}
+
+	return nil
+}
+
+func (ts *TrafficSplit) requestValue(r *http.Request, header, cookie string) string {
+	if header != "" {
+		if v := r.Header.Get(header); v != "" {
+			return v
+		}
+	}
+
+	if cookie != "" {
+		if c, err := r.Cookie(cookie); err == nil {
+			return c.Value
+		}
+	}
+
+	return ""
+}
@@ -1,34 +1,43 @@
 package handler
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"time"
 
+	"go_loadbalancer/lb/internal/circuitbreaker"
 	"go_loadbalancer/lb/internal/queue"
 	"go_loadbalancer/lb/internal/ratelimit"
 	"go_loadbalancer/lb/internal/registry"
 	"go_loadbalancer/lb/internal/retry"
 	"go_loadbalancer/lb/internal/strategy"
+	"go_loadbalancer/lb/internal/tunnel"
 )
 
 type LBHandler struct {
 	Registry      *registry.BackendRegistry
 	Strategy      strategy.Strategy
-	MaxRetries    int
+	Policy        retry.RetryPolicy
+	Hedge         *retry.HedgePolicy
 	GlobalLimiter *ratelimit.TokenBucket
 	Queue         *queue.RequestQueue
+	Tunnels       *tunnel.Manager
+	Mirror        *Mirror
 }
 
 func NewHandler(r *registry.BackendRegistry, s strategy.Strategy, maxRetries int, q *queue.RequestQueue) *LBHandler {
+	policy := retry.DefaultPolicy()
+	policy.MaxAttempts = maxRetries
+
 	h := &LBHandler{
-		Registry:   r,
-		Strategy:   s,
-		MaxRetries: maxRetries,
-		Queue:      q,
+		Registry: r,
+		Strategy: s,
+		Policy:   policy,
+		Queue:    q,
+		Tunnels:  tunnel.NewManager(DefaultUpgradeIdleTimeout),
 	}
 
 	return h
@@ -47,6 +56,13 @@ func (h *LBHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// An upgraded connection can live for hours; it must not hold one of
+	// the queue's workers for that long.
+	if isUpgrade(req) {
+		h.ServeBackend(w, req)
+		return
+	}
+
 	if !h.Queue.Enqueue(reqWrap) {
 		http.Error(w, "Server busy. Too many requests.", http.StatusServiceUnavailable)
 		return
@@ -56,86 +72,226 @@ func (h *LBHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 }
 
-func (h *LBHandler) processRequest(w http.ResponseWriter, req *http.Request) {
-	var bodyBuf []byte
-	if req.Body != nil {
-		if b, err := io.ReadAll(req.Body); err == nil {
-			bodyBuf = b
+func (h *LBHandler) processRequest(w http.ResponseWriter, req *http.Request, reg *registry.BackendRegistry, strat strategy.Strategy) error {
+	var permit circuitbreaker.Permit
+	if reg.CB != nil {
+		var ok bool
+		if permit, ok = reg.CB.Allow(); !ok {
+			return circuitbreaker.ErrOpen
+		}
+	}
+
+	start := time.Now()
+
+	if isUpgrade(req) {
+		// A tunnel can outlive the request by hours, so the pool is judged
+		// on the handshake alone, which is over once the connection is
+		// hijacked.
+		hw := &hijackWriter{ResponseWriter: w, onHijack: func() {
+			permit.Record(true, time.Since(start))
+		}}
+		status := h.forward(hw, req, reg, strat)
+		if !hw.hijacked {
+			permit.Record(status < 500, time.Since(start))
+		}
+		return nil
+	}
+
+	status := h.forward(w, req, reg, strat)
+	permit.Record(status < 500, time.Since(start))
+
+	return nil
+}
+
+func (h *LBHandler) forward(w http.ResponseWriter, req *http.Request, reg *registry.BackendRegistry, strat strategy.Strategy) int {
+	if isUpgrade(req) {
+		return h.forwardUpgrade(w, req, reg, strat)
+	}
+
+	body, err := retry.BufferBody(req, h.Policy.Body)
+	if err != nil {
+		log.Printf("failed to read request body: %v", err)
+		return retry.WriteBodyError(w, err)
+	}
+	defer body.Close()
+
+	if h.Mirror != nil {
+		if call := h.Mirror.start(req, body); call != nil {
+			w = call.capture(w)
+			defer call.finish()
 		}
-		req.Body = io.NopCloser(bytes.NewReader(bodyBuf))
+	}
+
+	if reg.RetryBudget != nil {
+		reg.RetryBudget.Deposit()
+	}
+
+	req, cancel := retry.WithGRPCDeadline(req)
+	defer cancel()
+
+	if h.Hedge != nil && h.Hedge.Enabled() && body.Replayable() && h.Policy.CanRetry(req) {
+		return h.forwardHedged(w, req, body, reg, strat)
+	}
+
+	maxAttempts := h.Policy.MaxAttempts
+	if !body.Replayable() {
+		maxAttempts = 1
 	}
 
 	var lastErr error
 
-	for attempt := 0; attempt < h.MaxRetries; attempt++ {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
 
-		alive := h.Registry.AliveBackends()
+		alive := reg.AliveBackends()
 		if len(alive) == 0 {
 			http.Error(w, "no backend available", http.StatusServiceUnavailable)
-			return
+			return http.StatusServiceUnavailable
 		}
 
-		backend := h.Strategy.Next(alive)
+		backend := strat.Next(alive)
 		if backend == nil {
 			http.Error(w, "no backend selected", http.StatusServiceUnavailable)
-			return
+			return http.StatusServiceUnavailable
 		}
 
-		if backend.CB != nil {
-			if ok := backend.CB.BeforeRequest(); !ok {
-				log.Printf("circuit OPEN for %s → skipping", backend.URL)
-				continue
-			}
+		permit, ok := backend.Allow()
+		if !ok {
+			log.Printf("circuit OPEN for %s → skipping", backend.URL)
+			strategy.Done(strat, backend)
+			continue
 		}
 
-		if bodyBuf != nil {
-			req.Body = io.NopCloser(bytes.NewReader(bodyBuf))
-		}
+		req.Body = body.Reader()
+		retry.SetGRPCRemaining(req)
 
-		rec := retry.NewResponseRecorder()
-		backend.Proxy.ServeHTTP(rec, req)
+		sw := retry.NewStreamWriter(w, h.Policy.MaxResponseBuffer, func(rec *retry.ResponseRecorder) bool {
+			return h.Policy.ShouldRetry(req, rec)
+		})
 
-		if rec.Status < 500 {
-			backend.RecordSuccess()
+		start := time.Now()
+		backend.Proxy.ServeHTTP(sw, req)
+		latency := time.Since(start)
+		strategy.Done(strat, backend)
 
-			for k, vv := range rec.HeaderMap {
-				for _, v := range vv {
-					w.Header().Add(k, v)
-				}
-			}
+		rec := sw.Recorder()
+		if !sw.Committed() && errors.Is(rec.Err, retry.ErrBodyTooLarge) {
+			// The client's body broke the limit; the backend is not to blame.
+			permit.Release()
+			return retry.WriteBodyError(w, rec.Err)
+		}
 
-			w.WriteHeader(rec.Status)
+		failed := retry.IsFailure(rec, sw.FinalHeader())
 
-			if rec.Body != nil {
-				_, _ = io.Copy(w, rec.Body)
+		if sw.Committed() || !h.Policy.ShouldRetry(req, rec) {
+			if failed {
+				backend.RecordFailure(permit, latency)
+			} else {
+				backend.RecordSuccess(permit, latency)
+				if reg.Latency != nil {
+					reg.Latency.Observe(latency)
+				}
 			}
 
+			sw.Commit()
+
 			log.Printf(
-				"backend SUCCESS: %s status=%d attempt=%d",
+				"backend RESPONSE: %s status=%d attempt=%d",
 				backend.URL, rec.Status, attempt+1,
 			)
 
-			return
+			return rec.Status
 		}
 
 		lastErr = fmt.Errorf("backend %s returned %d", backend.URL, rec.Status)
-		backend.RecordFailure()
+		if rec.Err != nil {
+			lastErr = fmt.Errorf("backend %s: %w", backend.URL, rec.Err)
+		}
+		backend.RecordFailure(permit, latency)
 
 		log.Printf(
 			"backend FAILURE: %s status=%d attempt=%d",
 			backend.URL, rec.Status, attempt+1,
 		)
 
-		time.Sleep(time.Duration(attempt+1) * 100 * time.Millisecond)
+		if attempt+1 == maxAttempts {
+			break
+		}
+
+		if reg.RetryBudget != nil && !reg.RetryBudget.TryWithdraw() {
+			log.Printf("retry budget exhausted, returning %d from %s", rec.Status, backend.URL)
+			sw.Commit()
+			return rec.Status
+		}
+
+		backoff, ok := h.Policy.Backoff(attempt+1, rec)
+		if !ok || !retry.FitsDeadline(req, backoff) {
+			log.Printf("no time left to retry %s, returning %d", backend.URL, rec.Status)
+			sw.Commit()
+			return rec.Status
+		}
+
+		time.Sleep(backoff)
 	}
 
 	if lastErr == nil {
 		lastErr = fmt.Errorf("all backend failed")
 	}
 
+	if retry.IsGRPC(req) {
+		code := retry.GRPCUnavailable
+		if errors.Is(req.Context().Err(), context.DeadlineExceeded) {
+			code = retry.GRPCDeadlineExceeded
+		}
+
+		retry.WriteGRPCError(w, code, lastErr.Error())
+		return http.StatusBadGateway
+	}
+
 	http.Error(w, lastErr.Error(), http.StatusBadGateway)
+	return http.StatusBadGateway
+}
+
+func (h *LBHandler) forwardHedged(w http.ResponseWriter, req *http.Request, body *retry.Body, reg *registry.BackendRegistry, strat strategy.Strategy) int {
+	rec, err := retry.Hedge(w, req, body, reg, strat, h.Policy, *h.Hedge)
+	if rec == nil {
+		http.Error(w, "no backend available", http.StatusServiceUnavailable)
+		return http.StatusServiceUnavailable
+	}
+
+	if err != nil {
+		log.Printf("hedged request failed: %v", err)
+	}
+
+	return rec.Status
+}
+
+// Shutdown drains upgraded connections, closing whatever is still open
+// when ctx is done.
+func (h *LBHandler) Shutdown(ctx context.Context) error {
+	return h.Tunnels.Drain(ctx)
 }
 
 func (h *LBHandler) ServeBackend(w http.ResponseWriter, r *http.Request) {
-	h.processRequest(w, r)
+	if err := h.processRequest(w, r, h.Registry, h.Strategy); err != nil {
+		http.Error(w, "pool circuit open", http.StatusServiceUnavailable)
+	}
+}
+
+// Serve proxies r through the handler's own pool and limiter without going
+// through the queue, so several handlers can serve as independent pipelines.
+// It returns circuitbreaker.ErrOpen without writing a response when the
+// pool's breaker rejects the request.
+func (h *LBHandler) Serve(w http.ResponseWriter, r *http.Request) error {
+	if h.GlobalLimiter != nil && !h.GlobalLimiter.Allow() {
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return nil
+	}
+
+	return h.processRequest(w, r, h.Registry, h.Strategy)
+}
+
+// ServePool proxies r to the given pool. It returns circuitbreaker.ErrOpen
+// without writing a response when the pool's breaker rejects the request.
+func (h *LBHandler) ServePool(w http.ResponseWriter, r *http.Request, reg *registry.BackendRegistry, strat strategy.Strategy) error {
+	return h.processRequest(w, r, reg, strat)
 }
@@ -0,0 +1,365 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"go_loadbalancer/lb/internal/backend"
+	"go_loadbalancer/lb/internal/registry"
+	"go_loadbalancer/lb/internal/retry"
+	"go_loadbalancer/lb/internal/strategy"
+)
+
+const (
+	DefaultMirrorTimeout     = 10 * time.Second
+	DefaultMirrorMaxInFlight = 100
+	DefaultMirrorDiffBytes   = 64 << 10
+)
+
+// Mirror copies a share of a pipeline's requests to a shadow pool. Shadow
+// requests run in the background, never delay or change the client's
+// response, and are dropped rather than queued when the shadow pool falls
+// behind.
+type Mirror struct {
+	Registry *registry.BackendRegistry
+	Strategy strategy.Strategy
+
+	// Percent of requests mirrored, from 0 to 100.
+	Percent float64
+	// Methods lists the request methods mirrored. Empty means GET, HEAD and
+	// OPTIONS: the shadow sees the same writes as production otherwise, so
+	// unsafe methods must be listed explicitly.
+	Methods []string
+	Timeout time.Duration
+	// MaxInFlight caps concurrent shadow requests.
+	MaxInFlight int
+	// MaxBodyBytes is the largest request body mirrored; zero means
+	// retry.DefaultBodyMemoryBytes.
+	MaxBodyBytes int64
+
+	// Diff compares each shadow response's status and body with the
+	// primary's. Bodies are compared up to MaxDiffBytes.
+	Diff         bool
+	MaxDiffBytes int64
+	// OnMismatch receives every difference found; nil logs it.
+	OnMismatch func(MirrorMismatch)
+
+	once  sync.Once
+	slots chan struct{}
+}
+
+// MirrorMismatch describes a shadow response that differs from the primary.
+type MirrorMismatch struct {
+	Method, URL  string
+	Status       int
+	ShadowStatus int
+	BodyDiffers  bool
+	ShadowErr    error
+}
+
+type mirrorResponse struct {
+	status    int
+	body      bytes.Buffer
+	limit     int64
+	truncated bool
+	err       error
+}
+
+func (mr *mirrorResponse) write(p []byte) {
+	if mr.limit <= 0 {
+		return
+	}
+
+	if room := mr.limit - int64(mr.body.Len()); int64(len(p)) > room {
+		p = p[:room]
+		mr.truncated = true
+	}
+	mr.body.Write(p)
+}
+
+func (mr *mirrorResponse) differs(other *mirrorResponse) bool {
+	a, b := mr.body.Bytes(), other.body.Bytes()
+	if mr.truncated || other.truncated {
+		// Only the captured prefixes can be compared.
+		n := min(len(a), len(b))
+		a, b = a[:n], b[:n]
+	}
+
+	return !bytes.Equal(a, b)
+}
+
+// mirrorCall is one shadow request in flight.
+type mirrorCall struct {
+	m       *Mirror
+	primary *mirrorResponse
+	done    chan struct{}
+}
+
+var safeMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+
+var errShadowAborted = errors.New("shadow response aborted")
+
+// start sends req to the shadow pool if its method is allowed, it is
+// sampled, its body is small enough and a slot is free. It returns nil
+// otherwise.
+func (m *Mirror) start(req *http.Request, body *retry.Body) *mirrorCall {
+	methods := m.Methods
+	if len(methods) == 0 {
+		methods = safeMethods
+	}
+	if !slices.Contains(methods, req.Method) {
+		return nil
+	}
+
+	if m.Percent <= 0 || rand.Float64()*100 >= m.Percent {
+		return nil
+	}
+
+	maxBody := m.MaxBodyBytes
+	if maxBody <= 0 {
+		maxBody = retry.DefaultBodyMemoryBytes
+	}
+	if !body.Replayable() || body.Size() > maxBody {
+		return nil
+	}
+
+	m.once.Do(func() {
+		n := m.MaxInFlight
+		if n <= 0 {
+			n = DefaultMirrorMaxInFlight
+		}
+		m.slots = make(chan struct{}, n)
+	})
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		return nil
+	}
+
+	// The primary closes its body when it is done, so the shadow gets its
+	// own copy.
+	data, err := io.ReadAll(body.Reader())
+	if err != nil {
+		<-m.slots
+		return nil
+	}
+
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = DefaultMirrorTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), timeout)
+
+	out := req.Clone(ctx)
+	out.Body = io.NopCloser(bytes.NewReader(data))
+	out.ContentLength = int64(len(data))
+
+	c := &mirrorCall{m: m, done: make(chan struct{})}
+	if m.Diff {
+		c.primary = &mirrorResponse{limit: m.diffBytes()}
+	}
+
+	go func() {
+		defer func() { <-m.slots }()
+		defer cancel()
+
+		shadow := m.send(out)
+
+		if c.primary == nil {
+			return
+		}
+
+		<-c.done
+		c.compare(out, shadow)
+	}()
+
+	return c
+}
+
+func (m *Mirror) diffBytes() int64 {
+	if m.MaxDiffBytes > 0 {
+		return m.MaxDiffBytes
+	}
+	return DefaultMirrorDiffBytes
+}
+
+func (m *Mirror) send(req *http.Request) *mirrorResponse {
+	res := &mirrorResponse{}
+	if m.Diff {
+		res.limit = m.diffBytes()
+	}
+
+	alive := m.Registry.AliveBackends()
+	if len(alive) == 0 {
+		res.status = http.StatusServiceUnavailable
+		return res
+	}
+
+	target := m.Strategy.Next(alive)
+	if target == nil {
+		res.status = http.StatusServiceUnavailable
+		return res
+	}
+	defer strategy.Done(m.Strategy, target)
+
+	permit, ok := target.Allow()
+	if !ok {
+		res.status = http.StatusServiceUnavailable
+		return res
+	}
+
+	sw := &shadowWriter{header: make(http.Header), res: res}
+
+	start := time.Now()
+	if proxy(target, sw, req) && res.err == nil {
+		res.err = errShadowAborted
+	}
+	latency := time.Since(start)
+
+	if res.status == 0 {
+		res.status = http.StatusOK
+	}
+
+	if res.err != nil || res.status >= 500 {
+		target.RecordFailure(permit, latency)
+	} else {
+		target.RecordSuccess(permit, latency)
+	}
+
+	return res
+}
+
+// proxy forwards req to target and reports whether the proxy aborted with
+// http.ErrAbortHandler, which it does when the shadow response cannot be
+// copied, such as when Timeout expires mid-body. Outside the server's own
+// goroutine that panic would take the process down.
+func proxy(target *backend.Backend, w http.ResponseWriter, req *http.Request) (aborted bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r != http.ErrAbortHandler {
+				panic(r)
+			}
+			aborted = true
+		}
+	}()
+
+	target.Proxy.ServeHTTP(w, req)
+	return false
+}
+
+// capture wraps the client's writer so the primary response can be diffed.
+func (c *mirrorCall) capture(w http.ResponseWriter) http.ResponseWriter {
+	if c.primary == nil {
+		return w
+	}
+
+	return &mirrorWriter{ResponseWriter: w, res: c.primary}
+}
+
+// finish marks the primary response complete.
+func (c *mirrorCall) finish() {
+	close(c.done)
+}
+
+func (c *mirrorCall) compare(req *http.Request, shadow *mirrorResponse) {
+	primary := c.primary
+	if primary.status == 0 {
+		primary.status = http.StatusOK
+	}
+
+	mm := MirrorMismatch{
+		Method:       req.Method,
+		URL:          req.URL.String(),
+		Status:       primary.status,
+		ShadowStatus: shadow.status,
+		ShadowErr:    shadow.err,
+	}
+
+	if mm.Status == mm.ShadowStatus && shadow.err == nil {
+		if !primary.differs(shadow) {
+			return
+		}
+		mm.BodyDiffers = true
+	}
+
+	if c.m.OnMismatch != nil {
+		c.m.OnMismatch(mm)
+		return
+	}
+
+	switch {
+	case mm.ShadowErr != nil:
+		log.Printf("mirror mismatch %s %s: shadow failed: %v", mm.Method, mm.URL, mm.ShadowErr)
+	case mm.BodyDiffers:
+		log.Printf("mirror mismatch %s %s: body differs", mm.Method, mm.URL)
+	default:
+		log.Printf("mirror mismatch %s %s: status %d, shadow %d", mm.Method, mm.URL, mm.Status, mm.ShadowStatus)
+	}
+}
+
+// mirrorWriter tees the primary response into a mirrorResponse.
+type mirrorWriter struct {
+	http.ResponseWriter
+	res *mirrorResponse
+}
+
+func (mw *mirrorWriter) WriteHeader(status int) {
+	if mw.res.status == 0 {
+		mw.res.status = status
+	}
+	mw.ResponseWriter.WriteHeader(status)
+}
+
+func (mw *mirrorWriter) Write(p []byte) (int, error) {
+	if mw.res.status == 0 {
+		mw.res.status = http.StatusOK
+	}
+	mw.res.write(p)
+	return mw.ResponseWriter.Write(p)
+}
+
+func (mw *mirrorWriter) Flush() {
+	_ = http.NewResponseController(mw.ResponseWriter).Flush()
+}
+
+func (mw *mirrorWriter) Unwrap() http.ResponseWriter {
+	return mw.ResponseWriter
+}
+
+// shadowWriter discards the shadow response, keeping only what the diff
+// needs.
+type shadowWriter struct {
+	header http.Header
+	res    *mirrorResponse
+}
+
+func (sw *shadowWriter) Header() http.Header {
+	return sw.header
+}
+
+func (sw *shadowWriter) WriteHeader(status int) {
+	if sw.res.status == 0 {
+		sw.res.status = status
+	}
+}
+
+func (sw *shadowWriter) Write(p []byte) (int, error) {
+	if sw.res.status == 0 {
+		sw.res.status = http.StatusOK
+	}
+	sw.res.write(p)
+	return len(p), nil
+}
+
+func (sw *shadowWriter) SetProxyError(err error) {
+	sw.res.err = err
+}
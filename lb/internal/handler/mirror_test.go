@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go_loadbalancer/lb/internal/backend"
+	"go_loadbalancer/lb/internal/registry"
+	"go_loadbalancer/lb/internal/retry"
+	"go_loadbalancer/lb/internal/strategy/roundrobin"
+)
+
+func testPool(t *testing.T, h http.HandlerFunc) *registry.BackendRegistry {
+	t.Helper()
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	b, err := backend.CreateNewBackend(srv.URL, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := registry.NewRegistry()
+	reg.Add(b)
+
+	return reg
+}
+
+// startMirror offers a request to m and reports whether it was mirrored.
+func startMirror(t *testing.T, m *Mirror, method string) bool {
+	t.Helper()
+
+	req := httptest.NewRequest(method, "/", strings.NewReader("body"))
+	body, err := retry.BufferBody(req, retry.BodyLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+
+	call := m.start(req, body)
+	if call == nil {
+		return false
+	}
+	call.finish()
+
+	return true
+}
+
+func TestMirrorMethods(t *testing.T) {
+	shadow := testPool(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		methods []string
+		method  string
+		want    bool
+	}{
+		{nil, http.MethodGet, true},
+		{nil, http.MethodHead, true},
+		{nil, http.MethodOptions, true},
+		{nil, http.MethodPost, false},
+		{nil, http.MethodDelete, false},
+		{[]string{http.MethodPost}, http.MethodPost, true},
+		{[]string{http.MethodPost}, http.MethodGet, false},
+	}
+
+	for _, tt := range tests {
+		m := &Mirror{Registry: shadow, Strategy: roundrobin.New(), Percent: 100, Methods: tt.methods}
+		if got := startMirror(t, m, tt.method); got != tt.want {
+			t.Errorf("Methods %v, %s: mirrored = %v, want %v", tt.methods, tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestMirrorSampling(t *testing.T) {
+	shadow := testPool(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, tt := range []struct {
+		percent  float64
+		min, max int
+	}{
+		{0, 0, 0},
+		{25, 50, 150},
+		{100, 400, 400},
+	} {
+		m := &Mirror{Registry: shadow, Strategy: roundrobin.New(), Percent: tt.percent, MaxInFlight: 1000}
+
+		n := 0
+		for range 400 {
+			if startMirror(t, m, http.MethodGet) {
+				n++
+			}
+		}
+
+		if n < tt.min || n > tt.max {
+			t.Errorf("Percent %v mirrored %d of 400, want %d to %d", tt.percent, n, tt.min, tt.max)
+		}
+	}
+}
+
+func TestMirrorInFlightCap(t *testing.T) {
+	release := make(chan struct{})
+	shadow := testPool(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+
+	m := &Mirror{Registry: shadow, Strategy: roundrobin.New(), Percent: 100, MaxInFlight: 2}
+
+	for i := range 2 {
+		if !startMirror(t, m, http.MethodGet) {
+			t.Fatalf("request %d dropped under the cap", i)
+		}
+	}
+	if startMirror(t, m, http.MethodGet) {
+		t.Fatal("request over the cap mirrored")
+	}
+
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !startMirror(t, m, http.MethodGet) {
+		if time.Now().After(deadline) {
+			t.Fatal("slots never freed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMirrorDiff(t *testing.T) {
+	primary := testPool(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "v1")
+	})
+	shadow := testPool(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/status":
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, "v1")
+		case "/body":
+			io.WriteString(w, "v2")
+		default:
+			io.WriteString(w, "v1")
+		}
+	})
+
+	// The proxy aborts when it cannot copy a response, which it only
+	// reports as a suppressed panic under test; raise a real one.
+	shadow.AliveBackends()[0].Proxy.ModifyResponse = func(resp *http.Response) error {
+		if resp.Request.URL.Path == "/abort" {
+			panic(http.ErrAbortHandler)
+		}
+		return nil
+	}
+
+	mismatches := make(chan MirrorMismatch, 10)
+
+	h := NewHandler(primary, roundrobin.New(), 1, nil)
+	h.Mirror = &Mirror{
+		Registry:   shadow,
+		Strategy:   roundrobin.New(),
+		Percent:    100,
+		Diff:       true,
+		OnMismatch: func(mm MirrorMismatch) { mismatches <- mm },
+	}
+
+	check := func(path string, want func(MirrorMismatch) bool) {
+		t.Helper()
+
+		// An identical response first: had it been reported, it would
+		// arrive before the expected mismatch.
+		h.ServeBackend(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/same", nil))
+		h.ServeBackend(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+
+		select {
+		case mm := <-mismatches:
+			if !strings.HasSuffix(mm.URL, path) || !want(mm) {
+				t.Fatalf("%s: got %+v", path, mm)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: no mismatch reported", path)
+		}
+	}
+
+	check("/status", func(mm MirrorMismatch) bool {
+		return mm.Status == http.StatusOK && mm.ShadowStatus == http.StatusInternalServerError
+	})
+	check("/body", func(mm MirrorMismatch) bool {
+		return mm.BodyDiffers && mm.ShadowStatus == http.StatusOK
+	})
+	check("/abort", func(mm MirrorMismatch) bool {
+		return mm.ShadowErr != nil
+	})
+}
@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go_loadbalancer/lb/internal/forwarded"
+	"go_loadbalancer/lb/internal/proxyproto"
+	"go_loadbalancer/lb/internal/registry"
+	"go_loadbalancer/lb/internal/strategy"
+	"go_loadbalancer/lb/internal/tunnel"
+)
+
+const (
+	DefaultUpgradeIdleTimeout = 5 * time.Minute
+	upgradeHandshakeTimeout   = 10 * time.Second
+)
+
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+
+	for _, v := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// forwardUpgrade proxies a connection upgrade such as a WebSocket handshake.
+// Once the backend switches protocols, the client connection is hijacked and
+// spliced to the backend until either side closes or the tunnel goes idle.
+// The backend stays counted by strat for the lifetime of the tunnel.
+func (h *LBHandler) forwardUpgrade(w http.ResponseWriter, req *http.Request, reg *registry.BackendRegistry, strat strategy.Strategy) int {
+	if h.Tunnels.Draining() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return http.StatusServiceUnavailable
+	}
+
+	alive := reg.AliveBackends()
+	if len(alive) == 0 {
+		http.Error(w, "no backend available", http.StatusServiceUnavailable)
+		return http.StatusServiceUnavailable
+	}
+
+	backend := strat.Next(alive)
+	if backend == nil {
+		http.Error(w, "no backend selected", http.StatusServiceUnavailable)
+		return http.StatusServiceUnavailable
+	}
+	defer strategy.Done(strat, backend)
+
+	permit, ok := backend.Allow()
+	if !ok {
+		http.Error(w, "backend circuit open", http.StatusServiceUnavailable)
+		return http.StatusServiceUnavailable
+	}
+
+	start := time.Now()
+
+	conn, err := backend.Dial(proxyproto.WithRequestAddrs(req.Context(), req))
+	if err != nil {
+		log.Printf("upgrade dial %s failed: %v", backend.URL, err)
+		backend.RecordFailure(permit, time.Since(start))
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return http.StatusBadGateway
+	}
+
+	outreq := req.Clone(req.Context())
+	backend.Proxy.Director(outreq)
+	// ReverseProxy adds the client to X-Forwarded-For after the director
+	// runs; this request bypasses it.
+	forwarded.AppendFor(outreq)
+	outreq.Body = http.NoBody
+	outreq.ContentLength = 0
+
+	conn.SetDeadline(time.Now().Add(upgradeHandshakeTimeout))
+
+	br := bufio.NewReader(conn)
+	resp, err := writeAndReadUpgrade(conn, br, outreq)
+	conn.SetDeadline(time.Time{})
+
+	if err != nil {
+		conn.Close()
+		log.Printf("upgrade handshake with %s failed: %v", backend.URL, err)
+		backend.RecordFailure(permit, time.Since(start))
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return http.StatusBadGateway
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer conn.Close()
+		defer resp.Body.Close()
+
+		if resp.StatusCode >= 500 {
+			backend.RecordFailure(permit, time.Since(start))
+		} else {
+			backend.RecordSuccess(permit, time.Since(start))
+		}
+
+		for k, vv := range resp.Header {
+			for _, v := range vv {
+				w.Header().Add(k, v)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+
+		return resp.StatusCode
+	}
+
+	backend.RecordSuccess(permit, time.Since(start))
+
+	clientConn, clientBuf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		conn.Close()
+		log.Printf("upgrade hijack failed: %v", err)
+		http.Error(w, "upgrade not supported", http.StatusInternalServerError)
+		return http.StatusInternalServerError
+	}
+
+	if err := resp.Write(clientBuf); err == nil {
+		err = clientBuf.Flush()
+	}
+
+	if err != nil {
+		conn.Close()
+		clientConn.Close()
+		return http.StatusSwitchingProtocols
+	}
+
+	log.Printf("upgrade to %q tunnelled to %s", resp.Header.Get("Upgrade"), backend.URL)
+
+	if err := h.Tunnels.Splice(tunnel.WithReader(clientConn, clientBuf.Reader), tunnel.WithReader(conn, br)); err != nil {
+		log.Printf("upgraded connection to %s closed: %v", backend.URL, err)
+	}
+
+	return http.StatusSwitchingProtocols
+}
+
+// hijackWriter calls onHijack when the connection is hijacked, which for an
+// upgrade means the backend has switched protocols.
+type hijackWriter struct {
+	http.ResponseWriter
+	onHijack func()
+	hijacked bool
+}
+
+func (hw *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(hw.ResponseWriter).Hijack()
+	if err == nil && !hw.hijacked {
+		hw.hijacked = true
+		hw.onHijack()
+	}
+
+	return conn, buf, err
+}
+
+func (hw *hijackWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+func writeAndReadUpgrade(conn io.Writer, br *bufio.Reader, req *http.Request) (*http.Response, error) {
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	return http.ReadResponse(br, req)
+}
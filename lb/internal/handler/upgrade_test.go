@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go_loadbalancer/lb/internal/circuitbreaker"
+	"go_loadbalancer/lb/internal/strategy/roundrobin"
+)
+
+// echoUpgrade switches to an echo protocol and reports the handshake's
+// headers on seen.
+func echoUpgrade(seen chan<- http.Header) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Clone()
+
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		io.WriteString(buf, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+		io.Copy(conn, buf)
+	}
+}
+
+// dialUpgrade sends an upgrade handshake to the proxy at addr and returns
+// the connection and the response.
+func dialUpgrade(t *testing.T, addr string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, br, resp
+}
+
+func TestUpgradeTunnel(t *testing.T) {
+	seen := make(chan http.Header, 1)
+	reg := testPool(t, echoUpgrade(seen))
+
+	h := NewHandler(reg, roundrobin.New(), 1, nil)
+	proxy := httptest.NewServer(http.HandlerFunc(h.ServeBackend))
+	defer proxy.Close()
+
+	conn, br, resp := dialUpgrade(t, proxy.Listener.Addr().String())
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+
+	hdr := <-seen
+	if got := hdr.Get("X-Forwarded-For"); got != "127.0.0.1" {
+		t.Errorf("X-Forwarded-For = %q", got)
+	}
+	if got := hdr.Get("X-Forwarded-Proto"); got != "http" {
+		t.Errorf("X-Forwarded-Proto = %q", got)
+	}
+
+	io.WriteString(conn, "hello\n")
+	if line, _ := br.ReadString('\n'); line != "hello\n" {
+		t.Fatalf("echo = %q", line)
+	}
+
+	if n := h.Tunnels.Active(); n != 1 {
+		t.Fatalf("%d active tunnels", n)
+	}
+}
+
+func TestUpgradeClosesProbeAtHandshake(t *testing.T) {
+	reg := testPool(t, echoUpgrade(make(chan http.Header, 1)))
+	reg.CB = circuitbreaker.NewCircuitBreaker(1, time.Millisecond)
+
+	p, _ := reg.CB.Allow()
+	p.Record(false, 0)
+	if s := reg.CB.State(); s != circuitbreaker.Open {
+		t.Fatalf("breaker %s, want open", s)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	h := NewHandler(reg, roundrobin.New(), 1, nil)
+	proxy := httptest.NewServer(http.HandlerFunc(h.ServeBackend))
+	defer proxy.Close()
+
+	conn, br, resp := dialUpgrade(t, proxy.Listener.Addr().String())
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+
+	// Once the echo works the handshake is over; the probe must have
+	// closed the breaker while the tunnel is still open.
+	io.WriteString(conn, "x\n")
+	br.ReadString('\n')
+
+	if s := reg.CB.State(); s != circuitbreaker.Closed {
+		t.Fatalf("breaker %s during the tunnel, want closed", s)
+	}
+}
+
+func TestUpgradeRefused(t *testing.T) {
+	for _, tt := range []struct {
+		status int
+		state  circuitbreaker.State
+	}{
+		{http.StatusForbidden, circuitbreaker.Closed},
+		{http.StatusBadGateway, circuitbreaker.Open},
+	} {
+		reg := testPool(t, func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "no upgrade", tt.status)
+		})
+		reg.CB = circuitbreaker.NewCircuitBreaker(1, time.Minute)
+
+		h := NewHandler(reg, roundrobin.New(), 1, nil)
+		proxy := httptest.NewServer(http.HandlerFunc(h.ServeBackend))
+		defer proxy.Close()
+
+		_, _, resp := dialUpgrade(t, proxy.Listener.Addr().String())
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != tt.status || !strings.Contains(string(body), "no upgrade") {
+			t.Fatalf("got %d %q, want the backend's %d", resp.StatusCode, body, tt.status)
+		}
+
+		if s := reg.CB.State(); s != tt.state {
+			t.Fatalf("%d: breaker %s, want %s", tt.status, s, tt.state)
+		}
+	}
+}
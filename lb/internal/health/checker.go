@@ -3,6 +3,7 @@ package health
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"time"
 
@@ -16,6 +17,11 @@ type HealthChecker struct {
 	failThreshold    int
 	successThreshold int
 	client           *http.Client
+
+	// UDPProbe is sent to udp:// backends, which are healthy when anything
+	// comes back, e.g. a DNS query. Without it they are probed over TCP on
+	// the same port.
+	UDPProbe []byte
 }
 
 func NewHealthChecker(r *registry.BackendRegistry, interval time.Duration, failThreshold int, successThreshold int) *HealthChecker {
@@ -72,8 +78,22 @@ func (hc *HealthChecker) check() {
 }
 
 func (hc *HealthChecker) ping(b *backend.Backend) bool {
+	switch b.URL.Scheme {
+	case "tcp":
+		return hc.dial(b)
+	case "udp":
+		if hc.UDPProbe == nil {
+			return hc.dialTCP(b.URL.Host)
+		}
+		return hc.probeUDP(b)
+	}
+
 	req, _ := http.NewRequest("GET", b.URL.String(), nil)
-	resp, err := hc.client.Do(req)
+
+	// Probe over the backend's own transport so h2/h2c backends are checked
+	// with the protocol they are proxied with.
+	client := &http.Client{Transport: b.Transport, Timeout: hc.client.Timeout}
+	resp, err := client.Do(req)
 
 	fmt.Println("Pinging", b.URL.String(), "Alive?", err == nil)
 
@@ -85,3 +105,57 @@ func (hc *HealthChecker) ping(b *backend.Backend) bool {
 
 	return resp.StatusCode < 500
 }
+
+// dial probes layer-4 backends, which are healthy when they accept a connection.
+func (hc *HealthChecker) dial(b *backend.Backend) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.client.Timeout)
+	defer cancel()
+
+	conn, err := b.Dial(ctx)
+
+	fmt.Println("Pinging", b.URL.String(), "Alive?", err == nil)
+
+	if err != nil {
+		return false
+	}
+
+	conn.Close()
+
+	return true
+}
+
+func (hc *HealthChecker) dialTCP(addr string) bool {
+	conn, err := net.DialTimeout("tcp", addr, hc.client.Timeout)
+
+	fmt.Println("Pinging", "tcp://"+addr, "Alive?", err == nil)
+
+	if err != nil {
+		return false
+	}
+
+	conn.Close()
+
+	return true
+}
+
+func (hc *HealthChecker) probeUDP(b *backend.Backend) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.client.Timeout)
+	defer cancel()
+
+	conn, err := b.Dial(ctx)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(hc.client.Timeout))
+
+	_, err = conn.Write(hc.UDPProbe)
+	if err == nil {
+		_, err = conn.Read(make([]byte, 512))
+	}
+
+	fmt.Println("Pinging", b.URL.String(), "Alive?", err == nil)
+
+	return err == nil
+}
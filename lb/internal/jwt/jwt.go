@@ -0,0 +1,253 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+var (
+	ErrMalformed     = errors.New("jwt: malformed token")
+	ErrAlgorithm     = errors.New("jwt: algorithm not allowed")
+	ErrUnknownKey    = errors.New("jwt: no key for token")
+	ErrSignature     = errors.New("jwt: invalid signature")
+	ErrExpired       = errors.New("jwt: token expired")
+	ErrNotYetValid   = errors.New("jwt: token not yet valid")
+	ErrIssuer        = errors.New("jwt: issuer not accepted")
+	ErrAudience      = errors.New("jwt: audience not accepted")
+	ErrMissingExpiry = errors.New("jwt: token has no expiry")
+)
+
+// Claims is a verified token's payload.
+type Claims map[string]any
+
+// String returns a string claim, or "" if it is missing or not a string.
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns a claim as a list: an array's string elements, or a
+// string's space-separated fields as used by "scope".
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+
+	return nil
+}
+
+func (c Claims) time(name string) (time.Time, bool) {
+	n, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(n), 0), true
+}
+
+// Verifier checks a token's signature and its registered claims.
+type Verifier struct {
+	Keys KeySource
+	// Algorithms limits the accepted algorithms; nil accepts HS256, RS256
+	// and ES256.
+	Algorithms []string
+
+	// Issuer, when set, must equal the iss claim, and aud must contain one
+	// of Audience when it is set.
+	Issuer   string
+	Audience []string
+	// RequireExpiry rejects tokens without an exp claim.
+	RequireExpiry bool
+	// Leeway allows for clock skew when checking exp and nbf.
+	Leeway time.Duration
+
+	Now func() time.Time
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verify parses a compact JWS token and returns its claims if the
+// signature and claims are valid.
+func (v *Verifier) Verify(ctx context.Context, token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, err
+	}
+
+	allowed := v.Algorithms
+	if allowed == nil {
+		allowed = []string{HS256, RS256, ES256}
+	}
+	if !slices.Contains(allowed, h.Alg) {
+		return nil, fmt.Errorf("%w: %q", ErrAlgorithm, h.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	keys, err := v.Keys.Keys(ctx, h.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+
+	verified, tried := false, false
+	for _, k := range keys {
+		if k.Algorithm != "" && k.Algorithm != h.Alg {
+			continue
+		}
+
+		ok, usable := verifySignature(h.Alg, k.Key, signed, sig)
+		tried = tried || usable
+		if ok {
+			verified = true
+			break
+		}
+	}
+
+	if !tried {
+		return nil, ErrUnknownKey
+	}
+	if !verified {
+		return nil, ErrSignature
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if err := v.validate(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return ErrMalformed
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrMalformed
+	}
+
+	return nil
+}
+
+// verifySignature reports whether sig is valid, and whether key is of the
+// right type for alg at all.
+func verifySignature(alg string, key any, signed, sig []byte) (ok, usable bool) {
+	switch alg {
+	case HS256:
+		secret, isSecret := key.([]byte)
+		if !isSecret {
+			return false, false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(sig, mac.Sum(nil)), true
+
+	case RS256:
+		pub, isRSA := key.(*rsa.PublicKey)
+		if !isRSA {
+			return false, false
+		}
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil, true
+
+	case ES256:
+		pub, isEC := key.(*ecdsa.PublicKey)
+		if !isEC || pub.Curve.Params().BitSize != 256 {
+			return false, false
+		}
+		if len(sig) != 64 {
+			return false, true
+		}
+		digest := sha256.Sum256(signed)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, digest[:], r, s), true
+	}
+
+	return false, false
+}
+
+func (v *Verifier) validate(c Claims) error {
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+
+	exp, hasExp := c.time("exp")
+	if !hasExp && v.RequireExpiry {
+		return ErrMissingExpiry
+	}
+	if hasExp && !now.Before(exp.Add(v.Leeway)) {
+		return ErrExpired
+	}
+
+	if nbf, ok := c.time("nbf"); ok && now.Add(v.Leeway).Before(nbf) {
+		return ErrNotYetValid
+	}
+
+	if v.Issuer != "" && c.String("iss") != v.Issuer {
+		return ErrIssuer
+	}
+
+	if len(v.Audience) > 0 {
+		var aud []string
+		switch a := c["aud"].(type) {
+		case string:
+			aud = []string{a}
+		case []any:
+			aud = c.Strings("aud")
+		}
+
+		if !slices.ContainsFunc(aud, func(s string) bool { return slices.Contains(v.Audience, s) }) {
+			return ErrAudience
+		}
+	}
+
+	return nil
+}
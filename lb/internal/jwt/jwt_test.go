@@ -0,0 +1,322 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	hmacSecret = []byte("secret")
+	rsaKey     = mustRSA()
+	ecKey      = mustEC()
+)
+
+func mustRSA() *rsa.PrivateKey {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+func mustEC() *ecdsa.PrivateKey {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// sign builds a compact token; key is a []byte secret, *rsa.PrivateKey or
+// *ecdsa.PrivateKey.
+func sign(t *testing.T, alg, kid string, key any, claims Claims) string {
+	t.Helper()
+
+	h, _ := json.Marshal(header{Alg: alg, Kid: kid})
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerifySignature(t *testing.T) {
+	keys := StaticKeys{
+		{ID: "hs", Algorithm: HS256, Key: hmacSecret},
+		{ID: "rs", Algorithm: RS256, Key: &rsaKey.PublicKey},
+		{ID: "es", Key: &ecKey.PublicKey},
+	}
+	rsaDER, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	exp := Claims{"exp": float64(time.Now().Add(time.Hour).Unix())}
+
+	tests := []struct {
+		name       string
+		token      string
+		algorithms []string
+		want       error
+	}{
+		{name: "HS256", token: sign(t, HS256, "hs", hmacSecret, exp)},
+		{name: "RS256", token: sign(t, RS256, "rs", rsaKey, exp)},
+		{name: "ES256", token: sign(t, ES256, "es", ecKey, exp)},
+		{name: "no kid", token: sign(t, ES256, "", ecKey, exp)},
+		{name: "wrong key", token: sign(t, HS256, "hs", []byte("other"), exp), want: ErrSignature},
+		{name: "tampered", token: sign(t, RS256, "rs", rsaKey, exp) + "A", want: ErrSignature},
+		{name: "algorithm not allowed", token: sign(t, HS256, "hs", hmacSecret, exp), algorithms: []string{RS256}, want: ErrAlgorithm},
+		{name: "none", token: sign(t, "none", "hs", hmacSecret, exp), want: ErrAlgorithm},
+		// The key's pinned algorithm does not match the header.
+		{name: "alg mismatch", token: sign(t, HS256, "rs", hmacSecret, exp), want: ErrUnknownKey},
+		// An RSA public key used as an HMAC secret must not verify.
+		{name: "key confusion", token: sign(t, HS256, "es", rsaDER, exp), want: ErrUnknownKey},
+		{name: "malformed", token: "a.b", want: ErrMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &Verifier{Keys: keys, Algorithms: tt.algorithms}
+			_, err := v.Verify(context.Background(), tt.token)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Verify() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	at := func(d time.Duration) float64 { return float64(now.Add(d).Unix()) }
+
+	tests := []struct {
+		name   string
+		claims Claims
+		v      Verifier
+		want   error
+	}{
+		{name: "valid", claims: Claims{"exp": at(time.Minute)}},
+		{name: "expired", claims: Claims{"exp": at(-time.Minute)}, want: ErrExpired},
+		{name: "expired within leeway", claims: Claims{"exp": at(-time.Minute)}, v: Verifier{Leeway: 2 * time.Minute}},
+		{name: "not yet valid", claims: Claims{"nbf": at(time.Minute)}, want: ErrNotYetValid},
+		{name: "nbf within leeway", claims: Claims{"nbf": at(time.Minute)}, v: Verifier{Leeway: 2 * time.Minute}},
+		{name: "missing exp", claims: Claims{}, v: Verifier{RequireExpiry: true}, want: ErrMissingExpiry},
+		{name: "issuer", claims: Claims{"iss": "idp"}, v: Verifier{Issuer: "idp"}},
+		{name: "wrong issuer", claims: Claims{"iss": "evil"}, v: Verifier{Issuer: "idp"}, want: ErrIssuer},
+		{name: "missing issuer", claims: Claims{}, v: Verifier{Issuer: "idp"}, want: ErrIssuer},
+		{name: "audience string", claims: Claims{"aud": "api"}, v: Verifier{Audience: []string{"web", "api"}}},
+		{name: "audience array", claims: Claims{"aud": []any{"other", "api"}}, v: Verifier{Audience: []string{"api"}}},
+		{name: "wrong audience", claims: Claims{"aud": []any{"other"}}, v: Verifier{Audience: []string{"api"}}, want: ErrAudience},
+		{name: "missing audience", claims: Claims{}, v: Verifier{Audience: []string{"api"}}, want: ErrAudience},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := tt.v
+			v.Keys = StaticKeys{{Key: hmacSecret}}
+			v.Now = func() time.Time { return now }
+
+			claims, err := v.Verify(context.Background(), sign(t, HS256, "", hmacSecret, tt.claims))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Verify() = %v, want %v", err, tt.want)
+			}
+			if err == nil && len(claims) != len(tt.claims) {
+				t.Fatalf("claims = %v", claims)
+			}
+		})
+	}
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	der, _ := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	pemPath := write("ec.pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	secretPath := write("secret", []byte("s3cret\n"))
+
+	k, err := LoadKeyFile(pemPath, "ec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Algorithm != ES256 || k.ID != "ec" {
+		t.Fatalf("LoadKeyFile() = %+v", k)
+	}
+
+	if _, err := LoadKeyFile(secretPath, "hs"); err == nil {
+		t.Fatal("LoadKeyFile accepted a non-PEM file")
+	}
+
+	k, err = LoadSecretFile(secretPath, "hs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Algorithm != HS256 || string(k.Key.([]byte)) != "s3cret" {
+		t.Fatalf("LoadSecretFile() = %+v", k)
+	}
+
+	if _, err := LoadSecretFile(write("empty", []byte("\n")), "hs"); err == nil {
+		t.Fatal("LoadSecretFile accepted an empty secret")
+	}
+}
+
+// jwksServer serves the public half of keys, by key ID, until swapped.
+type jwksServer struct {
+	*httptest.Server
+	keys    atomic.Pointer[map[string]*ecdsa.PrivateKey]
+	fetches atomic.Int32
+	// hold, when set, stalls fetches until it is closed.
+	hold atomic.Pointer[chan struct{}]
+}
+
+func newJWKSServer(t *testing.T, keys map[string]*ecdsa.PrivateKey) *jwksServer {
+	s := &jwksServer{}
+	s.keys.Store(&keys)
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		if hold := s.hold.Load(); hold != nil {
+			<-*hold
+		}
+
+		var set struct {
+			Keys []jwk `json:"keys"`
+		}
+		for kid, k := range *s.keys.Load() {
+			set.Keys = append(set.Keys, jwk{
+				Kty: "EC", Kid: kid, Crv: "P-256", Alg: ES256,
+				X: encodeInt(k.X), Y: encodeInt(k.Y),
+			})
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func encodeInt(n *big.Int) string {
+	b := make([]byte, 32)
+	n.FillBytes(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestJWKSRotation(t *testing.T) {
+	oldKey, newKey := mustEC(), mustEC()
+	srv := newJWKSServer(t, map[string]*ecdsa.PrivateKey{"old": oldKey})
+
+	jwks := NewJWKS(srv.URL)
+	jwks.MinRefreshInterval = time.Nanosecond
+	v := &Verifier{Keys: jwks}
+	ctx := context.Background()
+
+	if _, err := v.Verify(ctx, sign(t, ES256, "old", oldKey, Claims{})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify(ctx, sign(t, ES256, "old", oldKey, Claims{})); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.fetches.Load(); n != 1 {
+		t.Fatalf("%d fetches for a cached key, want 1", n)
+	}
+
+	srv.keys.Store(&map[string]*ecdsa.PrivateKey{"new": newKey})
+
+	if _, err := v.Verify(ctx, sign(t, ES256, "new", newKey, Claims{})); err != nil {
+		t.Fatalf("rotated key: %v", err)
+	}
+	if _, err := v.Verify(ctx, sign(t, ES256, "old", oldKey, Claims{})); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("retired key: %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestJWKSServesCacheDuringRefresh(t *testing.T) {
+	key := mustEC()
+	srv := newJWKSServer(t, map[string]*ecdsa.PrivateKey{"k": key})
+
+	jwks := NewJWKS(srv.URL)
+	jwks.RefreshInterval = time.Nanosecond
+	jwks.MinRefreshInterval = time.Nanosecond
+	ctx := context.Background()
+
+	if _, err := jwks.Keys(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every later call finds the keys stale; with the endpoint stuck, they
+	// must still answer from the cache without waiting.
+	hold := make(chan struct{})
+	srv.hold.Store(&hold)
+	defer close(hold)
+
+	for range 3 {
+		done := make(chan error, 1)
+		go func() {
+			keys, err := jwks.Keys(ctx, "k")
+			if err == nil && len(keys) != 1 {
+				err = errors.New("cached key missing")
+			}
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Keys blocked on the refresh")
+		}
+	}
+
+	// The first stale call started a refresh; the others found it running.
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.fetches.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := srv.fetches.Load(); n != 2 {
+		t.Fatalf("%d fetches, want one initial and one in flight", n)
+	}
+}
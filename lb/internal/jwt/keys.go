@@ -0,0 +1,336 @@
+package jwt
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultJWKSRefresh    = time.Hour
+	DefaultJWKSMinRefresh = time.Minute
+)
+
+// Key is a verification key: a []byte secret for HS256, an *rsa.PublicKey
+// for RS256 or an *ecdsa.PublicKey for ES256.
+type Key struct {
+	ID string
+	// Algorithm restricts the key to one algorithm; empty allows any that
+	// fits the key type.
+	Algorithm string
+	Key       any
+}
+
+// KeySource supplies the candidate keys for a token. kid is the token's key
+// ID and may be empty.
+type KeySource interface {
+	Keys(ctx context.Context, kid string) ([]Key, error)
+}
+
+// StaticKeys is a fixed set of keys. Keys without an ID match any token.
+type StaticKeys []Key
+
+func (sk StaticKeys) Keys(_ context.Context, kid string) ([]Key, error) {
+	var out []Key
+	for _, k := range sk {
+		if kid == "" || k.ID == "" || k.ID == kid {
+			out = append(out, k)
+		}
+	}
+
+	return out, nil
+}
+
+// LoadKeyFile reads a PEM public key or certificate for RS256/ES256. It
+// fails on anything else: treating a stray public key file as an HS256
+// secret would let anyone who has the key forge tokens. HS256 secrets are
+// loaded with LoadSecretFile.
+func LoadKeyFile(path, id string) (Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Key{}, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return Key{}, fmt.Errorf("%s: no PEM key found", path)
+	}
+
+	var pub any
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return Key{}, err
+		}
+		pub = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return Key{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return Key{ID: id, Algorithm: RS256, Key: pub}, nil
+	case *ecdsa.PublicKey:
+		return Key{ID: id, Algorithm: ES256, Key: pub}, nil
+	}
+
+	return Key{}, fmt.Errorf("%s: unsupported key type %T", path, pub)
+}
+
+// LoadSecretFile reads an HS256 secret, ignoring a trailing newline.
+func LoadSecretFile(path, id string) (Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Key{}, err
+	}
+
+	secret := bytes.TrimRight(data, "\r\n")
+	if len(secret) == 0 {
+		return Key{}, fmt.Errorf("%s: empty secret", path)
+	}
+
+	return Key{ID: id, Algorithm: HS256, Key: secret}, nil
+}
+
+// JWKS fetches keys from a JSON Web Key Set endpoint and caches them. The
+// set is refetched every RefreshInterval and, to pick up rotated keys, when
+// a token names an unknown key ID, but no more often than
+// MinRefreshInterval. One fetch runs at a time, in the background: callers
+// keep using the cached keys meanwhile, and only those with no cached keys
+// or an unknown key ID wait for it. If a refetch fails the cached keys stay
+// in use.
+type JWKS struct {
+	URL                string
+	HTTPClient         *http.Client
+	RefreshInterval    time.Duration
+	MinRefreshInterval time.Duration
+
+	mu         sync.Mutex
+	keys       []Key
+	err        error
+	fetchedAt  time.Time
+	triedAt    time.Time
+	refreshing chan struct{}
+}
+
+func NewJWKS(url string) *JWKS {
+	return &JWKS{
+		URL:                url,
+		HTTPClient:         &http.Client{Timeout: 10 * time.Second},
+		RefreshInterval:    DefaultJWKSRefresh,
+		MinRefreshInterval: DefaultJWKSMinRefresh,
+	}
+}
+
+func (j *JWKS) Keys(ctx context.Context, kid string) ([]Key, error) {
+	refresh, minRefresh := j.RefreshInterval, j.MinRefreshInterval
+	if refresh <= 0 {
+		refresh = DefaultJWKSRefresh
+	}
+	if minRefresh <= 0 {
+		minRefresh = DefaultJWKSMinRefresh
+	}
+
+	j.mu.Lock()
+	now := time.Now()
+	stale := j.fetchedAt.IsZero() || now.Sub(j.fetchedAt) >= refresh
+	unknown := kid != "" && !hasKey(j.keys, kid)
+
+	if (stale || unknown) && j.refreshing == nil && now.Sub(j.triedAt) >= minRefresh {
+		j.triedAt = now
+		j.refreshing = make(chan struct{})
+		// The fetch serves every waiting caller, so it must not end with
+		// the request that happened to start it.
+		go j.refresh(context.WithoutCancel(ctx), j.refreshing)
+	}
+	keys, err, wait := j.keys, j.err, j.refreshing
+	j.mu.Unlock()
+
+	if wait != nil && (keys == nil || (kid != "" && !hasKey(keys, kid))) {
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		j.mu.Lock()
+		keys, err = j.keys, j.err
+		j.mu.Unlock()
+	}
+
+	if keys == nil && err != nil {
+		return nil, err
+	}
+
+	return StaticKeys(keys).Keys(ctx, kid)
+}
+
+func (j *JWKS) refresh(ctx context.Context, done chan struct{}) {
+	keys, err := j.fetch(ctx)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	switch {
+	case err == nil:
+		j.keys, j.err, j.fetchedAt = keys, nil, time.Now()
+	case j.keys == nil:
+		j.err = err
+	default:
+		log.Printf("jwks: keeping cached keys: %v", err)
+	}
+
+	j.refreshing = nil
+	close(done)
+}
+
+func hasKey(keys []Key, kid string) bool {
+	for _, k := range keys {
+		if k.ID == kid {
+			return true
+		}
+	}
+
+	return false
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+func (j *JWKS) fetch(ctx context.Context) ([]Key, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := j.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks: %s returned %s", j.URL, resp.Status)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+
+	keys := make([]Key, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.parse()
+		if err != nil {
+			// One unusable key should not take the others down with it.
+			log.Printf("jwks: skipping key %q: %v", k.Kid, err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func (k jwk) parse() (Key, error) {
+	key := Key{ID: k.Kid, Algorithm: k.Alg}
+
+	switch k.Kty {
+	case "RSA":
+		n, err1 := decodeInt(k.N)
+		e, err2 := decodeInt(k.E)
+		if err := errors.Join(err1, err2); err != nil {
+			return Key{}, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return Key{}, errors.New("invalid RSA exponent")
+		}
+		key.Key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return Key{}, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err1 := decodeInt(k.X)
+		y, err2 := decodeInt(k.Y)
+		if err := errors.Join(err1, err2); err != nil {
+			return Key{}, err
+		}
+		if x.BitLen() > 256 || y.BitLen() > 256 {
+			return Key{}, errors.New("invalid EC point")
+		}
+
+		// crypto/ecdh rejects points that are not on the curve.
+		point := make([]byte, 65)
+		point[0] = 4
+		x.FillBytes(point[1:33])
+		y.FillBytes(point[33:])
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return Key{}, err
+		}
+		key.Key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil {
+			return Key{}, err
+		}
+		key.Key = secret
+
+	default:
+		return Key{}, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+
+	return key, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,191 @@
+package l4
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"go_loadbalancer/lb/internal/backend"
+	"go_loadbalancer/lb/internal/circuitbreaker"
+	"go_loadbalancer/lb/internal/proxyproto"
+	"go_loadbalancer/lb/internal/registry"
+	"go_loadbalancer/lb/internal/strategy"
+	"go_loadbalancer/lb/internal/tunnel"
+)
+
+var ErrNoBackendAvailable = errors.New("no backend available")
+
+const (
+	DefaultConnectTimeout = 5 * time.Second
+	DefaultIdleTimeout    = 10 * time.Minute
+)
+
+// TCPProxy balances raw TCP connections across the backends of a registry.
+// Backends are registered with tcp:// URLs, e.g. "tcp://10.0.0.5:5432".
+type TCPProxy struct {
+	Registry *registry.BackendRegistry
+	Strategy strategy.Strategy
+	Tunnels  *tunnel.Manager
+
+	ConnectTimeout time.Duration
+	// ConnectAttempts is how many backends are tried when connecting fails.
+	ConnectAttempts int
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	closed    bool
+}
+
+// NewTCPProxy returns a proxy whose connections close after idleTimeout
+// without traffic, or DefaultIdleTimeout if it is not positive.
+func NewTCPProxy(r *registry.BackendRegistry, s strategy.Strategy, idleTimeout time.Duration) *TCPProxy {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+
+	return &TCPProxy{
+		Registry:        r,
+		Strategy:        s,
+		Tunnels:         tunnel.NewManager(idleTimeout),
+		ConnectTimeout:  DefaultConnectTimeout,
+		ConnectAttempts: 3,
+		listeners:       make(map[net.Listener]struct{}),
+	}
+}
+
+func (p *TCPProxy) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return p.Serve(ln)
+}
+
+// Serve accepts connections on ln until it is closed. After Shutdown it
+// returns net.ErrClosed.
+func (p *TCPProxy) Serve(ln net.Listener) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		ln.Close()
+		return net.ErrClosed
+	}
+	p.listeners[ln] = struct{}{}
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.listeners, ln)
+		p.mu.Unlock()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		go p.handle(conn)
+	}
+}
+
+func (p *TCPProxy) handle(conn net.Conn) {
+	reg := p.Registry
+
+	var permit circuitbreaker.Permit
+	if reg.CB != nil {
+		var ok bool
+		if permit, ok = reg.CB.Allow(); !ok {
+			log.Printf("tcp: %s rejected: %v", conn.RemoteAddr(), circuitbreaker.ErrOpen)
+			conn.Close()
+			return
+		}
+	}
+
+	start := time.Now()
+	b, upstream, err := p.connect(conn)
+	permit.Record(err == nil, time.Since(start))
+
+	if err != nil {
+		log.Printf("tcp: %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	defer strategy.Done(p.Strategy, b)
+
+	if err := p.Tunnels.Splice(conn, upstream); err != nil {
+		log.Printf("tcp: %s <-> %s closed: %v", conn.RemoteAddr(), b.URL.Host, err)
+	}
+}
+
+// connect dials backends picked by the strategy until one accepts. The
+// caller must call strategy.Done for the returned backend.
+func (p *TCPProxy) connect(client net.Conn) (*backend.Backend, net.Conn, error) {
+	attempts := max(p.ConnectAttempts, 1)
+	lastErr := ErrNoBackendAvailable
+
+	timeout := p.ConnectTimeout
+	if timeout <= 0 {
+		timeout = DefaultConnectTimeout
+	}
+
+	for range attempts {
+		alive := p.Registry.AliveBackends()
+		if len(alive) == 0 {
+			return nil, nil, ErrNoBackendAvailable
+		}
+
+		b := p.Strategy.Next(alive)
+		if b == nil {
+			return nil, nil, ErrNoBackendAvailable
+		}
+
+		permit, ok := b.Allow()
+		if !ok {
+			strategy.Done(p.Strategy, b)
+			lastErr = circuitbreaker.ErrOpen
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		ctx = proxyproto.WithAddrs(ctx, client.RemoteAddr(), client.LocalAddr())
+		start := time.Now()
+		upstream, err := b.Dial(ctx)
+		cancel()
+
+		if err != nil {
+			b.RecordFailure(permit, time.Since(start))
+			strategy.Done(p.Strategy, b)
+			lastErr = err
+			continue
+		}
+
+		b.RecordSuccess(permit, time.Since(start))
+
+		return b, upstream, nil
+	}
+
+	return nil, nil, lastErr
+}
+
+// Shutdown closes the listeners and waits for open connections to finish
+// until ctx is done, then closes the rest.
+func (p *TCPProxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	for ln := range p.listeners {
+		ln.Close()
+	}
+	p.mu.Unlock()
+
+	return p.Tunnels.Drain(ctx)
+}
@@ -0,0 +1,158 @@
+package l4
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go_loadbalancer/lb/internal/backend"
+	"go_loadbalancer/lb/internal/registry"
+	"go_loadbalancer/lb/internal/strategy/roundrobin"
+)
+
+// tcpEcho greets every connection with name and a newline, then echoes.
+func tcpEcho(t *testing.T, name string) *backend.Backend {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, name+"\n")
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	b, err := backend.CreateNewBackend("tcp://"+ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func startTCPProxy(t *testing.T, p *TCPProxy) net.Addr {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go p.Serve(ln)
+	t.Cleanup(func() { p.Shutdown(t.Context()) })
+
+	return ln.Addr()
+}
+
+// greet connects through the proxy and returns the connection and the
+// greeting of the backend it reached, or "" if the proxy closed it.
+func greet(t *testing.T, proxy net.Addr) (net.Conn, *bufio.Reader, string) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", proxy.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	br := bufio.NewReader(conn)
+	line, _ := br.ReadString('\n')
+
+	return conn, br, line
+}
+
+func TestTCPSplice(t *testing.T) {
+	reg := registry.NewRegistry()
+	reg.Add(tcpEcho(t, "a"))
+
+	p := NewTCPProxy(reg, roundrobin.New(), time.Minute)
+	addr := startTCPProxy(t, p)
+
+	conn, br, hello := greet(t, addr)
+	if hello != "a\n" {
+		t.Fatalf("greeting %q", hello)
+	}
+
+	io.WriteString(conn, "ping\n")
+	if line, _ := br.ReadString('\n'); line != "ping\n" {
+		t.Fatalf("echo %q", line)
+	}
+
+	if n := p.Tunnels.Active(); n != 1 {
+		t.Fatalf("%d active tunnels", n)
+	}
+}
+
+func TestTCPConnectFailover(t *testing.T) {
+	down, err := backend.CreateNewBackend("tcp://127.0.0.1:1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := tcpEcho(t, "open")
+	healthy := tcpEcho(t, "healthy")
+
+	for range 3 {
+		permit, _ := open.CB.Allow()
+		permit.Record(false, 0)
+	}
+
+	reg := registry.NewRegistry()
+	reg.Add(down)
+	reg.Add(open)
+	reg.Add(healthy)
+
+	p := NewTCPProxy(reg, roundrobin.New(), time.Minute)
+	addr := startTCPProxy(t, p)
+
+	// Whichever backend round robin starts at, the refused dial and the
+	// open breaker are skipped.
+	for i := range 3 {
+		if _, _, hello := greet(t, addr); hello != "healthy\n" {
+			t.Fatalf("connection %d reached %q", i, hello)
+		}
+	}
+
+	if down.FailCount() == 0 {
+		t.Fatal("refused dial not recorded against the backend")
+	}
+}
+
+func TestTCPIdleTimeout(t *testing.T) {
+	if p := NewTCPProxy(registry.NewRegistry(), roundrobin.New(), 0); p.Tunnels.IdleTimeout != DefaultIdleTimeout {
+		t.Fatalf("idle timeout %v, want DefaultIdleTimeout", p.Tunnels.IdleTimeout)
+	}
+
+	reg := registry.NewRegistry()
+	reg.Add(tcpEcho(t, "a"))
+
+	addr := startTCPProxy(t, NewTCPProxy(reg, roundrobin.New(), 50*time.Millisecond))
+
+	conn, br, hello := greet(t, addr)
+	if hello != "a\n" {
+		t.Fatalf("greeting %q", hello)
+	}
+
+	start := time.Now()
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("read after idling: %v, want EOF", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("closed after %v", d)
+	}
+	conn.Close()
+}
@@ -0,0 +1,378 @@
+package l4
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go_loadbalancer/lb/internal/backend"
+	"go_loadbalancer/lb/internal/circuitbreaker"
+	"go_loadbalancer/lb/internal/consistenthashing"
+	"go_loadbalancer/lb/internal/registry"
+	"go_loadbalancer/lb/internal/strategy"
+)
+
+const (
+	DefaultSessionIdleTimeout = 30 * time.Second
+	DefaultMaxSessions        = 10000
+	maxDatagramSize           = 64 * 1024
+	affinityReplicas          = 100
+)
+
+var ErrTooManySessions = errors.New("too many udp sessions")
+
+// UDPProxy forwards datagrams to backends registered with udp:// URLs. Each
+// client address gets a session with its own upstream socket, so replies are
+// routed back to the right client; sessions end after IdleTimeout without
+// traffic.
+type UDPProxy struct {
+	Registry    *registry.BackendRegistry
+	Strategy    strategy.Strategy
+	IdleTimeout time.Duration
+	// MaxSessions caps concurrent client sessions, each holding an upstream
+	// socket; datagrams from new clients are dropped while it is reached.
+	// Zero means DefaultMaxSessions.
+	MaxSessions int
+
+	// Affinity picks backends by hashing the client IP onto a consistent-hash
+	// ring instead of using Strategy, so a client keeps reaching the same
+	// backend across sessions while the backend set is stable. When that
+	// backend's breaker is open the client moves to the next one on the ring.
+	Affinity bool
+	// ExpectReply counts sessions that end without any reply as backend
+	// failures. Leave it off for one-way protocols such as syslog.
+	ExpectReply bool
+
+	mu       sync.Mutex
+	conn     net.PacketConn
+	sessions map[string]*udpSession
+	closed   bool
+	ring     *affinityRing
+}
+
+// affinityRing is the consistent-hash ring for one set of backends.
+type affinityRing struct {
+	backends []*backend.Backend
+	byHost   map[string]*backend.Backend
+	ring     *consistenthashing.ConsistentHash
+}
+
+type udpSession struct {
+	client     net.Addr
+	backend    *backend.Backend
+	permit     circuitbreaker.Permit
+	upstream   net.Conn
+	start      time.Time
+	lastActive atomic.Int64
+	replied    atomic.Bool
+	failed     atomic.Bool
+}
+
+func NewUDPProxy(r *registry.BackendRegistry, s strategy.Strategy, idleTimeout time.Duration) *UDPProxy {
+	return &UDPProxy{
+		Registry:    r,
+		Strategy:    s,
+		IdleTimeout: idleTimeout,
+		MaxSessions: DefaultMaxSessions,
+		sessions:    make(map[string]*udpSession),
+	}
+}
+
+func (p *UDPProxy) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	return p.Serve(conn)
+}
+
+// Serve reads datagrams from conn until it is closed.
+func (p *UDPProxy) Serve(conn net.PacketConn) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		conn.Close()
+		return net.ErrClosed
+	}
+	p.conn = conn
+	p.mu.Unlock()
+
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		s, err := p.session(addr)
+		if err != nil {
+			log.Printf("udp: %s: %v", addr, err)
+			continue
+		}
+
+		s.lastActive.Store(time.Now().UnixNano())
+
+		if _, err := s.upstream.Write(buf[:n]); err != nil {
+			log.Printf("udp: %s -> %s: %v", addr, s.backend.URL.Host, err)
+		}
+	}
+}
+
+func (p *UDPProxy) session(addr net.Addr) (*udpSession, error) {
+	key := addr.String()
+
+	p.mu.Lock()
+	s, ok := p.sessions[key]
+	full := len(p.sessions) >= p.maxSessions()
+	p.mu.Unlock()
+
+	if ok {
+		return s, nil
+	}
+
+	if full {
+		return nil, ErrTooManySessions
+	}
+
+	b, permit, upstream, err := p.connect(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s = &udpSession{client: addr, backend: b, permit: permit, upstream: upstream, start: time.Now()}
+	s.lastActive.Store(time.Now().UnixNano())
+
+	p.mu.Lock()
+	if existing, ok := p.sessions[key]; ok {
+		p.mu.Unlock()
+		upstream.Close()
+		permit.Release()
+		p.done(b)
+		return existing, nil
+	}
+	if len(p.sessions) >= p.maxSessions() {
+		p.mu.Unlock()
+		upstream.Close()
+		permit.Release()
+		p.done(b)
+		return nil, ErrTooManySessions
+	}
+	p.sessions[key] = s
+	p.mu.Unlock()
+
+	go p.relay(key, s)
+
+	return s, nil
+}
+
+func (p *UDPProxy) maxSessions() int {
+	if p.MaxSessions > 0 {
+		return p.MaxSessions
+	}
+
+	return DefaultMaxSessions
+}
+
+// connect picks a backend whose breaker admits the session, skipping open
+// ones, and dials it.
+func (p *UDPProxy) connect(client net.Addr) (*backend.Backend, circuitbreaker.Permit, net.Conn, error) {
+	var none circuitbreaker.Permit
+
+	alive := p.Registry.AliveBackends()
+	if len(alive) == 0 {
+		return nil, none, nil, ErrNoBackendAvailable
+	}
+
+	var b *backend.Backend
+	var permit circuitbreaker.Permit
+	skipped := make(map[*backend.Backend]bool)
+	for {
+		if b = p.pick(alive, client, skipped); b == nil {
+			return nil, none, nil, ErrNoBackendAvailable
+		}
+
+		var ok bool
+		if permit, ok = b.Allow(); ok {
+			break
+		}
+		p.done(b)
+
+		// Without b its clients fall through to the next backend.
+		skipped[b] = true
+		if len(skipped) == len(alive) {
+			return nil, none, nil, circuitbreaker.ErrOpen
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultConnectTimeout)
+	defer cancel()
+
+	upstream, err := b.Dial(ctx)
+	if err != nil {
+		b.RecordFailure(permit, 0)
+		p.done(b)
+		return nil, none, nil, err
+	}
+
+	return b, permit, upstream, nil
+}
+
+// pick chooses a backend from alive other than the skipped ones.
+func (p *UDPProxy) pick(alive []*backend.Backend, client net.Addr, skipped map[*backend.Backend]bool) *backend.Backend {
+	if !p.Affinity {
+		candidates := slices.DeleteFunc(slices.Clone(alive), func(b *backend.Backend) bool { return skipped[b] })
+		if len(candidates) == 0 {
+			return nil
+		}
+		return p.Strategy.Next(candidates)
+	}
+
+	key := client.String()
+	if host, _, err := net.SplitHostPort(key); err == nil {
+		key = host
+	}
+
+	r := p.affinityRing(alive)
+	host := r.ring.Get(key, func(host string) bool { return skipped[r.byHost[host]] })
+
+	return r.byHost[host]
+}
+
+// affinityRing returns the ring for alive, building it only when the set of
+// backends has changed since the last call.
+func (p *UDPProxy) affinityRing(alive []*backend.Backend) *affinityRing {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ring != nil && slices.Equal(p.ring.backends, alive) {
+		return p.ring
+	}
+
+	byHost := make(map[string]*backend.Backend, len(alive))
+	hosts := make([]string, 0, len(alive))
+	for _, b := range alive {
+		byHost[b.URL.Host] = b
+		hosts = append(hosts, b.URL.Host)
+	}
+
+	p.ring = &affinityRing{
+		backends: slices.Clone(alive),
+		byHost:   byHost,
+		ring:     consistenthashing.NewConsistentHash(affinityReplicas, hosts),
+	}
+
+	return p.ring
+}
+
+func (p *UDPProxy) done(b *backend.Backend) {
+	if !p.Affinity {
+		strategy.Done(p.Strategy, b)
+	}
+}
+
+// relay copies replies from the backend to the client until the session is
+// idle for IdleTimeout or the proxy shuts down.
+func (p *UDPProxy) relay(key string, s *udpSession) {
+	defer p.endSession(key, s)
+
+	idle := p.IdleTimeout
+	if idle <= 0 {
+		idle = DefaultSessionIdleTimeout
+	}
+
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		s.upstream.SetReadDeadline(time.Now().Add(idle))
+
+		n, err := s.upstream.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				// Only idle if the client has been quiet as well.
+				if time.Since(time.Unix(0, s.lastActive.Load())) < idle {
+					continue
+				}
+				return
+			}
+
+			// ICMP port unreachable and similar surface as read errors.
+			s.failed.Store(true)
+			log.Printf("udp: %s <- %s: %v", s.client, s.backend.URL.Host, err)
+			return
+		}
+
+		// The first reply settles the backend's outcome for the session.
+		if !s.replied.Swap(true) {
+			s.backend.RecordSuccess(s.permit, time.Since(s.start))
+		}
+		s.lastActive.Store(time.Now().UnixNano())
+
+		p.mu.Lock()
+		conn := p.conn
+		p.mu.Unlock()
+
+		if _, err := conn.WriteTo(buf[:n], s.client); err != nil {
+			log.Printf("udp: %s <- %s: %v", s.client, s.backend.URL.Host, err)
+		}
+	}
+}
+
+func (p *UDPProxy) endSession(key string, s *udpSession) {
+	p.mu.Lock()
+	if p.sessions[key] == s {
+		delete(p.sessions, key)
+	}
+	p.mu.Unlock()
+
+	s.upstream.Close()
+
+	// A session without replies is judged when it ends, with no latency
+	// to report.
+	if !s.replied.Load() {
+		if s.failed.Load() || p.ExpectReply {
+			s.backend.RecordFailure(s.permit, 0)
+		} else {
+			s.backend.RecordSuccess(s.permit, 0)
+		}
+	}
+
+	p.done(s.backend)
+}
+
+func (p *UDPProxy) Sessions() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.sessions)
+}
+
+// Shutdown stops reading datagrams and ends every session.
+func (p *UDPProxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	for _, s := range p.sessions {
+		s.upstream.Close()
+	}
+	p.mu.Unlock()
+
+	return nil
+}
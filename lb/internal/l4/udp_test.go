@@ -0,0 +1,204 @@
+package l4
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"go_loadbalancer/lb/internal/backend"
+	"go_loadbalancer/lb/internal/circuitbreaker"
+	"go_loadbalancer/lb/internal/registry"
+	"go_loadbalancer/lb/internal/strategy/roundrobin"
+)
+
+// udpEcho answers every datagram with name.
+func udpEcho(t *testing.T, name string) *backend.Backend {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			_, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo([]byte(name), addr)
+		}
+	}()
+
+	b, err := backend.CreateNewBackend("udp://"+conn.LocalAddr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func startUDPProxy(t *testing.T, p *UDPProxy) net.Addr {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go p.Serve(conn)
+	t.Cleanup(func() { p.Shutdown(t.Context()) })
+
+	return conn.LocalAddr()
+}
+
+// ask sends one datagram from a fresh client socket and returns the reply,
+// or "" if none arrives.
+func ask(t *testing.T, proxy net.Addr) string {
+	t.Helper()
+
+	conn, err := net.Dial("udp", proxy.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return ""
+	}
+
+	return string(buf[:n])
+}
+
+func TestUDPSessionCap(t *testing.T) {
+	reg := registry.NewRegistry()
+	reg.Add(udpEcho(t, "a"))
+
+	p := NewUDPProxy(reg, roundrobin.New(), time.Minute)
+	p.MaxSessions = 1
+	addr := startUDPProxy(t, p)
+
+	if got := ask(t, addr); got != "a" {
+		t.Fatalf("first client got %q", got)
+	}
+
+	if got := ask(t, addr); got != "" {
+		t.Fatalf("client over the cap got %q", got)
+	}
+
+	if n := p.Sessions(); n != 1 {
+		t.Fatalf("%d sessions, want 1", n)
+	}
+}
+
+func TestUDPAffinityFailover(t *testing.T) {
+	backends := map[string]*backend.Backend{"a": udpEcho(t, "a"), "b": udpEcho(t, "b")}
+
+	reg := registry.NewRegistry()
+	reg.Add(backends["a"])
+	reg.Add(backends["b"])
+
+	p := NewUDPProxy(reg, roundrobin.New(), time.Minute)
+	p.Affinity = true
+	addr := startUDPProxy(t, p)
+
+	first := ask(t, addr)
+	if first == "" {
+		t.Fatal("no reply")
+	}
+	if again := ask(t, addr); again != first {
+		t.Fatalf("affinity broken: %q then %q", first, again)
+	}
+
+	// Trip the hashed backend's breaker; new sessions move to the other.
+	cb := backends[first].CB
+	for range 3 {
+		permit, _ := cb.Allow()
+		permit.Record(false, 0)
+	}
+
+	got := ask(t, addr)
+	if got == "" || got == first {
+		t.Fatalf("got %q with %q's breaker open", got, first)
+	}
+}
+
+func TestUDPRecordsFirstReply(t *testing.T) {
+	b := udpEcho(t, "a")
+	// A single slow call trips the breaker.
+	b.CB = circuitbreaker.NewCircuitBreakerWithSettings(circuitbreaker.Settings{
+		Mode:                  circuitbreaker.CountWindow,
+		WindowSize:            1,
+		MinimumRequests:       1,
+		SlowCallDuration:      100 * time.Millisecond,
+		SlowCallRateThreshold: 100,
+		ResetTimeout:          time.Minute,
+	})
+
+	reg := registry.NewRegistry()
+	reg.Add(b)
+
+	addr := startUDPProxy(t, NewUDPProxy(reg, roundrobin.New(), 300*time.Millisecond))
+
+	if got := ask(t, addr); got != "a" {
+		t.Fatalf("got %q", got)
+	}
+
+	// The session idles out well past SlowCallDuration; only the time to
+	// the reply counts.
+	time.Sleep(500 * time.Millisecond)
+	if s := b.CB.State(); s != circuitbreaker.Closed {
+		t.Fatalf("breaker %s after a fast reply, want closed", s)
+	}
+}
+
+func TestUDPProbeEndsAtFirstReply(t *testing.T) {
+	b := udpEcho(t, "a")
+	b.CB = circuitbreaker.NewCircuitBreaker(1, time.Millisecond)
+
+	permit, _ := b.CB.Allow()
+	permit.Record(false, 0)
+	time.Sleep(5 * time.Millisecond)
+
+	reg := registry.NewRegistry()
+	reg.Add(b)
+
+	p := NewUDPProxy(reg, roundrobin.New(), time.Minute)
+	addr := startUDPProxy(t, p)
+
+	if got := ask(t, addr); got != "a" {
+		t.Fatalf("got %q", got)
+	}
+
+	if n := p.Sessions(); n != 1 {
+		t.Fatalf("%d sessions, want 1", n)
+	}
+	if s := b.CB.State(); s != circuitbreaker.Closed {
+		t.Fatalf("breaker %s while the session is open, want closed", s)
+	}
+}
+
+func TestUDPAffinityRingReused(t *testing.T) {
+	reg := registry.NewRegistry()
+	reg.Add(udpEcho(t, "a"))
+	reg.Add(udpEcho(t, "b"))
+
+	p := NewUDPProxy(reg, roundrobin.New(), time.Minute)
+
+	first := p.affinityRing(reg.AliveBackends())
+	if again := p.affinityRing(reg.AliveBackends()); again != first {
+		t.Fatal("ring rebuilt for the same backends")
+	}
+
+	reg.Add(udpEcho(t, "c"))
+	if changed := p.affinityRing(reg.AliveBackends()); changed == first || len(changed.backends) != 3 {
+		t.Fatal("ring not rebuilt after a backend was added")
+	}
+}
@@ -0,0 +1,66 @@
+package latency
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Tracker keeps the most recent latency samples of a pool in a ring buffer.
+type Tracker struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	filled  int
+}
+
+func NewTracker(size int) *Tracker {
+	if size <= 0 {
+		size = 1024
+	}
+
+	return &Tracker{samples: make([]time.Duration, size)}
+}
+
+func (t *Tracker) Observe(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.samples[t.next] = d
+	t.next = (t.next + 1) % len(t.samples)
+
+	if t.filled < len(t.samples) {
+		t.filled++
+	}
+}
+
+func (t *Tracker) Count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.filled
+}
+
+// Percentile returns the p-th percentile (0-100) of the recorded samples.
+func (t *Tracker) Percentile(p float64) (time.Duration, bool) {
+	t.mu.Lock()
+	sorted := make([]time.Duration, t.filled)
+	copy(sorted, t.samples[:t.filled])
+	t.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return 0, false
+	}
+
+	slices.Sort(sorted)
+
+	idx := int(p / 100 * float64(len(sorted)))
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	if idx < 0 {
+		idx = 0
+	}
+
+	return sorted[idx], true
+}
@@ -1 +1,111 @@
 package lb
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go_loadbalancer/lb/internal/proxyproto"
+)
+
+type ListenerConfig struct {
+	Addr string
+
+	// HTTP2 enables HTTP/2 over TLS; it only takes effect when TLSConfig is set.
+	HTTP2 bool
+	// H2C enables cleartext HTTP/2 with prior knowledge.
+	H2C       bool
+	TLSConfig *tls.Config
+
+	MaxConcurrentStreams int
+	ReadHeaderTimeout    time.Duration
+	IdleTimeout          time.Duration
+
+	// ProxyProtocolTrusted lists the sources, such as a cloud L4 balancer,
+	// allowed to send PROXY protocol headers on this listener.
+	ProxyProtocolTrusted []*net.IPNet
+}
+
+// Listen opens the TCP listener for cfg, accepting PROXY protocol headers
+// from trusted sources. Serve it with the server from NewServer, or with
+// ServeTLS when TLSConfig is set.
+func Listen(cfg ListenerConfig) (net.Listener, error) {
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.ProxyProtocolTrusted) > 0 {
+		return proxyproto.NewListener(ln, cfg.ProxyProtocolTrusted), nil
+	}
+
+	return ln, nil
+}
+
+func NewServer(cfg ListenerConfig, h http.Handler) *http.Server {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(cfg.HTTP2)
+	protocols.SetUnencryptedHTTP2(cfg.H2C)
+
+	readHeaderTimeout := cfg.ReadHeaderTimeout
+	if readHeaderTimeout == 0 {
+		readHeaderTimeout = 10 * time.Second
+	}
+
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           h,
+		TLSConfig:         cfg.TLSConfig,
+		Protocols:         protocols,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+
+	if cfg.HTTP2 || cfg.H2C {
+		srv.HTTP2 = &http.HTTP2Config{
+			MaxConcurrentStreams: cfg.MaxConcurrentStreams,
+		}
+	}
+
+	return srv
+}
+
+// RedirectHandler sends every request to the same host, path and query over
+// HTTPS. httpsPort may be empty for the default port 443.
+func RedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		target := url.URL{
+			Scheme:   "https",
+			Host:     host,
+			Path:     r.URL.Path,
+			RawPath:  r.URL.RawPath,
+			RawQuery: r.URL.RawQuery,
+		}
+
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
+}
+
+func NewRedirectServer(addr, httpsPort string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           RedirectHandler(httpsPort),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
@@ -0,0 +1,48 @@
+package proxyproto
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+type addrsKey struct{}
+
+type addrs struct {
+	src, dst net.Addr
+}
+
+// WithAddrs records the client connection's addresses for the header sent
+// when dialing a backend.
+func WithAddrs(ctx context.Context, src, dst net.Addr) context.Context {
+	return context.WithValue(ctx, addrsKey{}, addrs{src: src, dst: dst})
+}
+
+// WithRequestAddrs is WithAddrs for the connection r arrived on.
+func WithRequestAddrs(ctx context.Context, r *http.Request) context.Context {
+	var src, dst net.Addr
+
+	if ap, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		src = ap
+	}
+
+	if la, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		dst = la
+	}
+
+	return WithAddrs(ctx, src, dst)
+}
+
+// HeaderFor builds the header for a backend connection dialed with ctx. It is
+// LOCAL when ctx carries no client, e.g. for health checks.
+func HeaderFor(ctx context.Context, version int) *Header {
+	h := &Header{Version: version, Command: Local}
+
+	if a, ok := ctx.Value(addrsKey{}).(addrs); ok && a.src != nil && a.dst != nil {
+		h.Command = Proxy
+		h.Source = a.src
+		h.Destination = a.dst
+	}
+
+	return h
+}
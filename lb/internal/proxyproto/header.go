@@ -0,0 +1,252 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidHeader = errors.New("proxyproto: invalid header")
+	ErrNoHeader      = errors.New("proxyproto: no header")
+)
+
+type Command byte
+
+const (
+	// Local connections come from the proxy itself, e.g. health checks, and
+	// carry no client address.
+	Local Command = 0
+	Proxy Command = 1
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const v1MaxLength = 107
+
+// Header is a PROXY protocol header. Source and Destination are *net.TCPAddr
+// or *net.UDPAddr, or nil for LOCAL and UNKNOWN headers.
+type Header struct {
+	Version     int
+	Command     Command
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// Read parses a v1 or v2 header from the start of r. It returns ErrNoHeader,
+// having consumed nothing, when the stream does not start with one.
+func Read(r *bufio.Reader) (*Header, error) {
+	prefix, err := r.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case string(prefix) == "PROXY":
+		return readV1(r)
+	case bytes.Equal(prefix, v2Signature[:5]):
+		return readV2(r)
+	}
+
+	return nil, ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, truncated(err)
+		}
+		line = append(line, b)
+
+		if b == '\n' {
+			break
+		}
+	}
+
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, ErrInvalidHeader
+	}
+
+	fields := strings.Split(s, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &Header{Version: 1, Command: Local}, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+
+	if v4 := fields[1] == "TCP4"; (src.IP.To4() != nil) != v4 || (dst.IP.To4() != nil) != v4 {
+		return nil, ErrInvalidHeader
+	}
+
+	return &Header{Version: 1, Command: Proxy, Source: src, Destination: dst}, nil
+}
+
+func parseV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if addr == nil || err != nil {
+		return nil, ErrInvalidHeader
+	}
+
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, truncated(err)
+	}
+
+	if !bytes.Equal(fixed[:12], v2Signature) || fixed[12]>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, truncated(err)
+	}
+
+	h := &Header{Version: 2, Command: Command(fixed[12] & 0x0f)}
+
+	switch h.Command {
+	case Local:
+		return h, nil
+	case Proxy:
+	default:
+		return nil, ErrInvalidHeader
+	}
+
+	family, transport := fixed[13]>>4, fixed[13]&0x0f
+
+	var ipLen int
+	switch family {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		// AF_UNSPEC or AF_UNIX: keep the connection's own addresses.
+		h.Command = Local
+		return h, nil
+	}
+
+	if len(body) < 2*ipLen+4 {
+		return nil, ErrInvalidHeader
+	}
+
+	srcIP := net.IP(bytes.Clone(body[:ipLen]))
+	dstIP := net.IP(bytes.Clone(body[ipLen : 2*ipLen]))
+	srcPort := int(binary.BigEndian.Uint16(body[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(body[2*ipLen+2:]))
+
+	if transport == 2 {
+		h.Source = &net.UDPAddr{IP: srcIP, Port: srcPort}
+		h.Destination = &net.UDPAddr{IP: dstIP, Port: dstPort}
+	} else {
+		h.Source = &net.TCPAddr{IP: srcIP, Port: srcPort}
+		h.Destination = &net.TCPAddr{IP: dstIP, Port: dstPort}
+	}
+
+	return h, nil
+}
+
+// truncated reports a header cut short by the end of the stream as
+// io.ErrUnexpectedEOF rather than a clean io.EOF.
+func truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// Format encodes h in its Version, defaulting to v1.
+func (h *Header) Format() []byte {
+	if h.Version == 2 {
+		return h.formatV2()
+	}
+
+	return h.formatV1()
+}
+
+func (h *Header) formatV1() []byte {
+	src, sport, srcOK := splitAddr(h.Source)
+	dst, dport, dstOK := splitAddr(h.Destination)
+
+	if h.Command == Local || !srcOK || !dstOK || (src.To4() == nil) != (dst.To4() == nil) {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	proto := "TCP6"
+	if src.To4() != nil {
+		proto = "TCP4"
+		src, dst = src.To4(), dst.To4()
+	}
+
+	return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", proto, src, dst, sport, dport)
+}
+
+func (h *Header) formatV2() []byte {
+	out := bytes.Clone(v2Signature)
+
+	src, sport, srcOK := splitAddr(h.Source)
+	dst, dport, dstOK := splitAddr(h.Destination)
+
+	if h.Command == Local || !srcOK || !dstOK || (src.To4() == nil) != (dst.To4() == nil) {
+		return append(out, 0x20, 0x00, 0x00, 0x00)
+	}
+
+	transport := byte(1)
+	if _, ok := h.Source.(*net.UDPAddr); ok {
+		transport = 2
+	}
+
+	family := byte(2)
+	if src.To4() != nil {
+		family = 1
+		src, dst = src.To4(), dst.To4()
+	}
+
+	body := make([]byte, 0, 2*len(src)+4)
+	body = append(body, src...)
+	body = append(body, dst...)
+	body = binary.BigEndian.AppendUint16(body, uint16(sport))
+	body = binary.BigEndian.AppendUint16(body, uint16(dport))
+
+	out = append(out, 0x21, family<<4|transport)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(body)))
+
+	return append(out, body...)
+}
+
+func splitAddr(a net.Addr) (net.IP, int, bool) {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, a.IP != nil
+	case *net.UDPAddr:
+		return a.IP, a.Port, a.IP != nil
+	}
+
+	return nil, 0, false
+}
@@ -0,0 +1,215 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func tcp(s string) *net.TCPAddr {
+	a, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func udp(s string) *net.UDPAddr {
+	a, err := net.ResolveUDPAddr("udp", s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// v2 builds a v2 header from its version/command and family/transport
+// bytes and body.
+func v2(verCmd, famProto byte, body ...[]byte) []byte {
+	b := bytes.Join(body, nil)
+
+	out := append(bytes.Clone(v2Signature), verCmd, famProto)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(b)))
+
+	return append(out, b...)
+}
+
+// tlv encodes a type-length-value record as carried after the addresses.
+func tlv(typ byte, value string) []byte {
+	return append(binary.BigEndian.AppendUint16([]byte{typ}, uint16(len(value))), value...)
+}
+
+func read(t *testing.T, in []byte) (*Header, string, error) {
+	t.Helper()
+
+	r := bufio.NewReader(bytes.NewReader(in))
+	h, err := Read(r)
+	rest, _ := io.ReadAll(r)
+
+	return h, string(rest), err
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		header Header
+		v1     string
+	}{
+		{
+			name:   "tcp4",
+			header: Header{Command: Proxy, Source: tcp("192.0.2.1:51000"), Destination: tcp("198.51.100.7:443")},
+			v1:     "PROXY TCP4 192.0.2.1 198.51.100.7 51000 443\r\n",
+		},
+		{
+			name:   "tcp6",
+			header: Header{Command: Proxy, Source: tcp("[2001:db8::1]:51000"), Destination: tcp("[2001:db8::2]:443")},
+			v1:     "PROXY TCP6 2001:db8::1 2001:db8::2 51000 443\r\n",
+		},
+		{
+			name:   "local",
+			header: Header{Command: Local},
+			v1:     "PROXY UNKNOWN\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		for _, version := range []int{1, 2} {
+			h := tt.header
+			h.Version = version
+
+			enc := h.Format()
+			if version == 1 && string(enc) != tt.v1 {
+				t.Errorf("%s: v1 = %q, want %q", tt.name, enc, tt.v1)
+			}
+
+			got, rest, err := read(t, append(enc, "payload"...))
+			if err != nil {
+				t.Fatalf("%s v%d: %v", tt.name, version, err)
+			}
+			if rest != "payload" {
+				t.Errorf("%s v%d: left %q after the header", tt.name, version, rest)
+			}
+			if got.Version != version || got.Command != h.Command ||
+				addrString(got.Source) != addrString(h.Source) || addrString(got.Destination) != addrString(h.Destination) {
+				t.Errorf("%s v%d: read %+v, want %+v", tt.name, version, got, h)
+			}
+		}
+	}
+}
+
+func addrString(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.Network() + " " + a.String()
+}
+
+func TestRoundTripUDP(t *testing.T) {
+	h := &Header{Version: 2, Command: Proxy, Source: udp("192.0.2.1:5353"), Destination: udp("198.51.100.7:53")}
+
+	got, _, err := read(t, h.Format())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got.Source.(*net.UDPAddr); !ok || got.Source.String() != "192.0.2.1:5353" {
+		t.Fatalf("source = %#v", got.Source)
+	}
+}
+
+func TestFormatMixedFamilies(t *testing.T) {
+	h := &Header{Command: Proxy, Source: tcp("192.0.2.1:1"), Destination: tcp("[2001:db8::2]:2")}
+
+	if got := string(h.Format()); got != "PROXY UNKNOWN\r\n" {
+		t.Errorf("v1 = %q", got)
+	}
+
+	h.Version = 2
+	got, _, err := read(t, h.Format())
+	if err != nil || got.Command != Local {
+		t.Errorf("v2 read %+v, %v", got, err)
+	}
+}
+
+func TestReadUnknownAndLocal(t *testing.T) {
+	for _, in := range [][]byte{
+		[]byte("PROXY UNKNOWN\r\n"),
+		[]byte("PROXY UNKNOWN 2001:db8::1 2001:db8::2 1 2\r\n"),
+		// LOCAL ignores whatever addresses and TLVs follow.
+		v2(0x20, 0x11, make([]byte, 12), tlv(0x04, "noop")),
+		// AF_UNSPEC and AF_UNIX carry no usable address.
+		v2(0x21, 0x00),
+		v2(0x21, 0x31, make([]byte, 216)),
+	} {
+		h, rest, err := read(t, append(in, "payload"...))
+		if err != nil {
+			t.Errorf("%q: %v", in, err)
+			continue
+		}
+		if h.Command != Local || h.Source != nil || rest != "payload" {
+			t.Errorf("%q: read %+v, left %q", in, h, rest)
+		}
+	}
+}
+
+func TestReadTLVs(t *testing.T) {
+	addrs := []byte{192, 0, 2, 1, 198, 51, 100, 7, 0xc7, 0x38, 0x01, 0xbb}
+	in := v2(0x21, 0x11, addrs, tlv(0x02, "example.com"), tlv(0x20, "\x01\x00\x00\x00\x00"))
+
+	h, rest, err := read(t, append(in, "payload"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Source.String() != "192.0.2.1:51000" || h.Destination.String() != "198.51.100.7:443" {
+		t.Fatalf("read %+v", h)
+	}
+	if rest != "payload" {
+		t.Fatalf("TLVs left %q in the stream", rest)
+	}
+}
+
+func TestReadNoHeader(t *testing.T) {
+	h, rest, err := read(t, []byte("GET / HTTP/1.1\r\n\r\n"))
+	if !errors.Is(err, ErrNoHeader) || h != nil {
+		t.Fatalf("read %+v, %v", h, err)
+	}
+	if rest != "GET / HTTP/1.1\r\n\r\n" {
+		t.Fatalf("consumed input: left %q", rest)
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	addrs := []byte{192, 0, 2, 1, 198, 51, 100, 7, 0xc7, 0x38, 0x01, 0xbb}
+
+	tests := []struct {
+		name string
+		in   []byte
+		want error
+	}{
+		{"v1 no CRLF", []byte("PROXY TCP4 192.0.2.1 198.51.100.7 1 2\n"), ErrInvalidHeader},
+		{"v1 bad protocol", []byte("PROXY UDP4 192.0.2.1 198.51.100.7 1 2\r\n"), ErrInvalidHeader},
+		{"v1 missing field", []byte("PROXY TCP4 192.0.2.1 198.51.100.7 1\r\n"), ErrInvalidHeader},
+		{"v1 bad address", []byte("PROXY TCP4 192.0.2.300 198.51.100.7 1 2\r\n"), ErrInvalidHeader},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 198.51.100.7 1 65536\r\n"), ErrInvalidHeader},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::1 2001:db8::2 1 2\r\n"), ErrInvalidHeader},
+		{"v1 oversized", []byte("PROXY UNKNOWN " + strings.Repeat("x", v1MaxLength) + "\r\n"), ErrInvalidHeader},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1"), io.ErrUnexpectedEOF},
+		{"v2 bad signature", append([]byte("\r\n\r\n\x00\r\nQUIX\n"), 0x21, 0x11, 0, 0), ErrInvalidHeader},
+		{"v2 bad version", v2(0x11, 0x11, addrs), ErrInvalidHeader},
+		{"v2 bad command", v2(0x22, 0x11, addrs), ErrInvalidHeader},
+		{"v2 short addresses", v2(0x21, 0x11, addrs[:8]), ErrInvalidHeader},
+		{"v2 short IPv6 addresses", v2(0x21, 0x21, addrs), ErrInvalidHeader},
+		{"v2 truncated fixed part", v2Signature[:10], io.ErrUnexpectedEOF},
+		{"v2 truncated body", v2(0x21, 0x11, addrs)[:20], io.ErrUnexpectedEOF},
+		{"v2 missing body", v2(0x21, 0x11, addrs)[:16], io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		if h, _, err := read(t, tt.in); !errors.Is(err, tt.want) {
+			t.Errorf("%s: read %+v, %v; want %v", tt.name, h, err, tt.want)
+		}
+	}
+}
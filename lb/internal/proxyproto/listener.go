@@ -0,0 +1,125 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const DefaultHeaderTimeout = 5 * time.Second
+
+// Listener parses PROXY protocol headers on connections from trusted
+// sources, so RemoteAddr and LocalAddr report the original client and
+// destination. Connections from other sources are passed through untouched.
+type Listener struct {
+	net.Listener
+	Trusted       []*net.IPNet
+	HeaderTimeout time.Duration
+}
+
+func NewListener(ln net.Listener, trusted []*net.IPNet) *Listener {
+	return &Listener{
+		Listener:      ln,
+		Trusted:       trusted,
+		HeaderTimeout: DefaultHeaderTimeout,
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.trusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	return &Conn{Conn: conn, r: bufio.NewReader(conn), timeout: l.HeaderTimeout}, nil
+}
+
+func (l *Listener) trusted(addr net.Addr) bool {
+	ip, _, ok := splitAddr(addr)
+	if !ok {
+		return false
+	}
+
+	for _, n := range l.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Conn reads the header lazily, on the first Read or address lookup, so a
+// slow sender only blocks its own connection and not Accept.
+type Conn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	header *Header
+	err    error
+}
+
+func (c *Conn) init() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+
+		c.header, c.err = Read(c.r)
+		if errors.Is(c.err, ErrNoHeader) {
+			c.err = nil
+		}
+
+		if c.err != nil {
+			c.err = fmt.Errorf("proxyproto: read header from %s: %w", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+// Header returns the parsed header, or nil if the peer sent none.
+func (c *Conn) Header() (*Header, error) {
+	c.init()
+	return c.header, c.err
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+
+	return c.r.Read(p)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if h, _ := c.Header(); h != nil && h.Command == Proxy && h.Source != nil {
+		return h.Source
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if h, _ := c.Header(); h != nil && h.Command == Proxy && h.Destination != nil {
+		return h.Destination
+	}
+
+	return c.Conn.LocalAddr()
+}
+
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
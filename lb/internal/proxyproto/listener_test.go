@@ -0,0 +1,158 @@
+package proxyproto
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go_loadbalancer/lb/internal/util"
+)
+
+// accept dials a Listener trusting cidrs, sends data and returns the
+// accepted connection.
+func accept(t *testing.T, cidrs []string, data string) net.Conn {
+	t.Helper()
+
+	trusted, err := util.ParseCIDRs(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := NewListener(inner, trusted)
+	ln.HeaderTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { ln.Close() })
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	io.WriteString(client, data)
+	client.(*net.TCPConn).CloseWrite()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestListenerTrusted(t *testing.T) {
+	conn := accept(t, []string{"127.0.0.0/8"}, "PROXY TCP4 192.0.2.1 198.51.100.7 51000 443\r\npayload")
+
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:51000" {
+		t.Errorf("RemoteAddr = %s", got)
+	}
+	if got := conn.LocalAddr().String(); got != "198.51.100.7:443" {
+		t.Errorf("LocalAddr = %s", got)
+	}
+	if got, _ := io.ReadAll(conn); string(got) != "payload" {
+		t.Errorf("read %q", got)
+	}
+}
+
+func TestListenerTrustedWithoutHeader(t *testing.T) {
+	conn := accept(t, []string{"127.0.0.0/8"}, "GET / HTTP/1.1\r\n\r\n")
+
+	if got, _ := io.ReadAll(conn); string(got) != "GET / HTTP/1.1\r\n\r\n" {
+		t.Errorf("read %q", got)
+	}
+	if ip := conn.RemoteAddr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Errorf("RemoteAddr = %s", ip)
+	}
+}
+
+func TestListenerLocalKeepsAddresses(t *testing.T) {
+	conn := accept(t, []string{"127.0.0.0/8"}, "PROXY UNKNOWN\r\nping")
+
+	if ip := conn.RemoteAddr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Errorf("RemoteAddr = %s", ip)
+	}
+	if got, _ := io.ReadAll(conn); string(got) != "ping" {
+		t.Errorf("read %q", got)
+	}
+}
+
+func TestListenerUntrusted(t *testing.T) {
+	// A header from an untrusted peer is just data; its addresses are
+	// not believed.
+	const data = "PROXY TCP4 192.0.2.1 198.51.100.7 51000 443\r\npayload"
+	conn := accept(t, []string{"10.0.0.0/8"}, data)
+
+	if _, ok := conn.(*Conn); ok {
+		t.Fatal("untrusted connection wrapped")
+	}
+	if ip := conn.RemoteAddr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Errorf("RemoteAddr = %s", ip)
+	}
+	if got, _ := io.ReadAll(conn); string(got) != data {
+		t.Errorf("read %q", got)
+	}
+}
+
+func TestListenerMalformed(t *testing.T) {
+	conn := accept(t, []string{"127.0.0.0/8"}, "PROXY TCP4 nonsense\r\npayload")
+
+	if _, err := conn.Read(make([]byte, 8)); !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("Read() = %v, want ErrInvalidHeader", err)
+	}
+	if ip := conn.RemoteAddr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Errorf("RemoteAddr = %s", ip)
+	}
+}
+
+func TestListenerHeaderTimeout(t *testing.T) {
+	trusted, _ := util.ParseCIDRs([]string{"127.0.0.0/8"})
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := NewListener(inner, trusted)
+	ln.HeaderTimeout = 50 * time.Millisecond
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	io.WriteString(client, "PROX")
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var ne net.Error
+	if _, err := conn.Read(make([]byte, 1)); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("Read() = %v, want a timeout", err)
+	}
+}
+
+func TestHeaderFor(t *testing.T) {
+	if h := HeaderFor(context.Background(), 2); h.Command != Local || h.Version != 2 {
+		t.Errorf("without a client: %+v", h)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "192.0.2.1:51000"
+	r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, tcp("198.51.100.7:443")))
+
+	h := HeaderFor(WithRequestAddrs(context.Background(), r), 1)
+	if got := string(h.Format()); got != "PROXY TCP4 192.0.2.1 198.51.100.7 51000 443\r\n" {
+		t.Errorf("header = %q", got)
+	}
+}
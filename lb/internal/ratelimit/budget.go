@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"go_loadbalancer/lb/internal/util"
+)
+
+const budgetBuckets = 10
+
+// RetryBudget caps retries to a fraction of the requests seen over the last
+// TTL, plus a fixed floor of retries per second, in the style of Finagle's
+// RetryBudget. Every request calls Deposit; every retry must win TryWithdraw.
+type RetryBudget struct {
+	ttl              time.Duration
+	minRetriesPerSec int
+	percentCanRetry  float64
+	clock            util.Clock
+
+	mu          sync.Mutex
+	deposits    *util.Window[int]
+	withdrawals *util.Window[int]
+}
+
+func NewRetryBudget(ttl time.Duration, minRetriesPerSec int, percentCanRetry float64) *RetryBudget {
+	return NewRetryBudgetWithClock(ttl, minRetriesPerSec, percentCanRetry, util.SystemClock)
+}
+
+func NewRetryBudgetWithClock(ttl time.Duration, minRetriesPerSec int, percentCanRetry float64, clock util.Clock) *RetryBudget {
+	if ttl <= 0 {
+		ttl = 10 * time.Second
+	}
+
+	return &RetryBudget{
+		ttl:              ttl,
+		minRetriesPerSec: minRetriesPerSec,
+		percentCanRetry:  percentCanRetry,
+		clock:            clock,
+		deposits:         util.NewWindow[int](ttl, budgetBuckets),
+		withdrawals:      util.NewWindow[int](ttl, budgetBuckets),
+	}
+}
+
+func (rb *RetryBudget) Deposit() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	*rb.deposits.At(rb.clock.Now())++
+}
+
+func (rb *RetryBudget) TryWithdraw() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	now := rb.clock.Now()
+	if sum(rb.withdrawals, now)+1 > rb.allowance(now) {
+		return false
+	}
+
+	*rb.withdrawals.At(now)++
+	return true
+}
+
+// Balance returns the number of retries that could currently be withdrawn.
+func (rb *RetryBudget) Balance() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	now := rb.clock.Now()
+	balance := rb.allowance(now) - sum(rb.withdrawals, now)
+
+	if balance < 0 {
+		return 0
+	}
+
+	return balance
+}
+
+func (rb *RetryBudget) allowance(now time.Time) int {
+	floor := float64(rb.minRetriesPerSec) * rb.ttl.Seconds()
+	earned := float64(sum(rb.deposits, now)) * rb.percentCanRetry / 100
+
+	return int(floor + earned)
+}
+
+func sum(w *util.Window[int], now time.Time) int {
+	total := 0
+	w.Each(now, func(n *int) { total += *n })
+
+	return total
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// withdraw takes up to n retries and returns how many it got.
+func withdraw(rb *RetryBudget, n int) int {
+	got := 0
+	for range n {
+		if rb.TryWithdraw() {
+			got++
+		}
+	}
+	return got
+}
+
+func TestRetryBudgetExhaustion(t *testing.T) {
+	rb := NewRetryBudgetWithClock(10*time.Second, 0, 20, &fakeClock{now: time.Unix(1000, 0)})
+
+	for range 10 {
+		rb.Deposit()
+	}
+
+	if b := rb.Balance(); b != 2 {
+		t.Fatalf("balance %d after 10 deposits at 20%%, want 2", b)
+	}
+	if got := withdraw(rb, 5); got != 2 {
+		t.Fatalf("withdrew %d, want 2", got)
+	}
+	if b := rb.Balance(); b != 0 {
+		t.Fatalf("balance %d once exhausted", b)
+	}
+
+	for range 5 {
+		rb.Deposit()
+	}
+	if got := withdraw(rb, 5); got != 1 {
+		t.Fatalf("withdrew %d after 5 more deposits, want 1", got)
+	}
+}
+
+func TestRetryBudgetFloor(t *testing.T) {
+	rb := NewRetryBudgetWithClock(10*time.Second, 2, 10, &fakeClock{now: time.Unix(1000, 0)})
+
+	// Without traffic the floor alone allows 2 per second over the TTL.
+	if got := withdraw(rb, 50); got != 20 {
+		t.Fatalf("withdrew %d with no deposits, want 20", got)
+	}
+
+	for range 30 {
+		rb.Deposit()
+	}
+	if got := withdraw(rb, 50); got != 3 {
+		t.Fatalf("withdrew %d over the floor, want 3", got)
+	}
+}
+
+func TestRetryBudgetExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	rb := NewRetryBudgetWithClock(10*time.Second, 0, 50, clock)
+
+	for range 10 {
+		rb.Deposit()
+	}
+	clock.Advance(5 * time.Second)
+	for range 10 {
+		rb.Deposit()
+	}
+	if b := rb.Balance(); b != 10 {
+		t.Fatalf("balance %d, want 10", b)
+	}
+
+	// The first deposits leave the TTL; the later ones still count.
+	clock.Advance(6 * time.Second)
+	if b := rb.Balance(); b != 5 {
+		t.Fatalf("balance %d after the first deposits expired, want 5", b)
+	}
+
+	if got := withdraw(rb, 10); got != 5 {
+		t.Fatalf("withdrew %d, want 5", got)
+	}
+
+	// Withdrawals expire too, so fresh deposits can be spent again.
+	clock.Advance(11 * time.Second)
+	for range 4 {
+		rb.Deposit()
+	}
+	if got := withdraw(rb, 10); got != 2 {
+		t.Fatalf("withdrew %d once the old withdrawals expired, want 2", got)
+	}
+}
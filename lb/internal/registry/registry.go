@@ -5,6 +5,9 @@ import (
 	"sync"
 
 	"go_loadbalancer/lb/internal/backend"
+	"go_loadbalancer/lb/internal/circuitbreaker"
+	"go_loadbalancer/lb/internal/latency"
+	"go_loadbalancer/lb/internal/ratelimit"
 )
 
 var (
@@ -14,6 +17,10 @@ var (
 type BackendRegistry struct {
 	backends []*backend.Backend
 	mu       sync.RWMutex
+
+	CB          *circuitbreaker.CircuitBreaker
+	RetryBudget *ratelimit.RetryBudget
+	Latency     *latency.Tracker
 }
 
 func NewRegistry() *BackendRegistry {
@@ -0,0 +1,199 @@
+package retry
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+)
+
+var ErrBodyTooLarge = errors.New("request body too large")
+
+const (
+	DefaultBodyMemoryBytes    = 1 << 20
+	DefaultBodyMaxReplayBytes = 64 << 20
+)
+
+type BodyLimits struct {
+	// MaxBytes rejects larger bodies with ErrBodyTooLarge; zero means no limit.
+	MaxBytes int64
+	// MemoryBytes is how much of a body is kept in memory before it spills
+	// to a temp file in TempDir.
+	MemoryBytes int64
+	// MaxReplayBytes is the largest body buffered for retries. Larger bodies
+	// are streamed to a single backend with retries disabled; zero means no cap.
+	MaxReplayBytes int64
+	TempDir        string
+}
+
+func DefaultBodyLimits() BodyLimits {
+	return BodyLimits{
+		MemoryBytes:    DefaultBodyMemoryBytes,
+		MaxReplayBytes: DefaultBodyMaxReplayBytes,
+	}
+}
+
+// Body is a request body prepared for one or more attempts.
+type Body struct {
+	mem    []byte
+	file   *os.File
+	size   int64
+	stream io.ReadCloser
+}
+
+func BufferBody(req *http.Request, limits BodyLimits) (*Body, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return &Body{}, nil
+	}
+
+	if limits.MaxBytes > 0 && req.ContentLength > limits.MaxBytes {
+		req.Body.Close()
+		return nil, ErrBodyTooLarge
+	}
+
+	var src io.ReadCloser = req.Body
+	if limits.MaxBytes > 0 {
+		src = &maxBytesReader{rc: req.Body, n: limits.MaxBytes}
+	}
+
+	if limits.MaxReplayBytes > 0 && req.ContentLength > limits.MaxReplayBytes {
+		return &Body{stream: src}, nil
+	}
+
+	memLimit := limits.MemoryBytes
+	if memLimit <= 0 {
+		memLimit = DefaultBodyMemoryBytes
+	}
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, src, memLimit+1)
+
+	if errors.Is(err, io.EOF) {
+		src.Close()
+		return &Body{mem: buf.Bytes(), size: n}, nil
+	}
+
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(limits.TempDir, "lb-body-*")
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+
+	spill := io.Reader(src)
+	if limits.MaxReplayBytes > 0 {
+		spill = io.LimitReader(src, limits.MaxReplayBytes-n+1)
+	}
+
+	m, err := io.Copy(f, io.MultiReader(&buf, spill))
+	if err != nil {
+		src.Close()
+		removeTemp(f)
+		return nil, err
+	}
+
+	if limits.MaxReplayBytes > 0 && m > limits.MaxReplayBytes {
+		// Too large to replay: send the spilled prefix and the rest of the
+		// client's body to one backend.
+		return &Body{
+			file: f,
+			stream: &spilledStream{
+				Reader: io.MultiReader(io.NewSectionReader(f, 0, m), src),
+				src:    src,
+			},
+		}, nil
+	}
+
+	src.Close()
+
+	return &Body{file: f, size: m}, nil
+}
+
+// Replayable reports whether the body can be sent more than once.
+func (b *Body) Replayable() bool {
+	return b.stream == nil
+}
+
+func (b *Body) Size() int64 {
+	return b.size
+}
+
+// Reader returns a fresh reader over the body. A non-replayable body can only
+// be read once; later calls return an empty body.
+func (b *Body) Reader() io.ReadCloser {
+	switch {
+	case b.stream != nil:
+		s := b.stream
+		b.stream = io.NopCloser(http.NoBody)
+		return s
+	case b.file != nil:
+		return io.NopCloser(io.NewSectionReader(b.file, 0, b.size))
+	case b.mem != nil:
+		return io.NopCloser(bytes.NewReader(b.mem))
+	}
+
+	return http.NoBody
+}
+
+// Close releases the body and removes any spill file. Every reader handed
+// out by Reader must be finished first; Hedge, for one, waits for its
+// cancelled attempts before returning.
+func (b *Body) Close() error {
+	if b.stream != nil {
+		b.stream.Close()
+	}
+
+	if b.file != nil {
+		removeTemp(b.file)
+		b.file = nil
+	}
+
+	return nil
+}
+
+type spilledStream struct {
+	io.Reader
+	src io.Closer
+}
+
+func (s *spilledStream) Close() error {
+	return s.src.Close()
+}
+
+type maxBytesReader struct {
+	rc io.ReadCloser
+	n  int64
+}
+
+func (r *maxBytesReader) Read(p []byte) (int, error) {
+	if r.n < 0 {
+		return 0, ErrBodyTooLarge
+	}
+
+	if int64(len(p)) > r.n+1 {
+		p = p[:r.n+1]
+	}
+
+	n, err := r.rc.Read(p)
+	r.n -= int64(n)
+
+	if r.n < 0 {
+		return n - int(-r.n), ErrBodyTooLarge
+	}
+
+	return n, err
+}
+
+func (r *maxBytesReader) Close() error {
+	return r.rc.Close()
+}
+
+func removeTemp(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
@@ -0,0 +1,43 @@
+package retry
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go_loadbalancer/lb/internal/backend"
+	"go_loadbalancer/lb/internal/registry"
+)
+
+func TestStreamedBodyOverMaxBytes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer srv.Close()
+
+	b, err := backend.CreateNewBackend(srv.URL, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := registry.NewRegistry()
+	reg.Add(b)
+
+	policy := DefaultPolicy()
+	policy.Body = BodyLimits{MaxBytes: 64, MemoryBytes: 16, MaxReplayBytes: 32, TempDir: t.TempDir()}
+
+	// An unknown length gets past the up-front check, so the limit is only
+	// hit while the body streams to the backend.
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("x", 200)))
+	req.ContentLength = -1
+
+	w := httptest.NewRecorder()
+	DoWithRetries(w, req, reg, firstStrategy{}, nil, policy)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want 413", w.Code)
+	}
+}
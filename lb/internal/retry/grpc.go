@@ -0,0 +1,167 @@
+package retry
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC status codes the balancer acts on.
+const (
+	GRPCOK                = 0
+	GRPCCanceled          = 1
+	GRPCUnknown           = 2
+	GRPCDeadlineExceeded  = 4
+	GRPCResourceExhausted = 8
+	GRPCInternal          = 13
+	GRPCUnavailable       = 14
+	GRPCDataLoss          = 15
+)
+
+func IsGRPC(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// GRPCStatus returns the grpc-status carried in a response, either as a
+// header (trailers-only response) or as a trailer.
+func GRPCStatus(h http.Header) (int, bool) {
+	v := h.Get("Grpc-Status")
+	if v == "" {
+		v = h.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+
+	if v == "" {
+		return 0, false
+	}
+
+	code, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, false
+	}
+
+	return code, true
+}
+
+// IsFailure reports whether a finished attempt counts against the backend for
+// circuit breaking and outlier detection. gRPC responses are always HTTP 200,
+// so their grpc-status, from headers or trailers in h, is consulted too.
+func IsFailure(rec *ResponseRecorder, h http.Header) bool {
+	if rec.Err != nil || rec.Status >= 500 {
+		return true
+	}
+
+	code, ok := GRPCStatus(h)
+	if !ok {
+		return false
+	}
+
+	switch code {
+	case GRPCUnknown, GRPCDeadlineExceeded, GRPCInternal, GRPCUnavailable, GRPCDataLoss:
+		return true
+	}
+
+	return false
+}
+
+// GRPCTimeout parses the grpc-timeout header of req.
+func GRPCTimeout(req *http.Request) (time.Duration, bool) {
+	v := req.Header.Get("Grpc-Timeout")
+	if len(v) < 2 {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	var unit time.Duration
+	switch v[len(v)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, false
+	}
+
+	return time.Duration(n) * unit, true
+}
+
+// WithGRPCDeadline bounds req by its grpc-timeout, so retries and backoff
+// never outlive the caller's deadline.
+func WithGRPCDeadline(req *http.Request) (*http.Request, context.CancelFunc) {
+	d, ok := GRPCTimeout(req)
+	if !ok {
+		return req, func() {}
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), d)
+	return req.WithContext(ctx), cancel
+}
+
+// SetGRPCRemaining rewrites grpc-timeout to the time left before the
+// request's deadline, so each attempt tells the backend its true budget.
+func SetGRPCRemaining(req *http.Request) {
+	deadline, ok := req.Context().Deadline()
+	if !ok || req.Header.Get("Grpc-Timeout") == "" {
+		return
+	}
+
+	remaining := time.Until(deadline)
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	req.Header.Set("Grpc-Timeout", formatGRPCTimeout(remaining))
+}
+
+// grpcTimeoutUnits are the units formatGRPCTimeout tries, finest first.
+var grpcTimeoutUnits = []struct {
+	unit   time.Duration
+	suffix string
+}{
+	{time.Millisecond, "m"},
+	{time.Second, "S"},
+	{time.Minute, "M"},
+	{time.Hour, "H"},
+}
+
+// formatGRPCTimeout encodes d in the finest unit whose value fits the eight
+// digits grpc-timeout allows, rounding down so the backend never sees more
+// time than is left.
+func formatGRPCTimeout(d time.Duration) string {
+	const maxValue = 99999999
+
+	for _, u := range grpcTimeoutUnits {
+		if v := d / u.unit; v <= maxValue {
+			return strconv.FormatInt(int64(v), 10) + u.suffix
+		}
+	}
+
+	return strconv.Itoa(maxValue) + "H"
+}
+
+// WriteGRPCError writes a trailers-only gRPC response carrying code.
+func WriteGRPCError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", msg)
+	w.WriteHeader(http.StatusOK)
+}
+
+// FitsDeadline reports whether waiting d still leaves time before req's deadline.
+func FitsDeadline(req *http.Request, d time.Duration) bool {
+	deadline, ok := req.Context().Deadline()
+	return !ok || time.Now().Add(d).Before(deadline)
+}
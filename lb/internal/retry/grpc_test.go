@@ -0,0 +1,32 @@
+package retry
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0m"},
+		{1500 * time.Microsecond, "1m"},
+		{5 * time.Second, "5000m"},
+		{99999999 * time.Millisecond, "99999999m"},
+		{100000 * time.Second, "100000S"},
+		{99999999*time.Second + time.Millisecond, "99999999S"},
+		{100000000 * time.Second, "1666666M"},
+		{100000000 * time.Minute, "1666666H"},
+	}
+
+	for _, tt := range tests {
+		got := formatGRPCTimeout(tt.d)
+		if got != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.d, got, tt.want)
+		}
+		if len(got) > 9 {
+			t.Errorf("%v: %q has more than eight digits", tt.d, got)
+		}
+	}
+}
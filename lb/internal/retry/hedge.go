@@ -0,0 +1,390 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go_loadbalancer/lb/internal/backend"
+	"go_loadbalancer/lb/internal/circuitbreaker"
+	"go_loadbalancer/lb/internal/ratelimit"
+	"go_loadbalancer/lb/internal/registry"
+	"go_loadbalancer/lb/internal/strategy"
+)
+
+// HedgePolicy enables request hedging: when the first backend has not
+// answered within the hedge delay, the same request is sent to another
+// backend and the first usable response wins.
+type HedgePolicy struct {
+	// Delay is how long to wait before hedging. With Percentile set it is
+	// only used until the pool has MinSamples latencies; if it is zero no
+	// timed hedges are sent in the meantime.
+	Delay time.Duration
+	// Percentile, when set, derives the delay from the pool's latency
+	// tracker once it holds at least MinSamples observations.
+	Percentile float64
+	MinSamples int
+
+	// MaxHedges caps the extra attempts; the policy's MaxAttempts caps the
+	// total as well.
+	MaxHedges int
+	// Budget limits hedges to a share of request volume, on top of the
+	// pool's retry budget.
+	Budget *ratelimit.RetryBudget
+}
+
+// Enabled reports whether the policy can ever send a timed hedge.
+func (hp HedgePolicy) Enabled() bool {
+	return hp.MaxHedges > 0 && (hp.Delay > 0 || hp.Percentile > 0)
+}
+
+// delay returns the hedge delay, or false when none is known yet.
+func (hp HedgePolicy) delay(reg *registry.BackendRegistry) (time.Duration, bool) {
+	if hp.Percentile > 0 && reg.Latency != nil && reg.Latency.Count() >= hp.MinSamples {
+		if d, ok := reg.Latency.Percentile(hp.Percentile); ok && d > 0 {
+			return d, true
+		}
+	}
+
+	return hp.Delay, hp.Delay > 0
+}
+
+type hedgeResult struct {
+	gate    *hedgeGate
+	sw      *StreamWriter
+	backend *backend.Backend
+}
+
+// Hedge sends req to up to 1+MaxHedges backends of reg. The first response
+// that the policy would not retry is streamed to w as soon as its headers
+// arrive, and the other attempts are cancelled. If every attempt is
+// retryable the last one is written. Hedge returns once every attempt has
+// finished, so body may be closed afterwards.
+//
+// The returned recorder holds the status and headers written; it is nil,
+// with nothing written, when no backend was available. body must be
+// replayable. Callers are responsible for only hedging requests that
+// policy.CanRetry.
+func Hedge(w http.ResponseWriter, req *http.Request, body *Body, reg *registry.BackendRegistry, strat strategy.Strategy, policy RetryPolicy, hp HedgePolicy) (*ResponseRecorder, error) {
+	alive := reg.AliveBackends()
+	if len(alive) == 0 {
+		return nil, ErrNoBackendAvailable
+	}
+
+	if hp.Budget != nil {
+		hp.Budget.Deposit()
+	}
+
+	// Every attempt, hedges included, is bounded by the caller's deadline
+	// and tells its backend the time left.
+	req, cancelDeadline := WithGRPCDeadline(req)
+	defer cancelDeadline()
+
+	maxAttempts := 1 + hp.MaxHedges
+	if policy.MaxAttempts > 0 {
+		maxAttempts = min(maxAttempts, policy.MaxAttempts)
+	}
+
+	race := &hedgeRace{w: w, won: make(chan struct{})}
+	results := make(chan hedgeResult, maxAttempts)
+	cancels := make(map[*hedgeGate]context.CancelFunc)
+	used := make(map[*backend.Backend]bool)
+
+	var wg sync.WaitGroup
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+		wg.Wait()
+	}()
+
+	launch := func() bool {
+		var permit circuitbreaker.Permit
+		target, tracked := pickUnused(alive, strat, used)
+		for target != nil {
+			var ok bool
+			if permit, ok = target.Allow(); ok {
+				break
+			}
+
+			used[target] = true
+			if tracked {
+				strategy.Done(strat, target)
+			}
+			target, tracked = pickUnused(alive, strat, used)
+		}
+
+		if target == nil {
+			return false
+		}
+
+		used[target] = true
+
+		ctx, cancel := context.WithCancel(req.Context())
+		gate := &hedgeGate{race: race}
+		sw := NewStreamWriter(gate, policy.MaxResponseBuffer, func(rec *ResponseRecorder) bool {
+			return policy.ShouldRetry(req, rec)
+		})
+		cancels[gate] = cancel
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			sendHedge(ctx, req, body, target, permit, reg, sw)
+			if tracked {
+				strategy.Done(strat, target)
+			}
+			results <- hedgeResult{gate: gate, sw: sw, backend: target}
+		}()
+
+		return true
+	}
+
+	if !launch() {
+		return nil, ErrNoBackendAvailable
+	}
+
+	inflight, attempts := 1, 1
+
+	hedge := func() {
+		if attempts >= maxAttempts || race.winner() != nil {
+			return
+		}
+
+		if hp.Budget != nil && !hp.Budget.TryWithdraw() {
+			return
+		}
+
+		if reg.RetryBudget != nil && !reg.RetryBudget.TryWithdraw() {
+			return
+		}
+
+		if launch() {
+			inflight++
+			attempts++
+		}
+	}
+
+	var timer <-chan time.Time
+	if d, ok := hp.delay(reg); ok {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	won := race.won
+	var last hedgeResult
+
+	for inflight > 0 {
+		select {
+		case <-won:
+			won = nil
+
+			// Stop the losers now rather than when the winner's body ends.
+			winner := race.winner()
+			for gate, cancel := range cancels {
+				if gate != winner {
+					cancel()
+				}
+			}
+
+		case res := <-results:
+			inflight--
+
+			if winner := race.winner(); winner != nil {
+				if res.gate == winner {
+					return res.sw.Recorder(), nil
+				}
+				continue
+			}
+
+			last = res
+			if inflight == 0 {
+				hedge()
+			}
+
+		case <-timer:
+			hedge()
+			if d, ok := hp.delay(reg); ok {
+				timer = time.After(d)
+			} else {
+				timer = nil
+			}
+		}
+	}
+
+	rec := last.sw.Recorder()
+	CommitResponse(w, rec)
+
+	return rec, fmt.Errorf("backend %s returned status %d", last.backend.URL, rec.Status)
+}
+
+func sendHedge(ctx context.Context, req *http.Request, body *Body, target *backend.Backend, permit circuitbreaker.Permit, reg *registry.BackendRegistry, sw *StreamWriter) {
+	// The proxy aborts with http.ErrAbortHandler when a response cannot be
+	// copied, such as when the attempt is cancelled mid-body. Outside the
+	// server's own goroutine that panic would take the process down.
+	defer func() {
+		if r := recover(); r != nil && r != http.ErrAbortHandler {
+			panic(r)
+		}
+	}()
+
+	out := req.Clone(ctx)
+	out.Body = body.Reader()
+	SetGRPCRemaining(out)
+
+	start := time.Now()
+	target.Proxy.ServeHTTP(sw, out)
+	latency := time.Since(start)
+
+	if ctx.Err() != nil {
+		// Lost the race and was cancelled; the outcome says nothing about the backend.
+		permit.Release()
+		return
+	}
+
+	if IsFailure(sw.Recorder(), sw.FinalHeader()) {
+		target.RecordFailure(permit, latency)
+	} else {
+		target.RecordSuccess(permit, latency)
+		if reg.Latency != nil {
+			reg.Latency.Observe(latency)
+		}
+	}
+}
+
+// pickUnused asks strat for a backend not yet in used, falling back to the
+// first unused one. tracked reports whether strat counted the pick and so
+// must be told when it is Done.
+func pickUnused(alive []*backend.Backend, strat strategy.Strategy, used map[*backend.Backend]bool) (target *backend.Backend, tracked bool) {
+	target = strat.Next(alive)
+	if target != nil && !used[target] {
+		return target, true
+	}
+	strategy.Done(strat, target)
+
+	for _, b := range alive {
+		if !used[b] {
+			return b, false
+		}
+	}
+
+	return nil, false
+}
+
+// hedgeRace hands the client's writer to the first attempt that commits.
+type hedgeRace struct {
+	w   http.ResponseWriter
+	won chan struct{}
+
+	mu     sync.Mutex
+	leader *hedgeGate
+}
+
+func (hr *hedgeRace) claim(g *hedgeGate) bool {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	if hr.leader == nil {
+		hr.leader = g
+		close(hr.won)
+	}
+
+	return hr.leader == g
+}
+
+func (hr *hedgeRace) winner() *hedgeGate {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	return hr.leader
+}
+
+// hedgeGate sits between an attempt's StreamWriter and the client. The
+// first attempt to commit claims the client's writer and streams through
+// it; output from any attempt that commits later is discarded.
+type hedgeGate struct {
+	race    *hedgeRace
+	decided bool
+	won     bool
+	discard http.Header
+}
+
+func (g *hedgeGate) claimed() bool {
+	if !g.decided {
+		g.decided = true
+		g.won = g.race.claim(g)
+		if !g.won {
+			g.discard = make(http.Header)
+		}
+	}
+
+	return g.won
+}
+
+func (g *hedgeGate) Header() http.Header {
+	if g.claimed() {
+		return g.race.w.Header()
+	}
+
+	return g.discard
+}
+
+func (g *hedgeGate) WriteHeader(status int) {
+	if g.claimed() {
+		g.race.w.WriteHeader(status)
+	}
+}
+
+func (g *hedgeGate) Write(p []byte) (int, error) {
+	if g.claimed() {
+		return g.race.w.Write(p)
+	}
+
+	// Report success so the proxy keeps draining until the cancellation
+	// reaches it.
+	return len(p), nil
+}
+
+func (g *hedgeGate) Flush() {
+	if g.decided && g.won {
+		_ = http.NewResponseController(g.race.w).Flush()
+	}
+}
+
+// DoWithHedging is the hedged counterpart of DoWithRetries. Requests that
+// are not safe to send twice, or that a disabled policy would never hedge,
+// go through DoWithRetries instead.
+func DoWithHedging(w http.ResponseWriter, req *http.Request, reg *registry.BackendRegistry, strat strategy.Strategy, policy RetryPolicy, hp HedgePolicy) error {
+	if !policy.CanRetry(req) || !hp.Enabled() {
+		return DoWithRetries(w, req, reg, strat, nil, policy)
+	}
+
+	body, err := BufferBody(req, policy.Body)
+	if err != nil {
+		WriteBodyError(w, err)
+		return fmt.Errorf("failed to read request body for hedging: %w", err)
+	}
+	defer body.Close()
+
+	if !body.Replayable() {
+		req, cancel := WithGRPCDeadline(req)
+		defer cancel()
+
+		return doWithRetries(w, req, reg, strat, policy, body)
+	}
+
+	if reg.RetryBudget != nil {
+		reg.RetryBudget.Deposit()
+	}
+
+	rec, err := Hedge(w, req, body, reg, strat, policy, hp)
+	if rec == nil {
+		http.Error(w, "no healthy backends", http.StatusServiceUnavailable)
+	}
+
+	return err
+}
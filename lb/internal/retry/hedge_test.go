@@ -0,0 +1,247 @@
+package retry
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go_loadbalancer/lb/internal/backend"
+	"go_loadbalancer/lb/internal/ratelimit"
+	"go_loadbalancer/lb/internal/registry"
+)
+
+// firstStrategy always picks the first backend, so hedges go to the others
+// in order.
+type firstStrategy struct{}
+
+func (firstStrategy) Next(backends []*backend.Backend) *backend.Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	return backends[0]
+}
+
+func newHedgePool(t *testing.T, handlers ...http.HandlerFunc) *registry.BackendRegistry {
+	t.Helper()
+
+	reg := registry.NewRegistry()
+	for _, h := range handlers {
+		srv := httptest.NewServer(h)
+		t.Cleanup(srv.Close)
+
+		b, err := backend.CreateNewBackend(srv.URL, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reg.Add(b)
+	}
+
+	return reg
+}
+
+// serveHedged runs Hedge behind a real server so responses can be streamed.
+func serveHedged(t *testing.T, reg *registry.BackendRegistry, policy RetryPolicy, hp HedgePolicy) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := BufferBody(r, policy.Body)
+		if err != nil {
+			WriteBodyError(w, err)
+			return
+		}
+		defer body.Close()
+
+		if rec, _ := Hedge(w, r, body, reg, firstStrategy{}, policy, hp); rec == nil {
+			http.Error(w, "no backend", http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func get(t *testing.T, url string) string {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, _ := io.ReadAll(resp.Body)
+	return string(b)
+}
+
+// slowHandler answers after d, or gives up when the request is cancelled.
+func slowHandler(hits *atomic.Int32, d time.Duration, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		select {
+		case <-time.After(d):
+			io.WriteString(w, body)
+		case <-r.Context().Done():
+		}
+	}
+}
+
+func TestHedgeFasterBackendWins(t *testing.T) {
+	var slow, fast atomic.Int32
+	cancelled := make(chan struct{})
+
+	reg := newHedgePool(t,
+		func(w http.ResponseWriter, r *http.Request) {
+			slow.Add(1)
+			<-r.Context().Done()
+			close(cancelled)
+		},
+		slowHandler(&fast, 0, "fast"),
+	)
+
+	srv := serveHedged(t, reg, DefaultPolicy(), HedgePolicy{Delay: 20 * time.Millisecond, MaxHedges: 1})
+
+	if got := get(t, srv.URL); got != "fast" {
+		t.Fatalf("body %q, want fast", got)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("losing attempt was not cancelled")
+	}
+
+	if slow.Load() != 1 || fast.Load() != 1 {
+		t.Fatalf("hits slow=%d fast=%d, want 1 each", slow.Load(), fast.Load())
+	}
+}
+
+func TestHedgeLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy func(*RetryPolicy)
+		hedge  HedgePolicy
+		budget *ratelimit.RetryBudget
+		want   int32
+	}{
+		{
+			name:  "max hedges",
+			hedge: HedgePolicy{Delay: 10 * time.Millisecond, MaxHedges: 2},
+			want:  3,
+		},
+		{
+			name:   "max attempts caps hedges",
+			policy: func(p *RetryPolicy) { p.MaxAttempts = 2 },
+			hedge:  HedgePolicy{Delay: 10 * time.Millisecond, MaxHedges: 2},
+			want:   2,
+		},
+		{
+			name:   "pool retry budget",
+			hedge:  HedgePolicy{Delay: 10 * time.Millisecond, MaxHedges: 2},
+			budget: ratelimit.NewRetryBudget(time.Second, 0, 0),
+			want:   1,
+		},
+		{
+			name:  "no delay means no hedges",
+			hedge: HedgePolicy{MaxHedges: 2},
+			want:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			h := slowHandler(&hits, 200*time.Millisecond, "ok")
+			reg := newHedgePool(t, h, h, h)
+			reg.RetryBudget = tt.budget
+
+			policy := DefaultPolicy()
+			if tt.policy != nil {
+				tt.policy(&policy)
+			}
+
+			srv := serveHedged(t, reg, policy, tt.hedge)
+			if got := get(t, srv.URL); got != "ok" {
+				t.Fatalf("body %q, want ok", got)
+			}
+
+			if got := hits.Load(); got != tt.want {
+				t.Fatalf("%d attempts, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHedgeStreamsWinner(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	reg := newHedgePool(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first\n")
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+
+	srv := serveHedged(t, reg, DefaultPolicy(), HedgePolicy{Delay: time.Second, MaxHedges: 1})
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The first line arrives while the backend is still holding the
+	// response open.
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "first" {
+		t.Fatalf("read %q, %v; want the first line streamed", line, err)
+	}
+}
+
+func TestHedgeAppliesGRPCDeadline(t *testing.T) {
+	timeouts := make(chan string, 2)
+	hang := func(w http.ResponseWriter, r *http.Request) {
+		timeouts <- r.Header.Get("Grpc-Timeout")
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+	reg := newHedgePool(t, hang, hang)
+
+	srv := serveHedged(t, reg, DefaultPolicy(), HedgePolicy{Delay: 20 * time.Millisecond, MaxHedges: 1})
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Grpc-Timeout", "200m")
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("hedged call took %v past a 200ms deadline", d)
+	}
+
+	// Each attempt carries the time left when it was sent.
+	for i := range 2 {
+		v := <-timeouts
+		ms, err := strconv.Atoi(strings.TrimSuffix(v, "m"))
+		if err != nil || ms > 200 || (i == 1 && ms > 190) {
+			t.Errorf("attempt %d sent grpc-timeout %q", i, v)
+		}
+	}
+}
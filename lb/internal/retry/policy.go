@@ -0,0 +1,138 @@
+package retry
+
+import (
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// CanRetry reports whether req may be sent again after a backend has already
+// seen it. Only idempotent methods and requests carrying an Idempotency-Key
+// qualify unless RetryNonIdempotent is set. gRPC calls are always POST, so,
+// as with gRPC's own retry policy, listing RetryableGRPCStatuses opts them in.
+func (p RetryPolicy) CanRetry(req *http.Request) bool {
+	if p.RetryNonIdempotent {
+		return true
+	}
+
+	if len(p.RetryableGRPCStatuses) > 0 && IsGRPC(req) {
+		return true
+	}
+
+	if req.Header.Get(IdempotencyKeyHeader) != "" {
+		return true
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return false
+}
+
+// ShouldRetry reports whether the recorded attempt matches one of the
+// policy's retry-on conditions and the request is safe to send again.
+// Connect failures never reached a backend, so they are retried for any method.
+func (p RetryPolicy) ShouldRetry(req *http.Request, rec *ResponseRecorder) bool {
+	if rec.Err != nil {
+		if isConnectFailure(rec.Err) {
+			return p.RetryOnConnectFailure
+		}
+
+		if isResetBeforeResponse(rec.Err) {
+			return p.RetryOnReset && p.CanRetry(req)
+		}
+	}
+
+	if !p.CanRetry(req) {
+		return false
+	}
+
+	if p.RetryOn5xx && rec.Status >= 500 {
+		return true
+	}
+
+	if slices.Contains(p.RetryableStatuses, rec.Status) {
+		return true
+	}
+
+	if code, ok := GRPCStatus(rec.HeaderMap); ok && slices.Contains(p.RetryableGRPCStatuses, code) {
+		return true
+	}
+
+	return false
+}
+
+// Backoff returns how long to wait after the given (1-based) failed attempt.
+// A Retry-After on the failed response raises the delay; ok is false when the
+// backend asked for longer than MaxBackoff, in which case the caller should
+// stop retrying.
+func (p RetryPolicy) Backoff(attempt int, rec *ResponseRecorder) (time.Duration, bool) {
+	d := backoffDuration(p.InitialBackoff, p.MaxBackoff, attempt)
+
+	if p.Jitter > 0 && d > 0 {
+		d -= time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+
+	if p.HonorRetryAfter && rec != nil {
+		if ra, ok := parseRetryAfter(rec.HeaderMap.Get("Retry-After"), time.Now()); ok {
+			if p.MaxBackoff > 0 && ra > p.MaxBackoff {
+				return 0, false
+			}
+
+			if ra > d {
+				d = ra
+			}
+		}
+	}
+
+	return d, true
+}
+
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+
+	return 0, true
+}
+
+func isConnectFailure(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+func isResetBeforeResponse(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
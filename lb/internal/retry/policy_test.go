@@ -0,0 +1,212 @@
+package retry
+
+import (
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBackoffDuration(t *testing.T) {
+	tests := []struct {
+		attempt int
+		max     time.Duration
+		want    time.Duration
+	}{
+		{attempt: 0, max: time.Second, want: 0},
+		{attempt: 1, max: time.Second, want: 100 * time.Millisecond},
+		{attempt: 2, max: time.Second, want: 200 * time.Millisecond},
+		{attempt: 3, max: time.Second, want: 400 * time.Millisecond},
+		{attempt: 5, max: time.Second, want: time.Second},
+		{attempt: 5, max: 0, want: 1600 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		if got := backoffDuration(100*time.Millisecond, tt.max, tt.attempt); got != tt.want {
+			t.Errorf("attempt %d, max %v: got %v, want %v", tt.attempt, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestBackoffFirstRetryWaits(t *testing.T) {
+	p := DefaultPolicy()
+	p.Jitter = 0
+
+	d, ok := p.Backoff(1, NewResponseRecorder())
+	if !ok || d != p.InitialBackoff {
+		t.Fatalf("first retry backoff %v, want %v", d, p.InitialBackoff)
+	}
+}
+
+func TestCanRetry(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		header http.Header
+		policy func(*RetryPolicy)
+		want   bool
+	}{
+		{name: "GET", method: http.MethodGet, want: true},
+		{name: "PUT", method: http.MethodPut, want: true},
+		{name: "DELETE", method: http.MethodDelete, want: true},
+		{name: "POST", method: http.MethodPost, want: false},
+		{name: "PATCH", method: http.MethodPatch, want: false},
+		{
+			name:   "POST with Idempotency-Key",
+			method: http.MethodPost,
+			header: http.Header{IdempotencyKeyHeader: {"abc"}},
+			want:   true,
+		},
+		{
+			name:   "POST with RetryNonIdempotent",
+			method: http.MethodPost,
+			policy: func(p *RetryPolicy) { p.RetryNonIdempotent = true },
+			want:   true,
+		},
+		{
+			name:   "gRPC without retryable statuses",
+			method: http.MethodPost,
+			header: http.Header{"Content-Type": {"application/grpc"}},
+			want:   false,
+		},
+		{
+			name:   "gRPC with retryable statuses",
+			method: http.MethodPost,
+			header: http.Header{"Content-Type": {"application/grpc"}},
+			policy: func(p *RetryPolicy) { p.RetryableGRPCStatuses = []int{14} },
+			want:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		p := DefaultPolicy()
+		if tt.policy != nil {
+			tt.policy(&p)
+		}
+
+		req := httptest.NewRequest(tt.method, "/", nil)
+		maps.Copy(req.Header, tt.header)
+
+		if got := p.CanRetry(req); got != tt.want {
+			t.Errorf("%s: CanRetry = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	connectErr := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+	tests := []struct {
+		name   string
+		method string
+		status int
+		err    error
+		policy func(*RetryPolicy)
+		want   bool
+	}{
+		{name: "GET 502", method: http.MethodGet, status: 502, want: true},
+		{name: "GET 404", method: http.MethodGet, status: 404, want: false},
+		{name: "POST 502", method: http.MethodPost, status: 502, want: false},
+		{name: "GET connect failure", method: http.MethodGet, err: connectErr, want: true},
+		{name: "POST connect failure", method: http.MethodPost, err: connectErr, want: true},
+		{
+			name:   "connect failure disabled",
+			method: http.MethodGet,
+			err:    connectErr,
+			policy: func(p *RetryPolicy) { p.RetryOnConnectFailure = false },
+			want:   false,
+		},
+		{name: "GET reset", method: http.MethodGet, err: syscall.ECONNRESET, want: true},
+		{name: "POST reset", method: http.MethodPost, err: syscall.ECONNRESET, want: false},
+		{
+			name:   "retryable status",
+			method: http.MethodGet,
+			status: http.StatusTooManyRequests,
+			policy: func(p *RetryPolicy) { p.RetryableStatuses = []int{http.StatusTooManyRequests} },
+			want:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		p := DefaultPolicy()
+		if tt.policy != nil {
+			tt.policy(&p)
+		}
+
+		rec := NewResponseRecorder()
+		rec.Status, rec.Err = tt.status, tt.err
+
+		if got := p.ShouldRetry(httptest.NewRequest(tt.method, "/", nil), rec); got != tt.want {
+			t.Errorf("%s: ShouldRetry = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{"0", 0, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+	}
+
+	for _, tt := range tests {
+		if got, ok := parseRetryAfter(tt.value, now); got != tt.want || ok != tt.ok {
+			t.Errorf("%q: got %v, %v; want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestBackoffRetryAfter(t *testing.T) {
+	p := DefaultPolicy()
+	p.Jitter = 0
+	p.MaxBackoff = 5 * time.Second
+
+	tests := []struct {
+		name       string
+		retryAfter string
+		honor      bool
+		want       time.Duration
+		ok         bool
+		// An HTTP-date has whole-second resolution.
+		approx bool
+	}{
+		{name: "raises the delay", retryAfter: "2", honor: true, want: 2 * time.Second, ok: true},
+		{name: "HTTP-date", retryAfter: time.Now().Add(4 * time.Second).UTC().Format(http.TimeFormat), honor: true, want: 4 * time.Second, ok: true, approx: true},
+		{name: "never lowers it", retryAfter: "0", honor: true, want: p.InitialBackoff, ok: true},
+		{name: "over MaxBackoff stops", retryAfter: "60", honor: true, ok: false},
+		{name: "ignored", retryAfter: "60", honor: false, want: p.InitialBackoff, ok: true},
+	}
+
+	for _, tt := range tests {
+		p.HonorRetryAfter = tt.honor
+
+		rec := NewResponseRecorder()
+		rec.HeaderMap.Set("Retry-After", tt.retryAfter)
+
+		d, ok := p.Backoff(1, rec)
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+
+		if tt.approx && d > tt.want-2*time.Second && d <= tt.want {
+			continue
+		}
+		if d != tt.want {
+			t.Errorf("%s: backoff %v, want %v", tt.name, d, tt.want)
+		}
+	}
+}
@@ -18,6 +18,7 @@ type ResponseRecorder struct {
 	HeaderMap http.Header
 	Body      *bytes.Buffer
 	Status    int
+	Err       error
 	written   bool
 }
 
@@ -43,37 +44,83 @@ func (r *ResponseRecorder) WriteHeader(status int) {
 	r.written = true
 }
 
+// SetProxyError is called by the backend's proxy error handler so retry
+// conditions can tell transport failures apart from upstream 502s.
+func (r *ResponseRecorder) SetProxyError(err error) {
+	r.Err = err
+}
+
 type RetryPolicy struct {
 	MaxAttempts    int
 	InitialBackoff time.Duration
 	MaxBackoff     time.Duration
-	RetryOn5xx     bool
+	// Jitter is the fraction of each backoff, in [0, 1], that is randomized away.
+	Jitter          float64
+	HonorRetryAfter bool
+
+	RetryOn5xx            bool
+	RetryOnConnectFailure bool
+	RetryOnReset          bool
+	RetryableStatuses     []int
+	RetryableGRPCStatuses []int
+
+	RetryNonIdempotent bool
+
+	// MaxResponseBuffer bounds how much of a retryable response is held back
+	// before it is committed to the client.
+	MaxResponseBuffer int
+	Body              BodyLimits
 }
 
 func DefaultPolicy() RetryPolicy {
 	return RetryPolicy{
-		MaxAttempts:    3,
-		InitialBackoff: 100 * time.Millisecond,
-		MaxBackoff:     2 * time.Second,
-		RetryOn5xx:     true,
+		MaxAttempts:           3,
+		InitialBackoff:        100 * time.Millisecond,
+		MaxBackoff:            2 * time.Second,
+		Jitter:                0.5,
+		HonorRetryAfter:       true,
+		RetryOn5xx:            true,
+		RetryOnConnectFailure: true,
+		RetryOnReset:          true,
+		MaxResponseBuffer:     DefaultMaxResponseBuffer,
+		Body:                  DefaultBodyLimits(),
 	}
 }
 
-var ErrNoBackendAvailable = errors.New("no new available to serve request")
+var (
+	ErrNoBackendAvailable = errors.New("no new available to serve request")
+	ErrBudgetExhausted    = errors.New("retry budget exhausted")
+)
 
 func DoWithRetries(w http.ResponseWriter, req *http.Request, reg *registry.BackendRegistry, strat strategy.Strategy, cb *circuitbreaker.CircuitBreaker, policy RetryPolicy) error {
-	var bodyBuf []byte
-	if req.Body != nil {
-		var err error
-		bodyBuf, err = io.ReadAll(req.Body)
-
-		if err != nil {
-			return fmt.Errorf("failed to read request body for retry: %w", err)
+	body, err := BufferBody(req, policy.Body)
+	if err != nil {
+		WriteBodyError(w, err)
+		return fmt.Errorf("failed to read request body for retry: %w", err)
+	}
+	defer body.Close()
+
+	var permit circuitbreaker.Permit
+	if cb != nil {
+		var ok bool
+		if permit, ok = cb.Allow(); !ok {
+			http.Error(w, "pool circuit open", http.StatusServiceUnavailable)
+			return circuitbreaker.ErrOpen
 		}
-
-		req.Body = io.NopCloser(bytes.NewReader(bodyBuf))
 	}
 
+	req, cancel := WithGRPCDeadline(req)
+	defer cancel()
+
+	start := time.Now()
+	err = doWithRetries(w, req, reg, strat, policy, body)
+
+	permit.Record(err == nil, time.Since(start))
+
+	return err
+}
+
+func doWithRetries(w http.ResponseWriter, req *http.Request, reg *registry.BackendRegistry, strat strategy.Strategy, policy RetryPolicy, body *Body) error {
 	backends := reg.List()
 
 	if len(backends) == 0 {
@@ -81,13 +128,20 @@ func DoWithRetries(w http.ResponseWriter, req *http.Request, reg *registry.Backe
 		return ErrNoBackendAvailable
 	}
 
+	if reg.RetryBudget != nil {
+		reg.RetryBudget.Deposit()
+	}
+
+	if !body.Replayable() {
+		policy.MaxAttempts = 1
+	}
+
 	var lastErr error
 	attempted := make(map[string]bool)
 
 	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
-		if bodyBuf != nil {
-			req.Body = io.NopCloser(bytes.NewReader(bodyBuf))
-		}
+		req.Body = body.Reader()
+		SetGRPCRemaining(req)
 
 		alive := reg.AliveBackends()
 		if len(alive) == 0 {
@@ -110,48 +164,83 @@ func DoWithRetries(w http.ResponseWriter, req *http.Request, reg *registry.Backe
 		}
 
 		if attempted[target.URL.String()] && attempt > len(alive) {
+			strategy.Done(strat, target)
 			continue
 		} else {
 			attempted[target.URL.String()] = true
 		}
 
-		if cb != nil {
-			if !cb.BeforeRequest() {
-				lastErr = fmt.Errorf("circuit open for backend %s", target.URL.String())
-				target.MarkDead()
-				continue
-			}
+		permit, ok := target.Allow()
+		if !ok {
+			lastErr = fmt.Errorf("circuit open for backend %s: %w", target.URL.String(), circuitbreaker.ErrOpen)
+			strategy.Done(strat, target)
+			continue
 		}
 
-		rec := NewResponseRecorder()
+		sw := NewStreamWriter(w, policy.MaxResponseBuffer, func(rec *ResponseRecorder) bool {
+			return policy.ShouldRetry(req, rec)
+		})
+
+		start := time.Now()
+		target.Proxy.ServeHTTP(sw, req)
+		latency := time.Since(start)
+		strategy.Done(strat, target)
+
+		rec := sw.Recorder()
+		if !sw.Committed() && errors.Is(rec.Err, ErrBodyTooLarge) {
+			// The client's body broke the limit; the backend is not to blame.
+			permit.Release()
+			WriteBodyError(w, rec.Err)
+			return rec.Err
+		}
 
-		target.Proxy.ServeHTTP(rec, req)
+		failed := IsFailure(rec, sw.FinalHeader())
 
-		if rec.Status < 500 || !policy.RetryOn5xx {
-			commitRecordedResponse(w, rec)
+		if sw.Committed() || !policy.ShouldRetry(req, rec) {
+			sw.Commit()
 
-			target.ResetFailCount()
-			if cb != nil {
-				cb.AfterRequestSuccess()
+			if failed {
+				target.IncrementFailCount()
+			} else {
+				target.ResetFailCount()
+				if reg.Latency != nil {
+					reg.Latency.Observe(latency)
+				}
 			}
 
+			permit.Record(!failed, latency)
+
+			if failed {
+				return fmt.Errorf("backend %s returned status %d", target.URL.String(), rec.Status)
+			}
 			return nil
 		}
 
 		lastErr = fmt.Errorf("backend %s returned status %d", target.URL.String(), rec.Status)
+		if rec.Err != nil {
+			lastErr = fmt.Errorf("backend %s: %w", target.URL.String(), rec.Err)
+		}
 
 		target.IncrementFailCount()
 
-		if cb != nil {
-			cb.AfterRequestFailure()
-		}
+		permit.Record(false, latency)
 
 		if attempt == policy.MaxAttempts {
-			commitRecordedResponse(w, rec)
+			sw.Commit()
+			return lastErr
+		}
+
+		if reg.RetryBudget != nil && !reg.RetryBudget.TryWithdraw() {
+			sw.Commit()
+			return fmt.Errorf("%w: %w", ErrBudgetExhausted, lastErr)
+		}
+
+		backoff, ok := policy.Backoff(attempt, rec)
+		if !ok || !FitsDeadline(req, backoff) {
+			sw.Commit()
 			return lastErr
 		}
 
-		backoff := backoffDuration(policy.InitialBackoff, policy.MaxBackoff, attempt)
 		time.Sleep(backoff)
 	}
 
@@ -160,26 +249,34 @@ func DoWithRetries(w http.ResponseWriter, req *http.Request, reg *registry.Backe
 	return lastErr
 }
 
-func commitRecordedResponse(w http.ResponseWriter, rec *ResponseRecorder) {
-	for k, vv := range rec.HeaderMap {
-		for _, v := range vv {
-			w.Header().Add(k, v)
-		}
+// WriteBodyError answers a request whose body could not be buffered.
+func WriteBodyError(w http.ResponseWriter, err error) int {
+	status := http.StatusBadRequest
+	if errors.Is(err, ErrBodyTooLarge) {
+		status = http.StatusRequestEntityTooLarge
 	}
 
-	w.WriteHeader(rec.Status)
+	http.Error(w, http.StatusText(status), status)
+	return status
+}
+
+func CommitResponse(w http.ResponseWriter, rec *ResponseRecorder) {
+	writeResponseHeader(w, rec)
 	_, _ = io.Copy(w, rec.Body)
+	writeResponseTrailers(w, rec)
 }
 
+// backoffDuration doubles initial for every failed attempt after the first,
+// so the first retry waits initial. A zero max leaves the delay uncapped.
 func backoffDuration(initial, max time.Duration, attempt int) time.Duration {
-	if attempt <= 1 {
+	if attempt < 1 {
 		return 0
 	}
 
-	exp := math.Pow(2, float64(attempt-2))
+	exp := math.Pow(2, float64(attempt-1))
 	d := time.Duration(float64(initial) * exp)
 
-	if d > max {
+	if max > 0 && d > max {
 		return max
 	}
 
@@ -0,0 +1,179 @@
+package retry
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const DefaultMaxResponseBuffer = 1 << 20
+
+// StreamWriter proxies one attempt's response to the client. Once the backend
+// sends headers that the retry policy would not retry, the writer commits and
+// streams the body straight through, flushes included. Retryable responses
+// are held back, up to maxBuffer bytes, so the caller can still try another
+// backend before the client has seen a byte.
+type StreamWriter struct {
+	rw        http.ResponseWriter
+	rec       *ResponseRecorder
+	retryable func(*ResponseRecorder) bool
+	maxBuffer int
+
+	wroteHeader bool
+	committed   bool
+}
+
+func NewStreamWriter(rw http.ResponseWriter, maxBuffer int, retryable func(*ResponseRecorder) bool) *StreamWriter {
+	if maxBuffer <= 0 {
+		maxBuffer = DefaultMaxResponseBuffer
+	}
+
+	return &StreamWriter{
+		rw:        rw,
+		rec:       NewResponseRecorder(),
+		retryable: retryable,
+		maxBuffer: maxBuffer,
+	}
+}
+
+// Recorder returns the attempt's status, headers, proxy error and, while
+// uncommitted, its buffered body.
+func (s *StreamWriter) Recorder() *ResponseRecorder {
+	return s.rec
+}
+
+// FinalHeader returns the headers, and any trailers, of the response as it
+// stands: the client's header map once committed, the buffered one before.
+func (s *StreamWriter) FinalHeader() http.Header {
+	if s.committed {
+		return s.rw.Header()
+	}
+
+	return s.rec.HeaderMap
+}
+
+func (s *StreamWriter) Committed() bool {
+	return s.committed
+}
+
+func (s *StreamWriter) Header() http.Header {
+	if s.committed {
+		return s.rw.Header()
+	}
+
+	return s.rec.HeaderMap
+}
+
+func (s *StreamWriter) WriteHeader(status int) {
+	if s.committed {
+		s.rw.WriteHeader(status)
+		return
+	}
+
+	// Informational responses are not forwarded while the attempt may be retried.
+	if status < http.StatusOK || s.wroteHeader {
+		return
+	}
+
+	s.wroteHeader = true
+	s.rec.Status = status
+
+	// The proxy's 502 for a client body over MaxBytes is held back so the
+	// caller can answer with WriteBodyError instead.
+	if errors.Is(s.rec.Err, ErrBodyTooLarge) {
+		return
+	}
+
+	if !s.retryable(s.rec) {
+		s.Commit()
+	}
+}
+
+func (s *StreamWriter) Write(p []byte) (int, error) {
+	if !s.wroteHeader && !s.committed {
+		s.WriteHeader(http.StatusOK)
+	}
+
+	if s.committed {
+		return s.rw.Write(p)
+	}
+
+	if s.rec.Body.Len()+len(p) > s.maxBuffer {
+		s.Commit()
+		return s.rw.Write(p)
+	}
+
+	return s.rec.Body.Write(p)
+}
+
+// Commit sends the buffered status, headers and body to the client; any
+// further output goes straight through and the attempt can no longer be retried.
+func (s *StreamWriter) Commit() {
+	if s.committed {
+		return
+	}
+
+	s.committed = true
+	writeResponseHeader(s.rw, s.rec)
+	_, _ = io.Copy(s.rw, s.rec.Body)
+	writeResponseTrailers(s.rw, s.rec)
+}
+
+func (s *StreamWriter) Flush() {
+	if s.committed {
+		_ = http.NewResponseController(s.rw).Flush()
+	}
+}
+
+func (s *StreamWriter) Unwrap() http.ResponseWriter {
+	return s.rw
+}
+
+func (s *StreamWriter) SetProxyError(err error) {
+	s.rec.Err = err
+}
+
+func writeResponseHeader(w http.ResponseWriter, rec *ResponseRecorder) {
+	trailers := declaredTrailers(rec.HeaderMap)
+
+	for k, vv := range rec.HeaderMap {
+		if trailers[k] || strings.HasPrefix(k, http.TrailerPrefix) {
+			continue
+		}
+
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+
+	w.WriteHeader(rec.Status)
+}
+
+func writeResponseTrailers(w http.ResponseWriter, rec *ResponseRecorder) {
+	trailers := declaredTrailers(rec.HeaderMap)
+
+	for k, vv := range rec.HeaderMap {
+		if !trailers[k] && !strings.HasPrefix(k, http.TrailerPrefix) {
+			continue
+		}
+
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+}
+
+func declaredTrailers(h http.Header) map[string]bool {
+	declared := make(map[string]bool)
+
+	for _, v := range h.Values("Trailer") {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				declared[http.CanonicalHeaderKey(k)] = true
+			}
+		}
+	}
+
+	return declared
+}
@@ -0,0 +1,166 @@
+package retry
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go_loadbalancer/lb/internal/registry"
+	"go_loadbalancer/lb/internal/strategy/roundrobin"
+)
+
+// serveRetries runs DoWithRetries behind a real server so responses can be
+// streamed.
+func serveRetries(t *testing.T, reg *registry.BackendRegistry, policy RetryPolicy) *httptest.Server {
+	t.Helper()
+
+	strat := roundrobin.New()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		DoWithRetries(w, r, reg, strat, nil, policy)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func streamPolicy() RetryPolicy {
+	p := DefaultPolicy()
+	p.InitialBackoff = time.Millisecond
+	p.Jitter = 0
+	return p
+}
+
+func TestStreamCommitsOnHeadersAndFlushes(t *testing.T) {
+	release := make(chan struct{})
+	reg := newHedgePool(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first\n")
+		w.(http.Flusher).Flush()
+
+		// The rest only comes once the client has seen the first chunk.
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		io.WriteString(w, "second\n")
+	})
+	srv := serveRetries(t, reg, streamPolicy())
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	br := bufio.NewReader(resp.Body)
+	if line, _ := br.ReadString('\n'); line != "first\n" {
+		t.Fatalf("first chunk %q", line)
+	}
+	close(release)
+	if line, _ := br.ReadString('\n'); line != "second\n" {
+		t.Fatalf("second chunk %q", line)
+	}
+}
+
+func TestStreamForwardsTrailers(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusServiceUnavailable} {
+		reg := newHedgePool(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Checksum")
+			w.WriteHeader(status)
+			io.WriteString(w, "body")
+			w.(http.Flusher).Flush()
+			w.Header().Set("X-Checksum", "abc")
+			w.Header().Set(http.TrailerPrefix+"X-Late", "def")
+		})
+
+		// A 503 on the last attempt is held back, then committed.
+		policy := streamPolicy()
+		policy.MaxAttempts = 1
+		srv := serveRetries(t, reg, policy)
+
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != status || string(body) != "body" {
+			t.Fatalf("%d: got %d %q", status, resp.StatusCode, body)
+		}
+		if got := resp.Trailer.Get("X-Checksum"); got != "abc" {
+			t.Errorf("%d: declared trailer %q", status, got)
+		}
+		if got := resp.Trailer.Get("X-Late"); got != "def" {
+			t.Errorf("%d: undeclared trailer %q", status, got)
+		}
+	}
+}
+
+func TestStreamRetriesBeforeCommit(t *testing.T) {
+	var second atomic.Int32
+	reg := newHedgePool(t,
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-From", "first")
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		},
+		func(w http.ResponseWriter, r *http.Request) {
+			second.Add(1)
+			io.WriteString(w, "ok")
+		},
+	)
+	srv := serveRetries(t, reg, streamPolicy())
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" || second.Load() != 1 {
+		t.Fatalf("got %d %q after %d calls to the second backend", resp.StatusCode, body, second.Load())
+	}
+	if got := resp.Header.Get("X-From"); got != "" {
+		t.Fatalf("headers of the retried attempt leaked: X-From %q", got)
+	}
+}
+
+func TestStreamCommitsPastMaxResponseBuffer(t *testing.T) {
+	large := strings.Repeat("x", 64)
+
+	var second atomic.Int32
+	reg := newHedgePool(t,
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, large)
+		},
+		func(w http.ResponseWriter, r *http.Request) {
+			second.Add(1)
+			io.WriteString(w, "ok")
+		},
+	)
+
+	policy := streamPolicy()
+	policy.MaxResponseBuffer = 16
+	srv := serveRetries(t, reg, policy)
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// Too large to hold back, the 503 went out and could not be retried.
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != large {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+	if n := second.Load(); n != 0 {
+		t.Fatalf("retried %d times after committing", n)
+	}
+}
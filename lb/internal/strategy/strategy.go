@@ -5,3 +5,15 @@ import "go_loadbalancer/lb/internal/backend"
 type Strategy interface {
 	Next([]*backend.Backend) *backend.Backend
 }
+
+// Tracker is implemented by strategies that count in-flight work per backend
+// and must be told when a request or upgraded connection has finished.
+type Tracker interface {
+	Done(*backend.Backend)
+}
+
+func Done(s Strategy, b *backend.Backend) {
+	if t, ok := s.(Tracker); ok && b != nil {
+		t.Done(b)
+	}
+}
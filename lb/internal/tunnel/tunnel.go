@@ -0,0 +1,205 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrDraining    = errors.New("tunnel manager is draining")
+	ErrIdleTimeout = errors.New("tunnel idle timeout")
+)
+
+// Manager splices long-lived connections, such as upgraded HTTP connections,
+// closes them after IdleTimeout without traffic in either direction and
+// drains them on shutdown.
+type Manager struct {
+	IdleTimeout time.Duration
+
+	mu       sync.Mutex
+	conns    map[*pair]struct{}
+	draining bool
+	wg       sync.WaitGroup
+}
+
+type pair struct {
+	a, b net.Conn
+}
+
+func (p *pair) close() {
+	p.a.Close()
+	p.b.Close()
+}
+
+func NewManager(idleTimeout time.Duration) *Manager {
+	return &Manager{
+		IdleTimeout: idleTimeout,
+		conns:       make(map[*pair]struct{}),
+	}
+}
+
+// Splice copies bytes between a and b until either side closes or the pair
+// has been idle for IdleTimeout. It closes both connections before returning.
+func (m *Manager) Splice(a, b net.Conn) error {
+	p := &pair{a: a, b: b}
+
+	m.mu.Lock()
+	if m.draining {
+		m.mu.Unlock()
+		p.close()
+		return ErrDraining
+	}
+	m.conns[p] = struct{}{}
+	m.wg.Add(1)
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.conns, p)
+		m.mu.Unlock()
+		m.wg.Done()
+	}()
+
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	errc := make(chan error, 2)
+	go func() { errc <- m.copy(b, a, &lastActive) }()
+	go func() { errc <- m.copy(a, b, &lastActive) }()
+
+	err := <-errc
+	if !errors.Is(err, io.EOF) || !canCloseWrite(a) || !canCloseWrite(b) {
+		p.close()
+	}
+	<-errc
+	p.close()
+
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return ErrIdleTimeout
+	}
+
+	return err
+}
+
+func canCloseWrite(c net.Conn) bool {
+	if rc, ok := c.(*readerConn); ok {
+		c = rc.Conn
+	}
+
+	_, ok := c.(interface{ CloseWrite() error })
+	return ok
+}
+
+func (m *Manager) copy(dst, src net.Conn, lastActive *atomic.Int64) error {
+	buf := make([]byte, 32*1024)
+
+	for {
+		if m.IdleTimeout > 0 {
+			src.SetReadDeadline(time.Now().Add(m.IdleTimeout))
+		}
+
+		n, err := src.Read(buf)
+		if n > 0 {
+			lastActive.Store(time.Now().UnixNano())
+
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+
+		if err == nil {
+			continue
+		}
+
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// Only idle if the other direction has been quiet as well.
+			idle := time.Since(time.Unix(0, lastActive.Load()))
+			if idle < m.IdleTimeout {
+				continue
+			}
+		}
+
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok && errors.Is(err, io.EOF) {
+			cw.CloseWrite()
+		}
+
+		return err
+	}
+}
+
+func (m *Manager) Active() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.conns)
+}
+
+// Drain stops new splices and waits for active ones to finish. When ctx is
+// done first, the remaining connections are closed.
+func (m *Manager) Drain(ctx context.Context) error {
+	m.mu.Lock()
+	m.draining = true
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	m.mu.Lock()
+	for p := range m.conns {
+		p.close()
+	}
+	m.mu.Unlock()
+
+	<-done
+
+	return ctx.Err()
+}
+
+func (m *Manager) Draining() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.draining
+}
+
+// WithReader returns conn with reads served from r first, for connections
+// whose initial bytes were already consumed into a bufio.Reader.
+func WithReader(conn net.Conn, r io.Reader) net.Conn {
+	return &readerConn{Conn: conn, r: r}
+}
+
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *readerConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-accepted
+	t.Cleanup(func() { c.Close(); s.Close() })
+
+	return c, s
+}
+
+// splice runs m.Splice between a client and a backend connection and
+// returns the outer ends plus the Splice result.
+func splice(t *testing.T, m *Manager) (client, backend net.Conn, errc chan error) {
+	t.Helper()
+
+	client, a := tcpPair(t)
+	b, backend := tcpPair(t)
+
+	errc = make(chan error, 1)
+	go func() { errc <- m.Splice(a, b) }()
+
+	return client, backend, errc
+}
+
+func wait(t *testing.T, errc chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Splice did not return")
+		return nil
+	}
+}
+
+func TestSpliceCopiesBothWays(t *testing.T) {
+	m := NewManager(time.Minute)
+	client, backend, errc := splice(t, m)
+
+	io.WriteString(client, "ping\n")
+	if line, _ := bufio.NewReader(backend).ReadString('\n'); line != "ping\n" {
+		t.Fatalf("backend read %q", line)
+	}
+
+	io.WriteString(backend, "pong\n")
+	if line, _ := bufio.NewReader(client).ReadString('\n'); line != "pong\n" {
+		t.Fatalf("client read %q", line)
+	}
+
+	if n := m.Active(); n != 1 {
+		t.Fatalf("%d active tunnels, want 1", n)
+	}
+
+	// A half-close is passed on and the other direction keeps working.
+	client.(*net.TCPConn).CloseWrite()
+	if rest, err := io.ReadAll(backend); err != nil || len(rest) != 0 {
+		t.Fatalf("backend read %q, %v after client half-close", rest, err)
+	}
+	io.WriteString(backend, "bye")
+	backend.Close()
+	if rest, _ := io.ReadAll(client); string(rest) != "bye" {
+		t.Fatalf("client read %q after half-close", rest)
+	}
+
+	if err := wait(t, errc); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.Active(); n != 0 {
+		t.Fatalf("%d active tunnels after close", n)
+	}
+}
+
+func TestSpliceIdleTimeout(t *testing.T) {
+	m := NewManager(50 * time.Millisecond)
+	client, backend, errc := splice(t, m)
+
+	// Traffic in one direction keeps the other from timing out.
+	go func() {
+		for range 6 {
+			io.WriteString(backend, "x")
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	got := make([]byte, 6)
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("tunnel closed while busy: %v", err)
+	}
+
+	if err := wait(t, errc); !errors.Is(err, ErrIdleTimeout) {
+		t.Fatalf("err = %v, want ErrIdleTimeout", err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("client connection left open")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	m := NewManager(time.Minute)
+	_, _, errc := splice(t, m)
+
+	for m.Active() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := m.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Drain() = %v", err)
+	}
+	wait(t, errc)
+
+	if !m.Draining() {
+		t.Fatal("not draining")
+	}
+
+	a, b := net.Pipe()
+	if err := m.Splice(a, b); !errors.Is(err, ErrDraining) {
+		t.Fatalf("Splice while draining = %v", err)
+	}
+}
+
+func TestWithReader(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	go func() {
+		io.WriteString(b, " world")
+		b.Close()
+	}()
+
+	got, _ := io.ReadAll(WithReader(a, io.MultiReader(strings.NewReader("hello"), a)))
+	if string(got) != "hello world" {
+		t.Fatalf("read %q", got)
+	}
+}
@@ -0,0 +1,42 @@
+package util
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs([]string{"10.0.0.0/8", "192.0.2.7", "2001:db8::1", "2001:db8:1::/48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.0.2.7", true},
+		{"192.0.2.8", false},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+		{"2001:db8:1::5", true},
+	}
+
+	for _, tt := range tests {
+		got := false
+		for _, n := range nets {
+			got = got || n.Contains(net.ParseIP(tt.ip))
+		}
+		if got != tt.want {
+			t.Errorf("%s: contained %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"not-an-ip", "10.0.0.0/33"} {
+		if _, err := ParseCIDRs([]string{bad}); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
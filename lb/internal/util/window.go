@@ -0,0 +1,61 @@
+package util
+
+import "time"
+
+// Window aggregates values over the last span of time in a ring of
+// fixed-width buckets. Buckets that fall out of the span are ignored and
+// recycled. It is not safe for concurrent use.
+type Window[T any] struct {
+	width   int64
+	buckets []windowBucket[T]
+}
+
+type windowBucket[T any] struct {
+	epoch int64
+	value T
+}
+
+// NewWindow returns a window covering span with n buckets.
+func NewWindow[T any](span time.Duration, n int) *Window[T] {
+	n = max(n, 1)
+
+	w := &Window[T]{
+		width:   max(int64(span)/int64(n), 1),
+		buckets: make([]windowBucket[T], n),
+	}
+	w.Reset()
+
+	return w
+}
+
+// At returns the bucket now falls in, cleared if it last held an older
+// period.
+func (w *Window[T]) At(now time.Time) *T {
+	epoch := now.UnixNano() / w.width
+	b := &w.buckets[epoch%int64(len(w.buckets))]
+
+	if b.epoch != epoch {
+		*b = windowBucket[T]{epoch: epoch}
+	}
+
+	return &b.value
+}
+
+// Each calls f with every bucket inside the window ending at now.
+func (w *Window[T]) Each(now time.Time, f func(*T)) {
+	epoch := now.UnixNano() / w.width
+	oldest := epoch - int64(len(w.buckets)) + 1
+
+	for i := range w.buckets {
+		if b := &w.buckets[i]; b.epoch >= oldest && b.epoch <= epoch {
+			f(&b.value)
+		}
+	}
+}
+
+// Reset empties every bucket.
+func (w *Window[T]) Reset() {
+	for i := range w.buckets {
+		w.buckets[i] = windowBucket[T]{epoch: -1}
+	}
+}
@@ -0,0 +1,46 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	w := NewWindow[int](10*time.Second, 10)
+	base := time.Unix(1000, 0)
+
+	sum := func(now time.Time) int {
+		total := 0
+		w.Each(now, func(n *int) { total += *n })
+		return total
+	}
+
+	*w.At(base)++
+	*w.At(base.Add(500 * time.Millisecond))++
+	*w.At(base.Add(5 * time.Second))++
+
+	if got := sum(base.Add(5 * time.Second)); got != 3 {
+		t.Fatalf("sum %d, want 3", got)
+	}
+
+	// The first bucket slides out of the window while the later one stays.
+	if got := sum(base.Add(10 * time.Second)); got != 1 {
+		t.Fatalf("sum %d after 10s, want 1", got)
+	}
+
+	// A bucket reused for a later period starts empty.
+	*w.At(base.Add(20 * time.Second))++
+	if got := sum(base.Add(20 * time.Second)); got != 1 {
+		t.Fatalf("sum %d after reuse, want 1", got)
+	}
+
+	// Buckets from the future are not counted.
+	if got := sum(base); got != 0 {
+		t.Fatalf("sum %d looking back, want 0", got)
+	}
+
+	w.Reset()
+	if got := sum(base.Add(20 * time.Second)); got != 0 {
+		t.Fatalf("sum %d after Reset", got)
+	}
+}
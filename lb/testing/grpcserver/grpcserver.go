@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+func readMessage(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+	_, err := io.ReadFull(r, msg)
+
+	return msg, err
+}
+
+func writeMessage(w io.Writer, msg []byte) error {
+	var hdr [5]byte
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(msg)))
+
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+
+	_, err := w.Write(msg)
+	return err
+}
+
+func decodeString(msg []byte) string {
+	if len(msg) < 2 || msg[0] != 0x0a || int(msg[1]) > len(msg)-2 {
+		return ""
+	}
+
+	return string(msg[2 : 2+msg[1]])
+}
+
+func encodeString(s string) []byte {
+	return append([]byte{0x0a, byte(len(s))}, s...)
+}
+
+func sayHello(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("gRPC backend received", r.URL.Path, "grpc-timeout", r.Header.Get("Grpc-Timeout"))
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	req, err := readMessage(r.Body)
+	if err != nil {
+		w.Header().Set("Grpc-Status", "13")
+		w.Header().Set("Grpc-Message", "malformed request")
+		return
+	}
+
+	writeMessage(w, encodeString("Hello "+decodeString(req)+" from gRPC backend"))
+	w.Header().Set("Grpc-Status", "0")
+}
+
+// A minimal gRPC backend for helloworld.Greeter/SayHello, speaking h2c
+// without a gRPC library. Messages are hand-encoded protobuf with a single
+// string field 1 (HelloRequest.name / HelloReply.message).
+func main() {
+	http.HandleFunc("/helloworld.Greeter/SayHello", sayHello)
+
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	srv := &http.Server{Addr: ":8083", Protocols: protocols}
+
+	fmt.Println("gRPC backend running on :8083")
+	srv.ListenAndServe()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go_loadbalancer/lb/internal/backend"
+	"go_loadbalancer/lb/internal/registry"
+	"go_loadbalancer/lb/internal/retry"
+	"go_loadbalancer/lb/internal/strategy/roundrobin"
+)
+
+// newPool serves each handler over h2c and returns them as one pool, in
+// order.
+func newPool(t *testing.T, handlers ...http.HandlerFunc) *registry.BackendRegistry {
+	t.Helper()
+
+	reg := registry.NewRegistry()
+	for _, h := range handlers {
+		srv := httptest.NewUnstartedServer(h)
+		srv.Config.Protocols = new(http.Protocols)
+		srv.Config.Protocols.SetHTTP1(true)
+		srv.Config.Protocols.SetUnencryptedHTTP2(true)
+		srv.Start()
+		t.Cleanup(srv.Close)
+
+		opts := backend.DefaultOptions(5 * time.Second)
+		opts.Protocol = backend.H2C
+
+		b, err := backend.CreateNewBackendWithOptions(srv.URL, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reg.Add(b)
+	}
+
+	return reg
+}
+
+func helloRequest(name string) *http.Request {
+	var body bytes.Buffer
+	writeMessage(&body, encodeString(name))
+
+	req := httptest.NewRequest(http.MethodPost, "/helloworld.Greeter/SayHello", &body)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	return req
+}
+
+func checkReply(t *testing.T, w *httptest.ResponseRecorder) {
+	t.Helper()
+
+	if got := w.Header().Get("Grpc-Status"); got != "0" {
+		t.Fatalf("grpc-status %q, want 0", got)
+	}
+
+	msg, err := readMessage(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decodeString(msg); !strings.Contains(got, "Hello world") {
+		t.Fatalf("reply %q", got)
+	}
+}
+
+func grpcPolicy() retry.RetryPolicy {
+	p := retry.DefaultPolicy()
+	p.InitialBackoff = time.Millisecond
+	p.RetryableGRPCStatuses = []int{retry.GRPCUnavailable}
+
+	return p
+}
+
+func TestGRPCStatusRetried(t *testing.T) {
+	var calls atomic.Int32
+	unavailableOnce := func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			// Trailers-only response, as gRPC servers send for errors.
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Grpc-Status", "14")
+			return
+		}
+
+		sayHello(w, r)
+	}
+	reg := newPool(t, unavailableOnce, unavailableOnce)
+
+	w := httptest.NewRecorder()
+	if err := retry.DoWithRetries(w, helloRequest("world"), reg, roundrobin.New(), nil, grpcPolicy()); err != nil {
+		t.Fatal(err)
+	}
+
+	checkReply(t, w)
+	if calls.Load() != 2 {
+		t.Fatalf("%d calls, want 2", calls.Load())
+	}
+}
+
+func TestGRPCHedged(t *testing.T) {
+	stuck := func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}
+	reg := newPool(t, stuck, sayHello)
+
+	hp := retry.HedgePolicy{Delay: 20 * time.Millisecond, MaxHedges: 1}
+
+	w := httptest.NewRecorder()
+	if err := retry.DoWithHedging(w, helloRequest("world"), reg, roundrobin.New(), grpcPolicy(), hp); err != nil {
+		t.Fatal(err)
+	}
+
+	checkReply(t, w)
+}
+
+func TestGRPCNotRetriedWithoutOptIn(t *testing.T) {
+	var calls atomic.Int32
+	reg := newPool(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "14")
+	})
+
+	policy := grpcPolicy()
+	policy.RetryableGRPCStatuses = nil
+
+	retry.DoWithRetries(httptest.NewRecorder(), helloRequest("world"), reg, roundrobin.New(), nil, policy)
+
+	if calls.Load() != 1 {
+		t.Fatalf("%d calls, want 1", calls.Load())
+	}
+}